@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const progressBarWidth = 30
+
+// console renders transfer events for an interactive terminal.
+type console struct {
+	// drawing is set while the progress bar occupies the current line.
+	drawing bool
+	// serving is set when several receivers may be served at once, so
+	// progress is labelled with the receiver it belongs to.
+	serving bool
+	// listening and pushing are set on the receiver and the sender when
+	// the receiver publishes the code and the sender pushes the file.
+	listening bool
+	pushing   bool
+	// session is set for a two-way session, where both sides are peers.
+	session bool
+	// sharing is set on the side sharing a directory for a peer to browse.
+	sharing bool
+}
+
+// peerRole names the peer this side looks up and connects to.
+func (c *console) peerRole() string {
+	if c.session || c.sharing {
+		return "peer"
+	}
+	if c.pushing {
+		return "receiver"
+	}
+	return "sender"
+}
+
+func (c *console) handle(e peerlink.Event) {
+	if e.Kind != peerlink.EventProgress {
+		c.endLine()
+	}
+
+	switch e.Kind {
+	case peerlink.EventBootstrapping:
+		fmt.Println("Connecting to bootstrap nodes...")
+	case peerlink.EventBootstrapped:
+		fmt.Println("Connected to bootstrap nodes!")
+	case peerlink.EventPublishing:
+		fmt.Println("Publishing address to DHT...")
+	case peerlink.EventPublished:
+		fmt.Printf("Published address to DHT!\n\n")
+	case peerlink.EventCode:
+		if c.sharing {
+			fmt.Println("Share the following five words with your peer securely:")
+			fmt.Println(e.Code)
+			fmt.Println("\nWaiting for the peer to browse the directory...")
+			break
+		}
+		if c.session {
+			fmt.Println("Share the following five words with your peer securely:")
+			fmt.Println(e.Code)
+			fmt.Println("\nWaiting for the peer to join the session...")
+			break
+		}
+		if c.listening {
+			fmt.Println("Share the following five words with the sender securely:")
+			fmt.Println(e.Code)
+			fmt.Println("\nWaiting for the sender to connect and push the file...")
+			break
+		}
+		fmt.Println("Share the following five words with the receiver securely:")
+		fmt.Println(e.Code)
+		fmt.Println("\nWaiting for the receiver to connect and request the file...")
+	case peerlink.EventQuerying:
+		fmt.Printf("Querying DHT and connecting to %s...\n", c.peerRole())
+	case peerlink.EventConnected:
+		switch e.Connection {
+		case peerlink.ConnDirect, "":
+			fmt.Printf("Connected to %s %s!\n\n", c.peerRole(), e.Peer.ShortString())
+		default:
+			fmt.Printf("Connected to %s %s through a relay, trying to connect directly...\n", c.peerRole(), e.Peer.ShortString())
+		}
+	case peerlink.EventUpgraded:
+		fmt.Printf("Connected directly to %s %s!\n\n", c.peerRole(), e.Peer.ShortString())
+	case peerlink.EventHandshake:
+		fmt.Println("Handshake completed successfully")
+		if e.Connection == peerlink.ConnRelayed || e.Connection == peerlink.ConnLimited {
+			fmt.Println("The receiver is connected through a relay")
+		}
+	case peerlink.EventTransferring:
+		if e.Metadata != nil {
+			fmt.Printf("Transferring file: %s\n", e.Metadata.Filename)
+		}
+	case peerlink.EventProgress:
+		c.drawProgress(e.Peer, *e.Progress)
+	case peerlink.EventTransferred:
+		fmt.Println("File transferred successfully")
+	case peerlink.EventPresent:
+		if e.Metadata != nil {
+			fmt.Printf("The receiver already has %s, skipping the transfer\n", e.Metadata.Filename)
+		}
+	case peerlink.EventRetrying:
+		if e.Metadata != nil {
+			fmt.Printf("Sending %s failed, retrying: %s\n", e.Metadata.Filename, e.Error)
+		}
+	case peerlink.EventReconnecting:
+		fmt.Printf("Lost the connection to %s, reconnecting...\n", e.Peer)
+	case peerlink.EventReconnected:
+		fmt.Printf("Reconnected to %s\n", e.Peer)
+	case peerlink.EventWaiting:
+		fmt.Println("The sender is busy with other receivers, waiting for a turn...")
+	case peerlink.EventComplete:
+		if c.sharing && e.Metadata != nil {
+			fmt.Printf("The peer fetched %s\n", e.Metadata.Filename)
+		}
+		if c.serving {
+			fmt.Printf("Receiver %s finished\n", e.Peer)
+		}
+	case peerlink.EventFailed:
+		if e.Peer != "" {
+			fmt.Printf("Peer %s failed: %s\n", e.Peer, e.Error)
+		} else {
+			fmt.Printf("Peer failed: %s\n", e.Error)
+		}
+	}
+}
+
+func (c *console) sent(result *peerlink.SendResult) {
+	c.endLine()
+	if result.Skipped {
+		fmt.Printf("\n%s already had the file, nothing was sent\n", result.Peer)
+		return
+	}
+	fmt.Printf("\nFile sent successfully to %s\n", result.Peer)
+	printStats(result.Stats)
+}
+
+func (c *console) served(result *peerlink.ServeResult) {
+	c.endLine()
+	fmt.Printf("\nServed the file to %d receiver(s), %d failed\n", len(result.Receivers), result.Failed)
+}
+
+func (c *console) received(result *peerlink.ReceiveResult) {
+	c.endLine()
+	if result.Skipped {
+		fmt.Printf("\nThe file was already present, verified %s\n", result.Path)
+		return
+	}
+	fmt.Printf("\nFile received successfully and saved as %s\n", result.Path)
+	if len(result.Providers) > 1 {
+		fmt.Printf("Downloaded from %d providers\n", len(result.Providers))
+	}
+	printStats(result.Stats)
+}
+
+func (c *console) synced(result *peerlink.SyncResult) {
+	c.endLine()
+	fmt.Printf("\nDirectory synced with %s: %d file(s) updated, %d unchanged\n", result.Peer, len(result.Updated), result.Unchanged)
+	if len(result.Updated) > 0 {
+		fmt.Printf("%s sent, %s reused from the existing copies\n", formatBytes(result.Literal), formatBytes(result.Matched))
+	}
+}
+
+func (c *console) shared(result *peerlink.ShareResult) {
+	c.endLine()
+	fmt.Printf("\n%s stopped browsing after fetching %d file(s)\n", result.Peer, len(result.Fetched))
+}
+
+func (c *console) listed(path string, entries []peerlink.ShareEntry) {
+	c.endLine()
+	if len(entries) == 0 {
+		fmt.Printf("%s is empty\n", path)
+	}
+	for _, e := range entries {
+		if e.Dir {
+			fmt.Printf("%10s  %s/\n", "", e.Name)
+		} else {
+			fmt.Printf("%10s  %s\n", formatBytes(e.Size), e.Name)
+		}
+	}
+}
+
+// printStats prints the summary of a completed transfer.
+func printStats(stats peerlink.Stats) {
+	fmt.Println("\nTransfer summary:")
+	for _, p := range stats.Phases {
+		fmt.Printf("  %-11s %s\n", p.Name, p.Duration.Round(time.Millisecond))
+	}
+	overhead := ""
+	if stats.Payload > 0 && stats.Wire > stats.Payload {
+		overhead = fmt.Sprintf(" (%.1f%% overhead)", float64(stats.Wire-stats.Payload)/float64(stats.Payload)*100)
+	}
+	fmt.Printf("  %-11s %s payload, %s on the wire%s\n", "data", formatBytes(stats.Payload), formatBytes(stats.Wire), overhead)
+	fmt.Printf("  %-11s %s/s average, %s/s peak\n", "throughput", formatBytes(int64(stats.Average)), formatBytes(int64(stats.Peak)))
+	if stats.RTT > 0 {
+		fmt.Printf("  %-11s %s\n", "rtt", stats.RTT.Round(100*time.Microsecond))
+	}
+	if stats.Path != "" {
+		fmt.Printf("  %-11s %s\n", "path", stats.Path)
+	}
+}
+
+// failed leaves reporting err to main, which prints it on exit.
+func (c *console) failed(err error) {
+	c.endLine()
+}
+
+// hookFailed leaves reporting err to the command, like failed.
+func (c *console) hookFailed(result *peerlink.ReceiveResult, err error) {
+	c.endLine()
+}
+
+// close finishes any line left open by the progress bar.
+func (c *console) close() {
+	c.endLine()
+}
+
+func (c *console) endLine() {
+	if c.drawing {
+		fmt.Println()
+		c.drawing = false
+	}
+}
+
+func (c *console) drawProgress(id peer.ID, p rw.Progress) {
+	fraction := 1.0
+	if p.Total > 0 {
+		fraction = float64(p.Done) / float64(p.Total)
+	}
+	fraction = min(max(fraction, 0), 1)
+	filled := int(fraction * progressBarWidth)
+
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+
+	eta := "--"
+	if p.ETA > 0 {
+		eta = p.ETA.Round(time.Second).String()
+	}
+
+	label := ""
+	if c.serving {
+		label = id.ShortString() + " "
+	}
+	limit := ""
+	if p.Limit > 0 {
+		limit = " (limit " + formatBytes(p.Limit) + "/s)"
+	}
+	fmt.Printf("\r%s[%s] %5.1f%% %s/%s %s/s%s ETA %s\033[K",
+		label, bar, fraction*100, formatBytes(p.Done), formatBytes(p.Total), formatBytes(int64(p.Rate)), limit, eta)
+	c.drawing = true
+}
+
+// formatBytes renders n with a binary unit suffix, e.g. "12.3 MiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/urfave/cli/v2"
+)
+
+func doctorCommand(client *peerlink.Client) *cli.Command {
+	return &cli.Command{
+		Name:  "doctor",
+		Usage: "Diagnose connectivity to the PeerLink network",
+		Flags: []cli.Flag{jsonFlag},
+		Action: func(c *cli.Context) error {
+			report := printCheck
+			if c.Bool(jsonFlag.Name) {
+				enc := json.NewEncoder(os.Stdout)
+				report = func(check peerlink.Check) {
+					_ = enc.Encode(jsonCheck{Time: time.Now(), Event: "check", Check: check})
+				}
+			}
+
+			failed := 0
+			err := client.Doctor(c.Context, func(check peerlink.Check) {
+				if check.Status == peerlink.CheckFail {
+					failed++
+				}
+				report(check)
+			})
+			if err != nil {
+				return err
+			}
+			if failed > 0 {
+				return fmt.Errorf("doctor: %d check(s) failed", failed)
+			}
+			return nil
+		},
+	}
+}
+
+// jsonCheck is a peerlink.Check stamped with the time it was written.
+type jsonCheck struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	peerlink.Check
+}
+
+func printCheck(check peerlink.Check) {
+	fmt.Printf("[%-4s] %-18s %8s  %s\n", check.Status, check.Name, check.Duration.Round(time.Millisecond), check.Detail)
+	for _, item := range check.Items {
+		fmt.Printf("%34s%s\n", "", item)
+	}
+}
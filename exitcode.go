@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+)
+
+// Exit codes returned by the peerlink command. They are part of the CLI's
+// interface and documented in the README; do not renumber them.
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitDeclined    = 3
+	exitWrongCode   = 4
+	exitIntegrity   = 5
+	exitNoProviders = 6
+	exitUnreachable = 7
+	exitTimeout     = 8
+	exitNoBootstrap = 9
+	exitDisconnect  = 10
+	exitRelay       = 11
+	exitInterrupted = 130
+)
+
+// errUsage marks errors caused by invalid command-line usage.
+var errUsage = errors.New("usage error")
+
+// exitCodes maps errors to exit codes, most specific first.
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{context.Canceled, exitInterrupted},
+	{errUsage, exitUsage},
+	{peerlink.ErrInvalidCode, exitUsage},
+	{peerlink.ErrDeclined, exitDeclined},
+	{peerlink.ErrWrongCode, exitWrongCode},
+	{peerlink.ErrIntegrity, exitIntegrity},
+	{peerlink.ErrNoProviders, exitNoProviders},
+	{peerlink.ErrUnreachable, exitUnreachable},
+	{peerlink.ErrNoBootstrap, exitNoBootstrap},
+	{peerlink.ErrDisconnected, exitDisconnect},
+	{peerlink.ErrRelayLimited, exitRelay},
+	{peerlink.ErrTimeout, exitTimeout},
+	{context.DeadlineExceeded, exitTimeout},
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	for _, e := range exitCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return exitFailure
+}
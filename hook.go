@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	preAcceptFlag  = &cli.StringFlag{Name: "pre-accept", Usage: "decide on each offered file by running `CMD` with its metadata as JSON on stdin; exit status 0 accepts it"}
+	onCompleteFlag = &cli.StringFlag{Name: "on-complete", Usage: "run `CMD` after each verified file, replacing {path}, {size}, {sha256} and {peer}"}
+)
+
+// hookMetadata is the offered file as the pre-accept hook sees it.
+type hookMetadata struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256,omitempty"`
+	Peer     string `json:"peer"`
+}
+
+// hookAccept returns an AcceptFunc that runs command with the metadata of
+// the offered file on stdin and accepts the file if it exits with status 0.
+// The output of the command goes to w.
+func hookAccept(command string, w io.Writer) protocol.AcceptFunc {
+	return func(ctx context.Context, metadata protocol.Metadata) (bool, error) {
+		var sender string
+		if p, ok := peerlink.Sender(ctx); ok {
+			sender = p.String()
+		}
+		input, err := json.Marshal(hookMetadata{
+			Filename: metadata.Filename,
+			Size:     metadata.Size,
+			SHA256:   utils.BytesToHex(metadata.Hash),
+			Peer:     sender,
+		})
+		if err != nil {
+			return false, err
+		}
+		cmd := shellCommand(ctx, command, w)
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Env = append(os.Environ(),
+			"PEERLINK_FILENAME="+metadata.Filename,
+			"PEERLINK_SIZE="+strconv.FormatInt(metadata.Size, 10),
+			"PEERLINK_SHA256="+utils.BytesToHex(metadata.Hash),
+			"PEERLINK_PEER="+sender,
+		)
+		err = cmd.Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			fmt.Fprintf(w, "The pre-accept hook declined %s (%s)\n", metadata.Filename, exitErr)
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("pre-accept hook: %w", err)
+		}
+		return true, nil
+	}
+}
+
+// runOnComplete runs command for a received file, once it passed its
+// checksum check.
+func runOnComplete(ctx context.Context, command string, result *peerlink.ReceiveResult, w io.Writer) error {
+	cmd := shellCommand(ctx, expandPlaceholders(command), w)
+	cmd.Env = append(os.Environ(),
+		"PEERLINK_PATH="+result.Path,
+		"PEERLINK_SIZE="+strconv.FormatInt(result.Size, 10),
+		"PEERLINK_SHA256="+utils.BytesToHex(result.Hash),
+		"PEERLINK_PEER="+result.Peer.String(),
+		"PEERLINK_FILENAME="+result.Metadata.Filename,
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("on-complete hook: %w", err)
+	}
+	return nil
+}
+
+// expandPlaceholders replaces the placeholders in command with references
+// to the environment variables holding their values. The shell expands
+// them without parsing the values, so a hostile file name cannot inject
+// commands.
+func expandPlaceholders(command string) string {
+	ref := func(name string) string { return `"$` + name + `"` }
+	if runtime.GOOS == "windows" {
+		ref = func(name string) string { return `"%` + name + `%"` }
+	}
+	return strings.NewReplacer(
+		"{path}", ref("PEERLINK_PATH"),
+		"{size}", ref("PEERLINK_SIZE"),
+		"{sha256}", ref("PEERLINK_SHA256"),
+		"{peer}", ref("PEERLINK_PEER"),
+	).Replace(command)
+}
+
+// shellCommand runs command through the system shell, writing its output
+// to w.
+func shellCommand(ctx context.Context, command string, w io.Writer) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	return cmd
+}
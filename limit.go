@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/urfave/cli/v2"
+)
+
+var limitFlag = &cli.StringFlag{Name: "limit", Usage: "cap the bandwidth of the file data at `RATE`, such as 10MB/s or 512KiB/s"}
+
+// newLimiter returns the limiter selected by --limit, or nil without one.
+func newLimiter(c *cli.Context) (*peerlink.Limiter, error) {
+	if !c.IsSet(limitFlag.Name) {
+		return nil, nil
+	}
+	rate, err := rw.ParseRate(c.String(limitFlag.Name))
+	if err != nil {
+		return nil, fmt.Errorf("%w: --limit: %w", errUsage, err)
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+	return peerlink.NewLimiter(rate), nil
+}
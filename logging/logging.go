@@ -0,0 +1,60 @@
+// Package logging builds the structured logger shared by the PeerLink
+// packages and can route libp2p's own logs into it.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Options selects where logs go and how much is written.
+type Options struct {
+	Level slog.Level
+	// Format is either "text" (the default) or "json".
+	Format string
+	// File, if set, receives the logs instead of stderr.
+	File string
+}
+
+// New returns a logger configured by opts and a function that releases the
+// log file, if any.
+func New(opts Options) (*slog.Logger, func() error, error) {
+	var w io.Writer = os.Stderr
+	closeFn := func() error { return nil }
+	if opts.File != "" {
+		f, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("logging: failed to open log file: %w", err)
+		}
+		w = f
+		closeFn = f.Close
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: opts.Level}
+	var handler slog.Handler
+	switch opts.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, handlerOpts)
+	case "json":
+		handler = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		closeFn()
+		return nil, nil, fmt.Errorf("logging: unknown log format %q", opts.Format)
+	}
+	return slog.New(handler), closeFn, nil
+}
+
+// Discard returns a logger that drops everything.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+// OrDiscard returns logger, or a discarding logger if it is nil.
+func OrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return Discard()
+	}
+	return logger
+}
@@ -4,72 +4,103 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/SyedMa3/peerlink/p2p"
-	"github.com/briandowns/spinner"
+	"github.com/SyedMa3/peerlink/logging"
+	"github.com/SyedMa3/peerlink/peerlink"
 	"github.com/urfave/cli/v2"
 )
 
 func main() {
-	// Create a new libp2p host with DHT
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
+	go func() {
+		// After the first signal, let a second one kill the process outright
+		<-ctx.Done()
+		cancel()
+	}()
 
-	fmt.Printf("Starting PeerLink...\n\n")
+	client := &peerlink.Client{}
+	closeLog := func() error { return nil }
 
 	app := &cli.App{
 		Name:  "peerlink",
 		Usage: "A peer-to-peer file sharing application",
+		Flags: append([]cli.Flag{
+			&cli.BoolFlag{Name: "verbose", Aliases: []string{"v"}, Usage: "log debug diagnostics"},
+			&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, Usage: "log errors only"},
+			&cli.StringFlag{Name: "log-format", Value: "text", Usage: "log format: text or json"},
+			&cli.StringFlag{Name: "log-file", Usage: "write logs to `FILE` instead of stderr"},
+			&cli.StringFlag{Name: "libp2p-log", Usage: "route libp2p logs at `LEVEL` (debug, info, warn, error) into the log"},
+		}, networkFlags...),
+		Before: func(c *cli.Context) error {
+			network, err := newNetwork(c)
+			if err != nil {
+				return err
+			}
+			client.Network = network
+
+			logger, closeFn, err := newLogger(c)
+			if err != nil {
+				return err
+			}
+			client.Logger = logger
+			closeLog = closeFn
+			return nil
+		},
+		After: func(c *cli.Context) error {
+			return closeLog()
+		},
 		Commands: []*cli.Command{
-			{
-				Name:      "send",
-				Usage:     "Send a file",
-				ArgsUsage: "<filename>",
-				Action: func(c *cli.Context) error {
-					if c.NArg() < 1 {
-						return fmt.Errorf("filename is required")
-					}
-					filename := c.Args().First()
-					node, err := initNode(ctx)
-					if err != nil {
-						return fmt.Errorf("failed to initialize node: %v", err)
-					}
-					defer node.Host.Close()
-					return p2p.HandleSend(ctx, node, filename)
-				},
-			},
-			{
-				Name:      "receive",
-				Usage:     "Receive a file",
-				ArgsUsage: "<input-passphrase>",
-				Action: func(c *cli.Context) error {
-					if c.NArg() < 1 {
-						return fmt.Errorf("input passphrase is required")
-					}
-					passphrase := c.Args().First()
-					node, err := initNode(ctx)
-					if err != nil {
-						return fmt.Errorf("failed to initialize node: %v", err)
-					}
-					defer node.Host.Close()
-					return p2p.HandleReceive(ctx, node, passphrase)
-				},
-			},
+			sendCommand(client),
+			receiveCommand(client),
+			sessionCommand(client),
+			syncCommand(client),
+			watchCommand(client),
+			roomCommand(client),
+			shareCommand(client),
+			browseCommand(client),
+			doctorCommand(client),
 		},
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		log.Print(err)
+		cancel()
+		os.Exit(exitCode(err))
 	}
 }
 
-func initNode(ctx context.Context) (*p2p.Node, error) {
-	s := spinner.New(spinner.CharSets[7], 100*time.Millisecond)
-	s.Suffix = " Connecting to bootstrap nodes...\n"
-	s.FinalMSG = "Connected to bootstrap nodes!\n"
-	s.Start()
-	defer s.Stop()
-	return p2p.NewNode(ctx)
+// newLogger builds the logger selected by the global flags.
+func newLogger(c *cli.Context) (*slog.Logger, func() error, error) {
+	if c.Bool("verbose") && c.Bool("quiet") {
+		return nil, nil, fmt.Errorf("%w: --verbose and --quiet are mutually exclusive", errUsage)
+	}
+	level := slog.LevelWarn
+	switch {
+	case c.Bool("verbose"):
+		level = slog.LevelDebug
+	case c.Bool("quiet"):
+		level = slog.LevelError
+	}
+
+	logger, closeFn, err := logging.New(logging.Options{
+		Level:  level,
+		Format: c.String("log-format"),
+		File:   c.String("log-file"),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if lvl := c.String("libp2p-log"); lvl != "" {
+		if err := logging.BridgeLibp2p(logger, lvl); err != nil {
+			closeFn()
+			return nil, nil, err
+		}
+	}
+	return logger, closeFn, nil
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/urfave/cli/v2"
+)
+
+// networkFlags select how the node connects to peers.
+var networkFlags = []cli.Flag{
+	&cli.StringSliceFlag{Name: "transport", Usage: "only use these transports: tcp, quic, websocket, webtransport, webrtc-direct (repeatable)"},
+	&cli.StringSliceFlag{Name: "listen", Usage: "listen on this `MULTIADDR`, e.g. /ip4/0.0.0.0/tcp/443 (repeatable)"},
+	&cli.BoolFlag{Name: "upnp", Usage: "ask the router to forward a port over UPnP or NAT-PMP"},
+	&cli.StringSliceFlag{Name: "relay", Usage: "reserve a slot on the relay at this `MULTIADDR` (with /p2p/<id>) instead of the bootstrap nodes (repeatable)"},
+	&cli.StringSliceFlag{Name: "announce", Usage: "only announce some addresses: lan, public, no-ipv4, no-ipv6, no-loopback, no-relay (repeatable)"},
+}
+
+// newNetwork builds the network configuration selected by the global flags.
+func newNetwork(c *cli.Context) (peerlink.Network, error) {
+	announce, err := p2p.ParseAnnounceFilter(c.StringSlice("announce"))
+	if err != nil {
+		return peerlink.Network{}, fmt.Errorf("%w: %w", errUsage, err)
+	}
+	network := peerlink.Network{
+		Transports:  c.StringSlice("transport"),
+		ListenAddrs: c.StringSlice("listen"),
+		PortMapping: c.Bool("upnp"),
+		Announce:    announce,
+		Relays:      c.StringSlice("relay"),
+	}
+	if err := network.Validate(); err != nil {
+		return peerlink.Network{}, fmt.Errorf("%w: %w", errUsage, err)
+	}
+	return network, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/urfave/cli/v2"
+)
+
+// output presents the course and outcome of a command to the user.
+type output interface {
+	handle(e peerlink.Event)
+	sent(result *peerlink.SendResult)
+	served(result *peerlink.ServeResult)
+	received(result *peerlink.ReceiveResult)
+	synced(result *peerlink.SyncResult)
+	shared(result *peerlink.ShareResult)
+	listed(path string, entries []peerlink.ShareEntry)
+	failed(err error)
+	// hookFailed reports that the on-complete hook failed for a file that
+	// was received.
+	hookFailed(result *peerlink.ReceiveResult, err error)
+	close()
+}
+
+var jsonFlag = &cli.BoolFlag{Name: "json", Usage: "print newline-delimited JSON events instead of human-readable output"}
+
+func newOutput(c *cli.Context) output {
+	if c.Bool(jsonFlag.Name) {
+		return &jsonOutput{enc: json.NewEncoder(os.Stdout)}
+	}
+	fmt.Printf("Starting PeerLink...\n\n")
+	return &console{}
+}
+
+// jsonOutput writes one JSON object per line to stdout.
+type jsonOutput struct {
+	enc *json.Encoder
+}
+
+// jsonEvent is a peerlink.Event stamped with the time it was written.
+type jsonEvent struct {
+	Time time.Time `json:"time"`
+	peerlink.Event
+}
+
+// jsonResult is the final line written for a successful transfer.
+type jsonResult struct {
+	Time      time.Time       `json:"time"`
+	Event     string          `json:"event"`
+	Code      string          `json:"code,omitempty"`
+	Peer      string          `json:"peer"`
+	Filename  string          `json:"filename"`
+	Path      string          `json:"path,omitempty"`
+	Size      int64           `json:"size"`
+	SHA256    string          `json:"sha256"`
+	Skipped   bool            `json:"skipped,omitempty"`
+	Providers []string        `json:"providers,omitempty"`
+	Stats     *peerlink.Stats `json:"stats,omitempty"`
+}
+
+type jsonError struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Error string    `json:"error"`
+}
+
+// jsonHookError is written when the on-complete hook failed for a received
+// file.
+type jsonHookError struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Peer  string    `json:"peer"`
+	Path  string    `json:"path"`
+	Error string    `json:"error"`
+}
+
+func (o *jsonOutput) write(v any) {
+	// Encoding these types cannot fail and a broken stdout has nowhere to be reported.
+	_ = o.enc.Encode(v)
+}
+
+func (o *jsonOutput) handle(e peerlink.Event) {
+	o.write(jsonEvent{Time: time.Now(), Event: e})
+}
+
+func (o *jsonOutput) sent(result *peerlink.SendResult) {
+	o.write(jsonResult{
+		Time:     time.Now(),
+		Event:    "result",
+		Code:     result.Code,
+		Peer:     result.Peer.String(),
+		Filename: result.Metadata.Filename,
+		Size:     result.Metadata.Size,
+		SHA256:   utils.BytesToHex(result.Hash),
+		Skipped:  result.Skipped,
+		Stats:    &result.Stats,
+	})
+}
+
+// jsonServed is the final line written when serving ends.
+type jsonServed struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Code      string    `json:"code"`
+	Receivers []string  `json:"receivers"`
+	Failed    int       `json:"failed"`
+}
+
+func (o *jsonOutput) served(result *peerlink.ServeResult) {
+	receivers := make([]string, 0, len(result.Receivers))
+	for _, r := range result.Receivers {
+		receivers = append(receivers, r.Peer.String())
+	}
+	o.write(jsonServed{
+		Time:      time.Now(),
+		Event:     "result",
+		Code:      result.Code,
+		Receivers: receivers,
+		Failed:    result.Failed,
+	})
+}
+
+func (o *jsonOutput) received(result *peerlink.ReceiveResult) {
+	var providers []string
+	for _, p := range result.Providers {
+		providers = append(providers, p.String())
+	}
+	o.write(jsonResult{
+		Time:      time.Now(),
+		Event:     "result",
+		Peer:      result.Peer.String(),
+		Filename:  result.Metadata.Filename,
+		Path:      result.Path,
+		Size:      result.Size,
+		SHA256:    utils.BytesToHex(result.Hash),
+		Skipped:   result.Skipped,
+		Providers: providers,
+		Stats:     &result.Stats,
+	})
+}
+
+// jsonSynced is the final line written for a completed directory sync.
+type jsonSynced struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	Code      string    `json:"code,omitempty"`
+	Peer      string    `json:"peer"`
+	Updated   []string  `json:"updated"`
+	Unchanged int       `json:"unchanged"`
+	Literal   int64     `json:"literal"`
+	Matched   int64     `json:"matched"`
+}
+
+func (o *jsonOutput) synced(result *peerlink.SyncResult) {
+	o.write(jsonSynced{
+		Time:      time.Now(),
+		Event:     "result",
+		Code:      result.Code,
+		Peer:      result.Peer.String(),
+		Updated:   append([]string{}, result.Updated...),
+		Unchanged: result.Unchanged,
+		Literal:   result.Literal,
+		Matched:   result.Matched,
+	})
+}
+
+// jsonShared is the final line written when the peer browsing a share
+// left.
+type jsonShared struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Code    string    `json:"code"`
+	Peer    string    `json:"peer"`
+	Fetched []string  `json:"fetched"`
+}
+
+func (o *jsonOutput) shared(result *peerlink.ShareResult) {
+	o.write(jsonShared{
+		Time:    time.Now(),
+		Event:   "result",
+		Code:    result.Code,
+		Peer:    result.Peer.String(),
+		Fetched: append([]string{}, result.Fetched...),
+	})
+}
+
+// jsonListing is written for each directory of a share listed.
+type jsonListing struct {
+	Time    time.Time             `json:"time"`
+	Event   string                `json:"event"`
+	Path    string                `json:"path"`
+	Entries []peerlink.ShareEntry `json:"entries"`
+}
+
+func (o *jsonOutput) listed(path string, entries []peerlink.ShareEntry) {
+	o.write(jsonListing{
+		Time:    time.Now(),
+		Event:   "listing",
+		Path:    path,
+		Entries: append([]peerlink.ShareEntry{}, entries...),
+	})
+}
+
+func (o *jsonOutput) failed(err error) {
+	o.write(jsonError{Time: time.Now(), Event: "error", Error: err.Error()})
+}
+
+func (o *jsonOutput) hookFailed(result *peerlink.ReceiveResult, err error) {
+	o.write(jsonHookError{Time: time.Now(), Event: "hook_failed", Peer: result.Peer.String(), Path: result.Path, Error: err.Error()})
+}
+
+func (o *jsonOutput) close() {}
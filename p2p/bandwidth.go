@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// wireCounter is a libp2p bandwidth counter that also keeps exact totals
+// per peer. The counter itself only updates its totals once a second, which
+// misses the end of a short transfer.
+type wireCounter struct {
+	*metrics.BandwidthCounter
+
+	mu    sync.Mutex
+	peers map[peer.ID]int64
+}
+
+func newWireCounter() *wireCounter {
+	return &wireCounter{
+		BandwidthCounter: metrics.NewBandwidthCounter(),
+		peers:            make(map[peer.ID]int64),
+	}
+}
+
+func (c *wireCounter) LogSentMessageStream(size int64, proto protocol.ID, p peer.ID) {
+	c.BandwidthCounter.LogSentMessageStream(size, proto, p)
+	c.add(p, size)
+}
+
+func (c *wireCounter) LogRecvMessageStream(size int64, proto protocol.ID, p peer.ID) {
+	c.BandwidthCounter.LogRecvMessageStream(size, proto, p)
+	c.add(p, size)
+}
+
+func (c *wireCounter) add(p peer.ID, size int64) {
+	c.mu.Lock()
+	c.peers[p] += size
+	c.mu.Unlock()
+}
+
+// WireBytes returns how many bytes the node sent to and received from p over
+// its streams, encryption and framing included.
+func (n *Node) WireBytes(p peer.ID) int64 {
+	if n.wire == nil {
+		return 0
+	}
+	n.wire.mu.Lock()
+	defer n.wire.mu.Unlock()
+	return n.wire.peers[p]
+}
+
+// trackRelayed remembers the peers the node was connected to through a
+// relay, so that Path can tell a hole-punched connection from one that was
+// direct from the start.
+func (n *Node) trackRelayed() {
+	n.relayed = make(map[peer.ID]bool)
+	n.Host.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			if isRelayed(conn.RemoteMultiaddr()) {
+				n.relayedMu.Lock()
+				n.relayed[conn.RemotePeer()] = true
+				n.relayedMu.Unlock()
+			}
+		},
+	})
+}
@@ -0,0 +1,323 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SyedMa3/peerlink/logging"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/p2p/host/eventbus"
+	"github.com/libp2p/go-libp2p/p2p/protocol/autonatv2"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Outcomes of a diagnostic Check.
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+	CheckSkip = "skip"
+)
+
+// How long each diagnostic step may take.
+const (
+	doctorBootstrapTimeout    = 30 * time.Second
+	doctorReachabilityTimeout = 45 * time.Second
+	doctorRelayTimeout        = 30 * time.Second
+	doctorDHTTimeout          = 60 * time.Second
+)
+
+// Check is the outcome of one step of Diagnose.
+type Check struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Duration time.Duration `json:"duration"`
+	Detail   string        `json:"detail,omitempty"`
+	// Items lists the individual results behind the check, such as one
+	// line per bootstrap node.
+	Items []string `json:"items,omitempty"`
+}
+
+// Diagnose sets up a node the way NewNode does and reports each step to
+// report as it completes: bootstrap connections, observed addresses, NAT
+// reachability, relay reservations and a DHT provide/find round trip. It
+// stops with an error when a step the later ones depend on fails; other
+// problems are only reported.
+func Diagnose(ctx context.Context, cfg Config, report func(Check)) error {
+	logger := logging.OrDiscard(cfg.Logger)
+	d := &doctor{report: report}
+
+	// Host
+	var h host.Host
+	err := d.step("host", func(c *Check) error {
+		var err error
+		if h, err = newLibp2pHost(cfg); err != nil {
+			return err
+		}
+		c.Detail = h.ID().String()
+		for _, addr := range h.Network().ListenAddresses() {
+			c.Items = append(c.Items, "listening on "+addr.String())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	// Subscribe before connecting so that no reachability change is missed.
+	sub, err := h.EventBus().Subscribe([]interface{}{
+		new(event.EvtLocalReachabilityChanged),
+		new(event.EvtNATDeviceTypeChanged),
+	}, eventbus.BufSize(16))
+	if err != nil {
+		return fmt.Errorf("Diagnose: failed to subscribe to reachability events: %w", err)
+	}
+	defer sub.Close()
+
+	// A second AutoNAT v2 client so that its result can be read back; the
+	// one libp2p runs internally does not expose it.
+	dialer, err := libp2p.New(libp2p.NoListenAddrs)
+	if err != nil {
+		return fmt.Errorf("Diagnose: failed to create dial-back host: %w", err)
+	}
+	defer dialer.Close()
+	an, err := autonatv2.New(h, dialer)
+	if err != nil {
+		return fmt.Errorf("Diagnose: failed to create AutoNAT v2 client: %w", err)
+	}
+	if err := an.Start(); err != nil {
+		return fmt.Errorf("Diagnose: failed to start AutoNAT v2 client: %w", err)
+	}
+	defer an.Close()
+
+	// Bootstrap
+	kademliaDHT, err := dht.New(ctx, h)
+	if err != nil {
+		return fmt.Errorf("Diagnose: failed to create DHT: %w", err)
+	}
+	defer kademliaDHT.Close()
+	err = d.step("bootstrap", func(c *Check) error {
+		bctx, cancel := context.WithTimeout(ctx, doctorBootstrapTimeout)
+		defer cancel()
+		results := connectBootstrap(bctx, h, logger)
+		connected := 0
+		for _, r := range results {
+			if r.Err != nil {
+				c.Items = append(c.Items, fmt.Sprintf("%s failed after %s: %v", r.Peer, r.Duration.Round(time.Millisecond), r.Err))
+				continue
+			}
+			connected++
+			c.Items = append(c.Items, fmt.Sprintf("%s connected in %s", r.Peer, r.Duration.Round(time.Millisecond)))
+		}
+		c.Detail = fmt.Sprintf("%d of %d bootstrap nodes", connected, len(results))
+		if connected == 0 {
+			return ErrNoBootstrap
+		}
+		if connected < len(results) {
+			c.Status = CheckWarn
+		}
+		return kademliaDHT.Bootstrap(ctx)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.step("observed addresses", func(c *Check) error {
+		var observed []ma.Multiaddr
+		if ids, ok := h.(interface{ IDService() identify.IDService }); ok {
+			observed = ids.IDService().OwnObservedAddrs()
+		}
+		for _, addr := range observed {
+			c.Items = append(c.Items, "observed "+addr.String())
+		}
+		for _, addr := range h.Addrs() {
+			c.Items = append(c.Items, "announced "+addr.String())
+		}
+		c.Detail = fmt.Sprintf("%d observed by peers", len(observed))
+		if len(observed) == 0 {
+			c.Status = CheckWarn
+			c.Detail = "no peer reported the address it sees us at"
+		}
+		return nil
+	})
+
+	reachability := network.ReachabilityUnknown
+	d.step("reachability", func(c *Check) error {
+		rctx, cancel := context.WithTimeout(ctx, doctorReachabilityTimeout)
+		defer cancel()
+		nat := make(map[network.NATTransportProtocol]network.NATDeviceType)
+		for reachability == network.ReachabilityUnknown {
+			select {
+			case e := <-sub.Out():
+				switch e := e.(type) {
+				case event.EvtLocalReachabilityChanged:
+					reachability = e.Reachability
+				case event.EvtNATDeviceTypeChanged:
+					nat[e.TransportProtocol] = e.NatDeviceType
+				}
+			case <-rctx.Done():
+				c.Status = CheckWarn
+				c.Detail = "AutoNAT did not determine reachability in time"
+				return nil
+			}
+		}
+		c.Detail = "AutoNAT reports " + reachability.String()
+		for proto, kind := range nat {
+			c.Items = append(c.Items, fmt.Sprintf("%s behind %s", proto, kind))
+		}
+		if reachability == network.ReachabilityPrivate {
+			c.Status = CheckWarn
+		}
+		return nil
+	})
+
+	d.step("autonat v2", func(c *Check) error {
+		var public []ma.Multiaddr
+		for _, addr := range h.Addrs() {
+			if manet.IsPublicAddr(addr) && !isRelayed(addr) {
+				public = append(public, addr)
+			}
+		}
+		if len(public) == 0 {
+			c.Status = CheckWarn
+			c.Detail = "no public address to verify"
+			return nil
+		}
+		rctx, cancel := context.WithTimeout(ctx, doctorReachabilityTimeout)
+		defer cancel()
+		reachable := 0
+		for _, addr := range public {
+			res, err := an.GetReachability(rctx, []autonatv2.Request{{Addr: addr, SendDialData: true}})
+			switch {
+			case errors.Is(err, autonatv2.ErrNoValidPeers):
+				c.Status = CheckWarn
+				c.Detail = "no connected peer offers AutoNAT v2"
+				return nil
+			case err != nil:
+				c.Items = append(c.Items, fmt.Sprintf("%s: %v", addr, withTimeout(rctx, err)))
+			default:
+				if res.Reachability == network.ReachabilityPublic {
+					reachable++
+				}
+				c.Items = append(c.Items, fmt.Sprintf("%s: %s", res.Addr, res.Reachability))
+			}
+		}
+		c.Detail = fmt.Sprintf("%d of %d public addresses reachable", reachable, len(public))
+		if reachable == 0 {
+			c.Status = CheckWarn
+		}
+		return nil
+	})
+
+	d.step("relay reservation", func(c *Check) error {
+		if reachability != network.ReachabilityPrivate {
+			c.Status = CheckSkip
+			c.Detail = "only needed when not reachable directly"
+			return nil
+		}
+		rctx, cancel := context.WithTimeout(ctx, doctorRelayTimeout)
+		defer cancel()
+		for {
+			var circuits []ma.Multiaddr
+			for _, addr := range h.Addrs() {
+				if isRelayed(addr) {
+					circuits = append(circuits, addr)
+				}
+			}
+			if len(circuits) > 0 {
+				for _, addr := range circuits {
+					c.Items = append(c.Items, addr.String())
+				}
+				c.Detail = fmt.Sprintf("%d relay addresses", len(circuits))
+				return nil
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-rctx.Done():
+				c.Status = CheckFail
+				c.Detail = "no relay accepted a reservation; peers behind NAT cannot reach us"
+				return nil
+			}
+		}
+	})
+
+	// DHT round trip
+	key, err := testCid()
+	if err != nil {
+		return fmt.Errorf("Diagnose: %w", err)
+	}
+	err = d.step("dht provide", func(c *Check) error {
+		c.Detail = key.String()
+		pctx, cancel := context.WithTimeout(ctx, doctorDHTTimeout)
+		defer cancel()
+		c.Items = append(c.Items, fmt.Sprintf("%d peers in routing table", kademliaDHT.RoutingTable().Size()))
+		return withTimeout(pctx, kademliaDHT.Provide(pctx, key, true))
+	})
+	if err != nil {
+		return err
+	}
+	return d.step("dht find", func(c *Check) error {
+		fctx, cancel := context.WithTimeout(ctx, doctorDHTTimeout)
+		defer cancel()
+		other, otherDHT, err := NewHost(fctx, Config{Logger: logger, Network: cfg.Network})
+		if err != nil {
+			return fmt.Errorf("failed to start a second node: %w", err)
+		}
+		defer other.Close()
+		defer otherDHT.Close()
+		for provider := range otherDHT.FindProvidersAsync(fctx, key, 0) {
+			c.Items = append(c.Items, "found provider "+provider.ID.String())
+			if provider.ID == h.ID() {
+				c.Detail = "a second node found this one"
+				return nil
+			}
+		}
+		if fctx.Err() != nil {
+			return withTimeout(fctx, fctx.Err())
+		}
+		return ErrNoProviders
+	})
+}
+
+type doctor struct {
+	report func(Check)
+}
+
+// step runs fn, timing it and reporting the check it fills in. Any error
+// fn returns marks the check as failed and is returned.
+func (d *doctor) step(name string, fn func(*Check) error) error {
+	c := Check{Name: name, Status: CheckOK}
+	start := time.Now()
+	err := fn(&c)
+	c.Duration = time.Since(start)
+	if err != nil {
+		c.Status = CheckFail
+		c.Detail = err.Error()
+		err = fmt.Errorf("%s: %w", name, err)
+	}
+	if d.report != nil {
+		d.report(c)
+	}
+	return err
+}
+
+// testCid derives a CID from fresh random words, the way a transfer code
+// is turned into its rendezvous CID.
+func testCid() (cid.Cid, error) {
+	words, err := protocol.GenerateRandomWords()
+	if err != nil {
+		return cid.Undef, fmt.Errorf("failed to generate random words: %w", err)
+	}
+	return protocol.GenerateCIDFromWordAndTime(words[:4])
+}
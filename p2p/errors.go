@@ -0,0 +1,33 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/SyedMa3/peerlink/protocol"
+)
+
+var (
+	// ErrNoBootstrap is returned when none of the bootstrap nodes could be reached.
+	ErrNoBootstrap = errors.New("could not connect to any bootstrap node")
+	// ErrNoProviders is returned when nobody is sharing under the code.
+	ErrNoProviders = errors.New("no peer found for this code")
+	// ErrUnreachable is returned when peers were found but none could be connected to.
+	ErrUnreachable = errors.New("could not connect to any peer found for this code")
+	// ErrDisconnected is returned when the peer went away mid-transfer.
+	ErrDisconnected = errors.New("peer disconnected")
+	// ErrRelayLimited is returned when the peers are only connected through
+	// a relay whose limits are too tight for the file.
+	ErrRelayLimited = errors.New("only connected through a limited relay, which cannot carry the file")
+	// ErrTimeout is returned when a network operation ran out of time.
+	ErrTimeout = protocol.ErrTimeout
+)
+
+// withTimeout marks err as ErrTimeout if it was caused by ctx's deadline.
+func withTimeout(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
@@ -2,112 +2,295 @@ package p2p
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/SyedMa3/peerlink/logging"
 	"github.com/SyedMa3/peerlink/protocol"
-	"github.com/briandowns/spinner"
 	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/metrics"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
+// Config controls how a Node is set up.
+type Config struct {
+	// Logger receives the node's diagnostics. A nil Logger discards them.
+	Logger *slog.Logger
+	// Network selects transports, listen addresses and the addresses
+	// announced to peers.
+	Network Network
+
+	// reporter, if set, counts the bytes the host exchanges with peers.
+	reporter metrics.Reporter
+}
+
 type Node struct {
-	Host      host.Host
-	DHT       *dht.IpfsDHT
-	words     []string
-	cid       cid.Cid
-	sharedKey []byte
+	Host   host.Host
+	DHT    *dht.IpfsDHT
+	Logger *slog.Logger
+	words  []string
+	cid    cid.Cid
+
+	wire      *wireCounter
+	relayedMu sync.Mutex
+	relayed   map[peer.ID]bool
 }
 
-func NewNode(ctx context.Context) (*Node, error) {
-	h, kademliaDHT, err := NewHost(ctx)
+func NewNode(ctx context.Context, cfg Config) (*Node, error) {
+	cfg.Logger = logging.OrDiscard(cfg.Logger)
+	wire := newWireCounter()
+	cfg.reporter = wire
+
+	h, kademliaDHT, err := NewHost(ctx, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create host: %w", err)
 	}
 
-	return &Node{
-		Host: h,
-		DHT:  kademliaDHT,
-	}, nil
+	n := &Node{
+		Host:   h,
+		DHT:    kademliaDHT,
+		Logger: cfg.Logger.With("peer", h.ID()),
+		wire:   wire,
+	}
+	n.trackRelayed()
+	return n, nil
 }
 
-func NewHost(ctx context.Context) (host.Host, *dht.IpfsDHT, error) {
-	h, err := libp2p.New(
-		libp2p.EnableHolePunching(),
-		libp2p.EnableAutoNATv2(),
-		libp2p.EnableAutoRelayWithStaticRelays(dht.GetDefaultBootstrapPeerAddrInfos()),
-	)
+func NewHost(ctx context.Context, cfg Config) (host.Host, *dht.IpfsDHT, error) {
+	logger := logging.OrDiscard(cfg.Logger)
+
+	h, err := newLibp2pHost(cfg)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create libp2p host: %w", err)
+		return nil, nil, err
 	}
+	logger.Debug("created libp2p host", "peer", h.ID(), "addrs", h.Addrs())
 
 	kademliaDHT, err := dht.New(ctx, h)
 	if err != nil {
+		h.Close()
 		return nil, nil, fmt.Errorf("failed to create DHT: %w", err)
 	}
 
-	bootstrapPeers := dht.GetDefaultBootstrapPeerAddrInfos()
-	count := 0
+	if err := bootstrap(ctx, h, kademliaDHT, logger); err != nil {
+		kademliaDHT.Close()
+		h.Close()
+		return nil, nil, err
+	}
+	return h, kademliaDHT, nil
+}
+
+// newLibp2pHost creates the libp2p host configured by cfg.
+func newLibp2pHost(cfg Config) (host.Host, error) {
+	networkOpts, err := cfg.Network.options()
+	if err != nil {
+		return nil, fmt.Errorf("invalid network configuration: %w", err)
+	}
+	opts := append([]libp2p.Option{
+		libp2p.EnableHolePunching(),
+		libp2p.EnableAutoNATv2(),
+	}, networkOpts...)
+	if cfg.reporter != nil {
+		opts = append(opts, libp2p.BandwidthReporter(cfg.reporter))
+	}
+	h, err := libp2p.New(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create libp2p host: %w", err)
+	}
+	return h, nil
+}
 
+// BootstrapResult is the outcome of connecting to one bootstrap node.
+type BootstrapResult struct {
+	Peer     peer.ID
+	Duration time.Duration
+	Err      error
+}
+
+// connectBootstrap connects h to the default bootstrap nodes.
+func connectBootstrap(ctx context.Context, h host.Host, logger *slog.Logger) []BootstrapResult {
+	bootstrapPeers := dht.GetDefaultBootstrapPeerAddrInfos()
+	results := make([]BootstrapResult, 0, len(bootstrapPeers))
 	for _, peerInfo := range bootstrapPeers {
-		if err := h.Connect(ctx, peerInfo); err != nil {
-			fmt.Printf("failed to connect to bootstrap node %s: %v", peerInfo.ID, err)
-		} else {
-			count++
+		start := time.Now()
+		err := h.Connect(ctx, peerInfo)
+		if err != nil {
+			logger.Debug("failed to connect to bootstrap node", "bootstrap", peerInfo.ID, "err", err)
+		}
+		results = append(results, BootstrapResult{Peer: peerInfo.ID, Duration: time.Since(start), Err: err})
+	}
+	return results
+}
+
+// bootstrap connects h to the bootstrap nodes and bootstraps the DHT.
+func bootstrap(ctx context.Context, h host.Host, kademliaDHT *dht.IpfsDHT, logger *slog.Logger) error {
+	start := time.Now()
+	results := connectBootstrap(ctx, h, logger)
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("bootstrap node %s: %w", r.Peer, r.Err))
 		}
 	}
+	logger.Info("connected to bootstrap nodes",
+		"connected", len(results)-len(errs), "total", len(results), "duration", time.Since(start))
 
-	if count == 0 {
-		return nil, nil, fmt.Errorf("failed to connect to any bootstrap nodes")
+	if len(errs) == len(results) {
+		return fmt.Errorf("%w: %w", ErrNoBootstrap, withTimeout(ctx, errors.Join(errs...)))
 	}
 
-	if err = kademliaDHT.Bootstrap(ctx); err != nil {
-		return nil, nil, fmt.Errorf("failed to bootstrap DHT: %w", err)
+	if err := kademliaDHT.Bootstrap(ctx); err != nil {
+		return fmt.Errorf("failed to bootstrap DHT: %w", err)
 	}
+	return nil
+}
 
-	return h, kademliaDHT, nil
+// RemoveHandlers stops serving the PeerLink protocols, so that peers still
+// finding this node under the current code fail straight away. It does not
+// withdraw the provider record published to the DHT: the DHT has no way of
+// deleting one, so it stays until it expires, and the code it was published
+// under changes daily.
+func (n *Node) RemoveHandlers() {
+	n.RemoveScopedHandlers("")
+}
+
+// RemoveScopedHandlers stops serving the file transfer named scope, as
+// described for Scoped.
+func (n *Node) RemoveScopedHandlers(scope string) {
+	for _, id := range fileProtocols {
+		n.Host.RemoveStreamHandler(Scoped(id, scope))
+	}
 }
 
-func (n *Node) QueryAndConnect(ctx context.Context) (*peer.AddrInfo, error) {
+// Close shuts down the DHT and the underlying host.
+func (n *Node) Close() error {
+	return errors.Join(n.DHT.Close(), n.Host.Close())
+}
+
+// QueryAndConnect connects to the first reachable provider of the current
+// code and reports how it is connected. Providers only reachable through a
+// relay are connected to as well; use WaitForDirect to give hole punching a
+// chance to upgrade such a connection.
+func (n *Node) QueryAndConnect(ctx context.Context) (*peer.AddrInfo, ConnKind, error) {
 	providers, err := n.QueryAddress(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query DHT: %w", err)
+		return nil, "", fmt.Errorf("failed to query DHT: %w", err)
 	}
 
+	return n.Connect(ctx, providers)
+}
+
+// Connect connects to the first reachable of providers and reports how it is
+// connected, relayed connections included.
+func (n *Node) Connect(ctx context.Context, providers []peer.AddrInfo) (*peer.AddrInfo, ConnKind, error) {
 	if len(providers) == 0 {
-		return nil, fmt.Errorf("no providers found for the given CID")
+		return nil, "", withTimeout(ctx, ErrNoProviders)
 	}
 
-	var connectedSender peer.AddrInfo
-	var connected bool
-
-	s := spinner.New(spinner.CharSets[7], 100*time.Millisecond)
-	s.Suffix = " Connecting to sender...\n"
-	s.FinalMSG = "Connected to sender!\n\n"
-	s.Start()
-	defer s.Stop()
+	var errs []error
+	ctx = network.WithAllowLimitedConn(ctx, "peerlink")
 	for _, senderInfo := range providers {
 		if err := n.Host.Connect(ctx, senderInfo); err != nil {
-			fmt.Printf("failed to connect to sender %v\n", err)
+			n.Logger.Warn("failed to connect to sender", "sender", senderInfo.ID, "err", err)
+			errs = append(errs, fmt.Errorf("sender %s: %w", senderInfo.ID, err))
 			continue
 		}
-		connectedSender = senderInfo
-		connected = true
-		break
+		for _, conn := range n.Host.Network().ConnsToPeer(senderInfo.ID) {
+			n.Logger.Info("connected to sender", "sender", senderInfo.ID, "addr", conn.RemoteMultiaddr(), "limited", conn.Stat().Limited)
+		}
+		return &senderInfo, n.ConnKind(senderInfo.ID), nil
+	}
+
+	return nil, "", fmt.Errorf("%w: %w", ErrUnreachable, withTimeout(ctx, errors.Join(errs...)))
+}
+
+// QueryAndConnectAll connects to up to limit providers of the current code at
+// once and returns those it reached. No more than limit are dialed at a time,
+// and dialing stops once limit are connected. A non-positive limit connects
+// to all of them.
+func (n *Node) QueryAndConnectAll(ctx context.Context, limit int) ([]peer.AddrInfo, error) {
+	providers, err := n.QueryAddress(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DHT: %w", err)
 	}
 
-	if !connected {
-		s.FinalMSG = "Failed to connect to any sender\n\n"
-		return nil, fmt.Errorf("failed to connect to any sender")
+	if len(providers) == 0 {
+		return nil, withTimeout(ctx, ErrNoProviders)
 	}
 
-	return &connectedSender, nil
+	queue := make(chan peer.AddrInfo, len(providers))
+	for _, senderInfo := range providers {
+		if senderInfo.ID != n.Host.ID() {
+			queue <- senderInfo
+		}
+	}
+	close(queue)
+	workers := len(queue)
+	if limit > 0 {
+		workers = min(workers, limit)
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		connected []peer.AddrInfo
+		dialing   int
+		errs      []error
+	)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for senderInfo := range queue {
+				mu.Lock()
+				if limit > 0 && len(connected)+dialing >= limit {
+					mu.Unlock()
+					return
+				}
+				dialing++
+				mu.Unlock()
+
+				err := n.Host.Connect(ctx, senderInfo)
+				mu.Lock()
+				dialing--
+				if err != nil {
+					n.Logger.Warn("failed to connect to sender", "sender", senderInfo.ID, "err", err)
+					errs = append(errs, fmt.Errorf("sender %s: %w", senderInfo.ID, err))
+				} else {
+					n.Logger.Info("connected to sender", "sender", senderInfo.ID)
+					connected = append(connected, senderInfo)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(connected) == 0 {
+		return nil, fmt.Errorf("%w: %w", ErrUnreachable, withTimeout(ctx, errors.Join(errs...)))
+	}
+	return connected, nil
+}
+
+// Words returns the secret words of the current session.
+func (n *Node) Words() []string {
+	return n.words
 }
 
-func (n *Node) generateWordsAndCid() error {
+// Code returns the secret words joined into the code shared with the peer.
+func (n *Node) Code() string {
+	return strings.Join(n.words, "-")
+}
+
+// GenerateWordsAndCid picks fresh secret words and derives the rendezvous CID from them.
+func (n *Node) GenerateWordsAndCid() error {
 	words, err := protocol.GenerateRandomWords()
 	if err != nil {
 		return fmt.Errorf("failed to generate random words: %w", err)
@@ -121,7 +304,22 @@ func (n *Node) generateWordsAndCid() error {
 	return nil
 }
 
-func (n *Node) setWordsAndCid(words []string) error {
+// RefreshCid re-derives the rendezvous CID for the current day and reports
+// whether it changed, in which case the address has to be published again.
+func (n *Node) RefreshCid() (bool, error) {
+	cid, err := protocol.GenerateCIDFromWordAndTime(n.words[:4])
+	if err != nil {
+		return false, fmt.Errorf("failed to generate CID: %w", err)
+	}
+	if cid.Equals(n.cid) {
+		return false, nil
+	}
+	n.cid = cid
+	return true, nil
+}
+
+// SetWordsAndCid adopts words received from the peer and derives the rendezvous CID from them.
+func (n *Node) SetWordsAndCid(words []string) error {
 	cid, err := protocol.GenerateCIDFromWordAndTime(words[:4])
 	if err != nil {
 		return fmt.Errorf("failed to generate CID: %w", err)
@@ -0,0 +1,114 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// RelayDataLimit is how much data a limited relay circuit carries before the
+// relay cuts it, per the circuit relay v2 defaults. Relays may enforce less,
+// but the actual limit is not reported to the ends of the circuit.
+const RelayDataLimit = 128 << 10
+
+// ConnKind describes how a node is connected to a peer.
+type ConnKind string
+
+const (
+	// ConnDirect is a connection without a relay in between.
+	ConnDirect ConnKind = "direct"
+	// ConnRelayed goes through a relay that does not limit it.
+	ConnRelayed ConnKind = "relayed"
+	// ConnLimited goes through a relay that cuts it after RelayDataLimit
+	// bytes or a couple of minutes.
+	ConnLimited ConnKind = "limited-relay"
+	// ConnHolePunched is a direct connection that replaced a relayed one,
+	// as reported by Path.
+	ConnHolePunched ConnKind = "hole-punched"
+)
+
+// isRelayed reports whether addr goes through a circuit relay.
+func isRelayed(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// ConnKind reports the best connection the node has to p, or an empty
+// ConnKind if there is none.
+func (n *Node) ConnKind(p peer.ID) ConnKind {
+	var kind ConnKind
+	for _, conn := range n.Host.Network().ConnsToPeer(p) {
+		switch {
+		case !isRelayed(conn.RemoteMultiaddr()):
+			return ConnDirect
+		case !conn.Stat().Limited:
+			kind = ConnRelayed
+		case kind == "":
+			kind = ConnLimited
+		}
+	}
+	return kind
+}
+
+// Path is like ConnKind, but tells a direct connection established by hole
+// punching after a relayed one apart as ConnHolePunched.
+func (n *Node) Path(p peer.ID) ConnKind {
+	kind := n.ConnKind(p)
+	n.relayedMu.Lock()
+	defer n.relayedMu.Unlock()
+	if kind == ConnDirect && n.relayed[p] {
+		return ConnHolePunched
+	}
+	return kind
+}
+
+// WaitForDirect waits until the node has a direct connection to p, which
+// hole punching (DCUtR) may establish shortly after a relayed one, or until
+// ctx is done. It returns the best connection kind to p by then.
+func (n *Node) WaitForDirect(ctx context.Context, p peer.ID) ConnKind {
+	upgraded := make(chan struct{}, 1)
+	notifee := &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			if conn.RemotePeer() == p && !isRelayed(conn.RemoteMultiaddr()) {
+				select {
+				case upgraded <- struct{}{}:
+				default:
+				}
+			}
+		},
+	}
+	n.Host.Network().Notify(notifee)
+	defer n.Host.Network().StopNotify(notifee)
+
+	if kind := n.ConnKind(p); kind == ConnDirect {
+		return kind
+	}
+	select {
+	case <-upgraded:
+		n.Logger.Info("connection upgraded to direct", "peer", p)
+	case <-ctx.Done():
+		n.Logger.Info("no direct connection established", "peer", p, "err", ctx.Err())
+	}
+	return n.ConnKind(p)
+}
+
+// relayInfos parses the relays of the network, falling back to the
+// bootstrap nodes, which double as relays.
+func (n Network) relayInfos() ([]peer.AddrInfo, error) {
+	if len(n.Relays) == 0 {
+		return dht.GetDefaultBootstrapPeerAddrInfos(), nil
+	}
+	infos := make([]peer.AddrInfo, 0, len(n.Relays))
+	for _, s := range n.Relays {
+		info, err := peer.AddrInfoFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay address %q: %w", s, err)
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
@@ -0,0 +1,205 @@
+package p2p
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/libp2p/go-libp2p"
+	libp2pquic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	libp2pwebrtc "github.com/libp2p/go-libp2p/p2p/transport/webrtc"
+	ws "github.com/libp2p/go-libp2p/p2p/transport/websocket"
+	webtransport "github.com/libp2p/go-libp2p/p2p/transport/webtransport"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Transports that can be selected in Network.Transports.
+const (
+	TransportTCP          = "tcp"
+	TransportQUIC         = "quic"
+	TransportWebSocket    = "websocket"
+	TransportWebTransport = "webtransport"
+	TransportWebRTCDirect = "webrtc-direct"
+)
+
+// transports maps each selectable transport to its libp2p constructor and
+// the addresses it listens on unless told otherwise.
+var transports = map[string]struct {
+	option libp2p.Option
+	listen []string
+}{
+	TransportTCP: {
+		libp2p.Transport(tcp.NewTCPTransport),
+		[]string{"/ip4/0.0.0.0/tcp/0", "/ip6/::/tcp/0"},
+	},
+	TransportQUIC: {
+		libp2p.Transport(libp2pquic.NewTransport),
+		[]string{"/ip4/0.0.0.0/udp/0/quic-v1", "/ip6/::/udp/0/quic-v1"},
+	},
+	TransportWebSocket: {
+		libp2p.Transport(ws.New),
+		[]string{"/ip4/0.0.0.0/tcp/0/ws", "/ip6/::/tcp/0/ws"},
+	},
+	TransportWebTransport: {
+		libp2p.Transport(webtransport.New),
+		[]string{"/ip4/0.0.0.0/udp/0/quic-v1/webtransport", "/ip6/::/udp/0/quic-v1/webtransport"},
+	},
+	TransportWebRTCDirect: {
+		libp2p.Transport(libp2pwebrtc.New),
+		[]string{"/ip4/0.0.0.0/udp/0/webrtc-direct", "/ip6/::/udp/0/webrtc-direct"},
+	},
+}
+
+// Network selects how a node reaches and is reached by its peers. The zero
+// value uses the libp2p defaults.
+type Network struct {
+	// Transports restricts the node to the named transports, see the
+	// Transport constants. Empty means every transport libp2p supports.
+	Transports []string
+	// ListenAddrs are the multiaddrs to listen on, such as
+	// "/ip4/0.0.0.0/tcp/443". Empty means every interface on a random
+	// port for each selected transport.
+	ListenAddrs []string
+	// PortMapping asks the router to forward a port to the node over UPnP
+	// or NAT-PMP.
+	PortMapping bool
+	// Announce filters the addresses the node advertises to peers.
+	Announce AnnounceFilter
+	// Relays are the multiaddrs, including /p2p/<id>, of the relays the
+	// node reserves a slot on when it is not reachable directly. Empty
+	// means the public bootstrap nodes.
+	Relays []string
+}
+
+// AnnounceFilter selects which of its addresses a node advertises. The zero
+// value advertises all of them.
+type AnnounceFilter struct {
+	LANOnly    bool // only private and loopback addresses
+	PublicOnly bool // only public addresses
+	NoIPv4     bool
+	NoIPv6     bool
+	NoLoopback bool
+	NoRelay    bool // no addresses through a circuit relay
+}
+
+// announceFilters names the filters accepted by ParseAnnounceFilter.
+var announceFilters = map[string]func(*AnnounceFilter){
+	"lan":         func(f *AnnounceFilter) { f.LANOnly = true },
+	"public":      func(f *AnnounceFilter) { f.PublicOnly = true },
+	"no-ipv4":     func(f *AnnounceFilter) { f.NoIPv4 = true },
+	"no-ipv6":     func(f *AnnounceFilter) { f.NoIPv6 = true },
+	"no-loopback": func(f *AnnounceFilter) { f.NoLoopback = true },
+	"no-relay":    func(f *AnnounceFilter) { f.NoRelay = true },
+}
+
+// ParseAnnounceFilter builds a filter from names such as "lan" or "no-ipv6".
+func ParseAnnounceFilter(names []string) (AnnounceFilter, error) {
+	var f AnnounceFilter
+	for _, name := range names {
+		set, ok := announceFilters[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return f, fmt.Errorf("ParseAnnounceFilter: unknown filter %q", name)
+		}
+		set(&f)
+	}
+	if f.LANOnly && f.PublicOnly {
+		return f, fmt.Errorf("ParseAnnounceFilter: lan and public exclude each other")
+	}
+	return f, nil
+}
+
+// isZero reports whether f lets every address through.
+func (f AnnounceFilter) isZero() bool {
+	return f == AnnounceFilter{}
+}
+
+// keep reports whether addr passes the filter.
+func (f AnnounceFilter) keep(addr ma.Multiaddr) bool {
+	if f.NoRelay && isRelayed(addr) {
+		return false
+	}
+	if _, err := addr.ValueForProtocol(ma.P_IP4); err == nil && f.NoIPv4 {
+		return false
+	}
+	if _, err := addr.ValueForProtocol(ma.P_IP6); err == nil && f.NoIPv6 {
+		return false
+	}
+	loopback := manet.IsIPLoopback(addr)
+	switch {
+	case f.NoLoopback && loopback:
+		return false
+	case f.LANOnly && !loopback && !manet.IsPrivateAddr(addr):
+		return false
+	case f.PublicOnly && !manet.IsPublicAddr(addr):
+		return false
+	}
+	return true
+}
+
+func (f AnnounceFilter) apply(addrs []ma.Multiaddr) []ma.Multiaddr {
+	kept := make([]ma.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if f.keep(addr) {
+			kept = append(kept, addr)
+		}
+	}
+	return kept
+}
+
+// Validate reports unknown transports and malformed listen or relay
+// addresses.
+func (n Network) Validate() error {
+	_, err := n.options()
+	return err
+}
+
+// options translates the network settings into libp2p options.
+func (n Network) options() ([]libp2p.Option, error) {
+	relays, err := n.relayInfos()
+	if err != nil {
+		return nil, err
+	}
+	opts := []libp2p.Option{libp2p.EnableAutoRelayWithStaticRelays(relays)}
+
+	var listen []string
+	if len(n.Transports) > 0 {
+		seen := make(map[string]bool)
+		for _, name := range n.Transports {
+			name = strings.ToLower(strings.TrimSpace(name))
+			t, ok := transports[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown transport %q", name)
+			}
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			opts = append(opts, t.option)
+			listen = append(listen, t.listen...)
+		}
+	}
+
+	if len(n.ListenAddrs) > 0 {
+		listen = n.ListenAddrs
+	}
+	if len(listen) > 0 {
+		addrs := make([]ma.Multiaddr, 0, len(listen))
+		for _, s := range listen {
+			addr, err := ma.NewMultiaddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid listen address %q: %w", s, err)
+			}
+			addrs = append(addrs, addr)
+		}
+		opts = append(opts, libp2p.ListenAddrs(addrs...))
+	}
+
+	if n.PortMapping {
+		opts = append(opts, libp2p.NATPortMap())
+	}
+	if !n.Announce.isZero() {
+		opts = append(opts, libp2p.AddrsFactory(n.Announce.apply))
+	}
+	return opts, nil
+}
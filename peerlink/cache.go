@@ -0,0 +1,145 @@
+package peerlink
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/utils"
+)
+
+// presentCopy is a copy of the offered file the receiver already holds.
+type presentCopy struct {
+	// path is the file the sink would have saved, which is kept as it is.
+	path string
+	// cached is the file in the cache, which is copied to the sink.
+	cached string
+}
+
+// findPresent looks for the offered file in the sink and then in the cache.
+// Both are checked against the offered checksum.
+func (r *receiver) findPresent(sink Sink, metadata protocol.Metadata) *presentCopy {
+	if len(metadata.Hash) != sha256.Size || metadata.Attrs != nil && metadata.Attrs.Link != "" {
+		return nil
+	}
+	if finder, ok := sink.(Finder); ok {
+		if path, ok := finder.Find(metadata); ok {
+			return &presentCopy{path: path}
+		}
+	}
+	if r.opts.Cache != "" {
+		cached := filepath.Join(r.opts.Cache, utils.BytesToHex(metadata.Hash))
+		if sameContent(cached, metadata.Size, metadata.Hash) {
+			return &presentCopy{cached: cached}
+		}
+	}
+	return nil
+}
+
+// receivePresent completes the transfer of a file the sender was told the
+// receiver already holds, copying it from the cache if needed.
+func (r *receiver) receivePresent(ctx context.Context, sink Sink, found *presentCopy, result *ReceiveResult) error {
+	result.Skipped = true
+	result.Size = result.Metadata.Size
+	result.Hash = result.Metadata.Hash
+	r.opts.emit(Event{Kind: EventPresent, Peer: r.peer, Metadata: &result.Metadata})
+
+	if found.path != "" {
+		result.Path = found.path
+	} else if err := r.copyCached(sink, found.cached, result); err != nil {
+		// Let the sender know instead of leaving it waiting
+		if checkErr := r.completeCheck(ctx, false); checkErr != nil {
+			r.node.Logger.Warn("failed to report the failed copy to sender", "err", checkErr)
+		}
+		return fmt.Errorf("receivePresent: %w", err)
+	}
+	r.node.Logger.Info("file already present", "sender", r.peer, "path", result.Path, "cached", found.cached)
+
+	if err := r.completeCheck(ctx, true); err != nil {
+		return fmt.Errorf("receivePresent: %w", err)
+	}
+	result.Stats = r.stats
+	result.Stats.measure(r.node, r.peer, 0, nil)
+	return nil
+}
+
+// copyCached writes the cached copy of the file to sink, checking it
+// against the offered checksum on the way.
+func (r *receiver) copyCached(sink Sink, cached string, result *ReceiveResult) (err error) {
+	file, err := os.Open(cached)
+	if err != nil {
+		return fmt.Errorf("failed to open cached copy: %w", err)
+	}
+	defer file.Close()
+
+	w, err := sink.Create(result.Metadata)
+	if err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hasher), file)
+	if err != nil {
+		err = fmt.Errorf("failed to copy cached copy: %w", err)
+	} else if n != result.Metadata.Size || !bytes.Equal(hasher.Sum(nil), result.Metadata.Hash) {
+		err = fmt.Errorf("cached copy %s changed: %w", cached, protocol.ErrIntegrity)
+	}
+	if err != nil {
+		finishSink(w, err, r.node.Logger)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to save file: %w", err)
+	}
+	if named, ok := w.(interface{ Name() string }); ok {
+		result.Path = named.Name()
+	}
+	return nil
+}
+
+// addToCache links the received file into the cache, or copies it there if
+// linking fails, for instance because the cache is on another file system.
+// Failures only cost future transfers, so they are logged.
+func (r *receiver) addToCache(result *ReceiveResult) {
+	if r.opts.Cache == "" || result.Path == "" || len(result.Hash) != sha256.Size {
+		return
+	}
+	if attrs := result.Metadata.Attrs; attrs != nil && attrs.Link != "" {
+		return
+	}
+	cached := filepath.Join(r.opts.Cache, utils.BytesToHex(result.Hash))
+	if _, err := os.Lstat(cached); err == nil {
+		return
+	}
+	err := os.MkdirAll(r.opts.Cache, 0o755)
+	if err == nil && os.Link(result.Path, cached) != nil {
+		err = copyFile(result.Path, cached)
+	}
+	if err != nil {
+		r.node.Logger.Warn("failed to add file to cache", "path", result.Path, "cache", r.opts.Cache, "err", err)
+	}
+}
+
+// copyFile copies the file at src to the new file dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err = errors.Join(err, out.Close()); err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
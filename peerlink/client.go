@@ -0,0 +1,179 @@
+// Package peerlink is an embeddable API for sending and receiving files over
+// PeerLink. Nothing in this package prints, prompts or panics: progress is
+// reported through Options.OnEvent and decisions are delegated to callbacks.
+package peerlink
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Errors returned by Send and Receive, re-exported from the packages that
+// produce them. Match them with errors.Is.
+var (
+	ErrInvalidCode  = protocol.ErrInvalidCode
+	ErrDeclined     = protocol.ErrDeclined
+	ErrBusy         = protocol.ErrBusy
+	ErrWrongCode    = protocol.ErrWrongCode
+	ErrIntegrity    = protocol.ErrIntegrity
+	ErrNoBootstrap  = p2p.ErrNoBootstrap
+	ErrNoProviders  = p2p.ErrNoProviders
+	ErrUnreachable  = p2p.ErrUnreachable
+	ErrTimeout      = p2p.ErrTimeout
+	ErrDisconnected = p2p.ErrDisconnected
+	ErrRelayLimited = p2p.ErrRelayLimited
+)
+
+// ConnKind describes how the peers are connected.
+type ConnKind = p2p.ConnKind
+
+const (
+	ConnDirect  = p2p.ConnDirect
+	ConnRelayed = p2p.ConnRelayed
+	ConnLimited = p2p.ConnLimited
+)
+
+// Client sends and receives files. The zero value is ready to use.
+type Client struct {
+	// Logger receives structured diagnostics. A nil Logger discards them.
+	Logger *slog.Logger
+	// Network selects the transports, listen addresses and announced
+	// addresses of the nodes the client starts. The zero value uses the
+	// libp2p defaults.
+	Network Network
+}
+
+// Limiter caps the bandwidth of a transfer, see Options.Limit.
+type Limiter = rw.Limiter
+
+// NewLimiter returns a Limiter passing rate bytes per second.
+func NewLimiter(rate int64) *Limiter {
+	return rw.NewLimiter(rate)
+}
+
+// Network configures how the nodes started by a Client connect to peers.
+type Network = p2p.Network
+
+// AnnounceFilter selects the addresses a node advertises to peers.
+type AnnounceFilter = p2p.AnnounceFilter
+
+// Options configures a single Send or Receive call.
+type Options struct {
+	// OnEvent, if set, is called as the transfer moves through its stages
+	// and, while data is flowing, with EventProgress events on both sides.
+	// It is called synchronously and must not block.
+	OnEvent func(Event)
+
+	// Accept decides whether to receive an offered file. A nil Accept
+	// takes every file. Only used by Receive.
+	Accept protocol.AcceptFunc
+
+	// Timeouts bounds the individual phases of the transfer.
+	Timeouts Timeouts
+
+	// Streams is how many parallel streams Receive fetches the file over,
+	// which helps on links with a high round-trip time. Zero picks a
+	// number from the file size and the round-trip time to the sender.
+	// It is capped at 16. Sinks whose writers do not implement both
+	// io.WriterAt and io.ReaderAt always use one.
+	Streams int
+
+	// Limit caps the bandwidth the file data may use, shared by all of
+	// its streams and, when serving, by all receivers. Nil means no limit.
+	// Its rate may be changed with SetRate while the transfer runs.
+	Limit *Limiter
+
+	// Cache is a directory of files received before, each named after the
+	// hex encoding of its checksum. An accepted file found there is copied
+	// from it instead of being transferred, and every file received into a
+	// named file is added to it. Empty means no cache. Only used by Receive.
+	Cache string
+
+	// Preserve offers the permissions, times and extended attributes of
+	// the file along with it, and symbolic links from LinkSource as links.
+	// On the receiving side it applies them and keeps the holes of sparse
+	// files. Both sides must set it.
+	Preserve bool
+
+	// Policy, if set, declines offered files that break its rules before
+	// Accept is asked about them. Only used by Receive.
+	Policy *Policy
+}
+
+func (o Options) emit(e Event) {
+	if o.OnEvent != nil {
+		o.OnEvent(e)
+	}
+}
+
+// meter returns a meter for a payload of total bytes exchanged with p,
+// which reports EventProgress events if anybody is listening.
+func (o Options) meter(p peer.ID, total int64) *rw.Meter {
+	if o.OnEvent == nil {
+		return rw.NewMeter(total, nil)
+	}
+	return rw.NewMeter(total, func(progress rw.Progress) {
+		progress.Limit = o.Limit.Rate()
+		o.emit(Event{Kind: EventProgress, Peer: p, Progress: &progress})
+	})
+}
+
+func (o Options) accept(ctx context.Context, sender peer.ID, metadata protocol.Metadata) (bool, error) {
+	if o.Accept == nil || o.Policy.trusts(sender) {
+		return true, nil
+	}
+	return o.Accept(context.WithValue(ctx, senderKey{}, sender), metadata)
+}
+
+type senderKey struct{}
+
+// Sender returns the peer offering the file, given the context passed to
+// Options.Accept.
+func Sender(ctx context.Context) (peer.ID, bool) {
+	sender, ok := ctx.Value(senderKey{}).(peer.ID)
+	return sender, ok
+}
+
+// SendResult describes a completed Send.
+type SendResult struct {
+	Code     string
+	Peer     peer.ID
+	Metadata protocol.Metadata
+	Hash     []byte
+	// Skipped reports that the receiver already held the file, so that
+	// no data was transferred.
+	Skipped bool
+	Stats   Stats
+}
+
+// ReceiveResult describes a completed Receive.
+type ReceiveResult struct {
+	Peer     peer.ID
+	Metadata protocol.Metadata
+	// Path is the location the file was saved to, if the sink wrote to a named file.
+	Path string
+	Size int64
+	Hash []byte
+	// Skipped reports that the file was not transferred because the sink
+	// or the cache already held it.
+	Skipped bool
+	// Providers lists the providers a swarm download fetched chunks from.
+	Providers []peer.ID
+	Stats     Stats
+}
+
+func (c *Client) newNode(ctx context.Context, opts Options) (*p2p.Node, error) {
+	opts.emit(Event{Kind: EventBootstrapping})
+	node, err := p2p.NewNode(ctx, p2p.Config{Logger: c.Logger, Network: c.Network})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize node: %w", err)
+	}
+	opts.emit(Event{Kind: EventBootstrapped})
+	return node, nil
+}
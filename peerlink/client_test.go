@@ -0,0 +1,27 @@
+package peerlink
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestAcceptSender(t *testing.T) {
+	sender := peer.ID("sender")
+	var got peer.ID
+	opts := Options{Accept: func(ctx context.Context, metadata protocol.Metadata) (bool, error) {
+		got, _ = Sender(ctx)
+		return true, nil
+	}}
+	if _, err := opts.accept(context.Background(), sender, protocol.Metadata{Filename: "a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if got != sender {
+		t.Fatalf("Accept saw sender %q, want %q", got, sender)
+	}
+	if _, ok := Sender(context.Background()); ok {
+		t.Fatal("a context from outside Accept has a sender")
+	}
+}
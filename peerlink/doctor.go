@@ -0,0 +1,26 @@
+package peerlink
+
+import (
+	"context"
+
+	"github.com/SyedMa3/peerlink/p2p"
+)
+
+// Check is the outcome of one diagnostic step run by Doctor.
+type Check = p2p.Check
+
+// Outcomes of a Check.
+const (
+	CheckOK   = p2p.CheckOK
+	CheckWarn = p2p.CheckWarn
+	CheckFail = p2p.CheckFail
+	CheckSkip = p2p.CheckSkip
+)
+
+// Doctor sets up a node the way Send and Receive do and diagnoses its
+// connectivity, calling report with each step as it completes. It returns
+// an error if a step the later ones depend on fails, such as connecting to
+// the bootstrap nodes.
+func (c *Client) Doctor(ctx context.Context, report func(Check)) error {
+	return p2p.Diagnose(ctx, p2p.Config{Logger: c.Logger, Network: c.Network}, report)
+}
@@ -0,0 +1,59 @@
+package peerlink
+
+import (
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// EventKind identifies a stage of a transfer.
+type EventKind string
+
+const (
+	EventBootstrapping EventKind = "bootstrapping"
+	EventBootstrapped  EventKind = "bootstrapped"
+	EventPublishing    EventKind = "publishing"
+	EventPublished     EventKind = "published"
+	EventCode          EventKind = "code"
+	EventQuerying      EventKind = "querying"
+	EventConnected     EventKind = "connected"
+	EventHandshake     EventKind = "handshake"
+	EventMetadata      EventKind = "metadata"
+	EventAccepted      EventKind = "accepted"
+	EventTransferring  EventKind = "transferring"
+	EventProgress      EventKind = "progress"
+	EventTransferred   EventKind = "transferred"
+	EventComplete      EventKind = "complete"
+	// EventFailed reports a receiver whose session failed while Serve
+	// carries on with the others.
+	EventFailed EventKind = "failed"
+	// EventWaiting reports that the sender is busy and Receive will retry.
+	EventWaiting EventKind = "waiting"
+	// EventUpgraded reports that a relayed connection was replaced by a
+	// direct one.
+	EventUpgraded EventKind = "upgraded"
+	// EventPresent reports that the receiver already holds the offered
+	// file, so that it is not transferred.
+	EventPresent EventKind = "present"
+	// EventRetrying reports that Watch failed to send a file and will try
+	// again.
+	EventRetrying EventKind = "retrying"
+	// EventReconnecting reports that the connection to the peer of a
+	// session dropped and is being restored; EventReconnected that it was.
+	EventReconnecting EventKind = "reconnecting"
+	EventReconnected  EventKind = "reconnected"
+)
+
+// Event reports progress through a transfer. Only the fields relevant to
+// Kind are set, and only those appear in its JSON encoding.
+type Event struct {
+	Kind EventKind `json:"event"`
+	Code string    `json:"code,omitempty"`
+	Peer peer.ID   `json:"peer,omitempty"`
+	// Connection tells how the peers are connected on EventConnected,
+	// EventHandshake and EventUpgraded.
+	Connection ConnKind           `json:"connection,omitempty"`
+	Metadata   *protocol.Metadata `json:"metadata,omitempty"`
+	Progress   *rw.Progress       `json:"progress,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
@@ -0,0 +1,137 @@
+package peerlink
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func accessTime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(stat.Atim.Unix())
+}
+
+// readXattrs returns the extended attributes of the file at path in the
+// user namespace, leaving them all out if they exceed maxXattrBytes.
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if errors.Is(err, syscall.ENOTSUP) || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+	list := make([]byte, size)
+	if size, err = syscall.Listxattr(path, list); err != nil {
+		return nil, fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+
+	xattrs := make(map[string][]byte)
+	total := 0
+	for _, name := range bytes.Split(list[:size], []byte{0}) {
+		if !strings.HasPrefix(string(name), xattrPrefix) {
+			continue
+		}
+		size, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read extended attribute %s: %w", name, err)
+		}
+		value := make([]byte, size)
+		if size, err = syscall.Getxattr(path, string(name), value); err != nil {
+			return nil, fmt.Errorf("failed to read extended attribute %s: %w", name, err)
+		}
+		total += len(name) + size
+		if total > maxXattrBytes {
+			return nil, nil
+		}
+		xattrs[string(name)] = value[:size]
+	}
+	return xattrs, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	if err := syscall.Setxattr(path, name, value, 0); err != nil {
+		return fmt.Errorf("failed to set extended attribute %s: %w", name, err)
+	}
+	return nil
+}
+
+// freeSpace returns the bytes available to unprivileged users on the file
+// system holding dir.
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * stat.Bsize, nil
+}
+
+// preallocate reserves size bytes for file, unless the file system cannot.
+func preallocate(file *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
+
+// watchChanges reports the names of the entries of dir that are created,
+// written or moved in, using inotify. An empty name means that events were
+// lost and dir has to be scanned again. The channel is closed once ctx is
+// done.
+func watchChanges(ctx context.Context, dir string) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	const mask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	// The descriptor is non-blocking, so closing the file interrupts Read
+	events := os.NewFile(uintptr(fd), "inotify")
+	context.AfterFunc(ctx, func() { events.Close() })
+
+	changes := make(chan string, 64)
+	go func() {
+		defer close(changes)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := events.Read(buf)
+			if err != nil {
+				return
+			}
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				event := buf[off:]
+				mask := binary.NativeEndian.Uint32(event[4:])
+				length := int(binary.NativeEndian.Uint32(event[12:]))
+				name := string(bytes.TrimRight(event[syscall.SizeofInotifyEvent:syscall.SizeofInotifyEvent+length], "\x00"))
+				off += syscall.SizeofInotifyEvent + length
+				if mask&syscall.IN_Q_OVERFLOW != 0 {
+					name = ""
+				} else if name == "" {
+					continue
+				}
+				select {
+				case changes <- name:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return changes, nil
+}
@@ -0,0 +1,16 @@
+package peerlink
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCheckSpace(t *testing.T) {
+	sink := DirSink(t.TempDir()).(SpaceChecker)
+	if err := sink.CheckSpace(1); err != nil {
+		t.Fatalf("one byte does not fit: %v", err)
+	}
+	if err := sink.CheckSpace(math.MaxInt64); err == nil {
+		t.Fatal("the largest possible file fits")
+	}
+}
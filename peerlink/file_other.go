@@ -0,0 +1,41 @@
+//go:build !linux
+
+package peerlink
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+func accessTime(info os.FileInfo) time.Time {
+	return time.Time{}
+}
+
+// readXattrs returns no extended attributes, which are only preserved on
+// Linux.
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
+
+// freeSpace is not known outside Linux, so no file is refused for the lack
+// of it.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// preallocate does nothing outside Linux; the file grows as it is written.
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
+
+// watchChanges reports nothing outside Linux, where Watch scans the
+// directory periodically instead.
+func watchChanges(ctx context.Context, dir string) (<-chan string, error) {
+	return nil, nil
+}
@@ -0,0 +1,114 @@
+package peerlink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Listen publishes a freshly generated code and waits for a sender to push a
+// file to it with SendTo, reporting the code through an EventCode event.
+// Once a sender knocks, the file is received as in Receive: opts.Accept is
+// asked about it and, if accepted, it is written to sink. Senders that fail
+// the handshake, for instance because they mistyped the code, are turned
+// away and Listen keeps waiting.
+func (c *Client) Listen(ctx context.Context, sink Sink, opts Options) (*ReceiveResult, error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+
+	var stats Stats
+	start := time.Now()
+	node, err := c.newNode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Listen: %w", err)
+	}
+	defer node.Close()
+	stats.phase(PhaseBootstrap, start, time.Now())
+
+	if err := node.GenerateWordsAndCid(); err != nil {
+		return nil, fmt.Errorf("Listen: failed to generate words and CID: %w", err)
+	}
+
+	// Knocks are taken one at a time; senders knocking while another one
+	// is being handled are turned away.
+	knocks := make(chan peer.ID)
+	node.Host.SetStreamHandler(p2p.PushProtocol, func(stream network.Stream) {
+		select {
+		case knocks <- stream.Conn().RemotePeer():
+			protocol.AnswerKnock(stream, true)
+		default:
+			protocol.AnswerKnock(stream, false)
+		}
+	})
+	defer node.Host.RemoveStreamHandler(p2p.PushProtocol)
+
+	opts.emit(Event{Kind: EventPublishing})
+	start = time.Now()
+	publishCtx, cancel := phase(ctx, opts.Timeouts.Publish)
+	err = node.PublishAddress(publishCtx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("Listen: failed to publish address to DHT: %w", err)
+	}
+	published := time.Now()
+	stats.phase(PhasePublish, start, published)
+	opts.emit(Event{Kind: EventPublished})
+	opts.emit(Event{Kind: EventCode, Code: node.Code()})
+
+	midnight := time.NewTimer(untilNextDay())
+	defer midnight.Stop()
+	for {
+		select {
+		case sender := <-knocks:
+			result, err := listenTo(ctx, node, sender, sink, opts, stats, published)
+			if errors.Is(err, protocol.ErrWrongCode) {
+				node.Logger.Warn("turned away a sender with the wrong code", "sender", sender)
+				opts.emit(Event{Kind: EventFailed, Peer: sender, Error: err.Error()})
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Listen: %w", err)
+			}
+			opts.emit(Event{Kind: EventComplete, Peer: sender})
+			return result, nil
+		case <-midnight.C:
+			// The rendezvous CID is derived from the date, so senders
+			// starting after midnight look for a new one.
+			if changed, err := node.RefreshCid(); err == nil && changed {
+				publishCtx, cancel := phase(ctx, opts.Timeouts.Publish)
+				if err := node.PublishAddress(publishCtx); err != nil {
+					node.Logger.Warn("failed to republish address for the new day", "err", err)
+				}
+				cancel()
+			}
+			midnight.Reset(untilNextDay())
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Listen: %w", ctx.Err())
+		}
+	}
+}
+
+// listenTo receives the file from a sender that knocked.
+func listenTo(ctx context.Context, node *p2p.Node, sender peer.ID, sink Sink, opts Options, stats Stats, published time.Time) (*ReceiveResult, error) {
+	kind := node.ConnKind(sender)
+	opts.emit(Event{Kind: EventConnected, Peer: sender, Connection: kind})
+	start := time.Now()
+	stats.phase(PhaseWait, published, start)
+	if kind != p2p.ConnDirect {
+		waitCtx, cancel := phase(ctx, opts.Timeouts.Phase)
+		kind = node.WaitForDirect(waitCtx, sender)
+		cancel()
+		if kind == p2p.ConnDirect {
+			opts.emit(Event{Kind: EventUpgraded, Peer: sender, Connection: kind})
+		}
+		stats.phase(PhaseConnect, start, time.Now())
+	}
+
+	r := &receiver{node: node, peer: sender, opts: opts, stats: stats}
+	return r.run(network.WithAllowLimitedConn(ctx, "peerlink"), sink)
+}
@@ -0,0 +1,136 @@
+package peerlink
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// pairing is the handshake of a node with the single peer it exchanges
+// files with under a code, in either direction. The handlers of the
+// protocols that follow the handshake are registered before it and wait for
+// the pairing, since the peer may open its next stream before this side has
+// seen its handshake complete.
+type pairing struct {
+	once sync.Once
+	done chan struct{}
+	peer peer.ID
+	key  []byte
+}
+
+func newPairing() *pairing {
+	return &pairing{done: make(chan struct{})}
+}
+
+// pair records the handshake with remote, unless one was recorded already.
+func (p *pairing) pair(remote peer.ID, key []byte) {
+	p.once.Do(func() {
+		p.peer = remote
+		p.key = key
+		close(p.done)
+	})
+}
+
+// keyFor waits for the pairing and returns the session key if stream comes
+// from the paired peer. Otherwise it resets stream and returns nil.
+func (p *pairing) keyFor(ctx context.Context, stream network.Stream) []byte {
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		stream.Reset()
+		return nil
+	}
+	if stream.Conn().RemotePeer() != p.peer {
+		stream.Reset()
+		return nil
+	}
+	return p.key
+}
+
+// host publishes a fresh code and waits for a peer to complete the handshake
+// with it. Peers that fail the handshake are turned away.
+func (p *pairing) host(ctx context.Context, node *p2p.Node, opts Options) error {
+	if err := node.GenerateWordsAndCid(); err != nil {
+		return fmt.Errorf("failed to generate words and CID: %w", err)
+	}
+
+	node.Host.SetStreamHandler(p2p.HandshakeProtocol, func(stream network.Stream) {
+		remote := stream.Conn().RemotePeer()
+		select {
+		case <-p.done:
+			stream.Reset()
+			return
+		default:
+		}
+		hctx, cancel := phase(ctx, opts.Timeouts.Phase)
+		defer cancel()
+		key, err := protocol.HandleHandshake(hctx, stream, node.Words(), node.Logger)
+		if err != nil {
+			node.Logger.Warn("peer failed the handshake", "peer", remote, "err", err)
+			opts.emit(Event{Kind: EventFailed, Peer: remote, Error: err.Error()})
+			return
+		}
+		p.pair(remote, key)
+	})
+	defer node.Host.RemoveStreamHandler(p2p.HandshakeProtocol)
+
+	opts.emit(Event{Kind: EventPublishing})
+	publishCtx, cancel := phase(ctx, opts.Timeouts.Publish)
+	err := node.PublishAddress(publishCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to publish address to DHT: %w", err)
+	}
+	opts.emit(Event{Kind: EventPublished})
+	opts.emit(Event{Kind: EventCode, Code: node.Code()})
+
+	select {
+	case <-p.done:
+		opts.emit(Event{Kind: EventHandshake, Peer: p.peer, Connection: node.ConnKind(p.peer)})
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// join looks up the peer that published code and performs the handshake
+// with it.
+func (p *pairing) join(ctx context.Context, node *p2p.Node, code string, opts Options) error {
+	words, err := protocol.ParseCode(code)
+	if err != nil {
+		return err
+	}
+	if err := node.SetWordsAndCid(words); err != nil {
+		return fmt.Errorf("failed to set words and CID: %w", err)
+	}
+
+	opts.emit(Event{Kind: EventQuerying})
+	queryCtx, cancel := phase(ctx, opts.Timeouts.Query)
+	remote, kind, err := node.QueryAndConnect(queryCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to query and connect to peer: %w", err)
+	}
+	opts.emit(Event{Kind: EventConnected, Peer: remote.ID, Connection: kind})
+	if kind != p2p.ConnDirect {
+		waitCtx, cancel := phase(ctx, opts.Timeouts.Phase)
+		kind = node.WaitForDirect(waitCtx, remote.ID)
+		cancel()
+		if kind == p2p.ConnDirect {
+			opts.emit(Event{Kind: EventUpgraded, Peer: remote.ID, Connection: kind})
+		}
+	}
+
+	r := &receiver{node: node, peer: remote.ID, opts: opts}
+	if err := r.handshake(network.WithAllowLimitedConn(ctx, "peerlink")); err != nil {
+		return err
+	}
+	p.pair(remote.ID, r.key)
+	opts.emit(Event{Kind: EventHandshake, Peer: remote.ID, Connection: node.ConnKind(remote.ID)})
+	return nil
+}
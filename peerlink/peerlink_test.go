@@ -0,0 +1,165 @@
+package peerlink
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SyedMa3/peerlink/logging"
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// The tests run the protocols between nodes listening on the loopback
+// interface, connected to each other directly instead of through the DHT.
+
+func newLocalNode(t *testing.T) *p2p.Node {
+	t.Helper()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return &p2p.Node{Host: h, Logger: logging.Discard()}
+}
+
+func connect(t *testing.T, a, b *p2p.Node) {
+	t.Helper()
+	if err := b.Host.Connect(context.Background(), peer.AddrInfo{ID: a.Host.ID(), Addrs: a.Host.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// localPair returns a sender and a receiver node, connected and sharing a
+// code.
+func localPair(t *testing.T) (*p2p.Node, *p2p.Node) {
+	t.Helper()
+	sn, rn := newLocalNode(t), newLocalNode(t)
+	connect(t, sn, rn)
+	if err := sn.GenerateWordsAndCid(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rn.SetWordsAndCid(sn.Words()); err != nil {
+		t.Fatal(err)
+	}
+	return sn, rn
+}
+
+func testContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func startServer(ctx context.Context, sn *p2p.Node, src Source, opts Options, limits ServeOptions) *server {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	s := newServer(ctx, sn, src, opts, limits)
+	s.register()
+	return s
+}
+
+func recv(ctx context.Context, rn, sn *p2p.Node, sink Sink, opts Options) (*ReceiveResult, error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	r := &receiver{node: rn, peer: sn.Host.ID(), opts: opts}
+	return r.run(ctx, sink)
+}
+
+// pairLocal runs the handshake from rn to sn and pairs p, which sn hosts,
+// with rn. It returns the key the pairing agreed on.
+func pairLocal(t *testing.T, ctx context.Context, sn, rn *p2p.Node, p *pairing) []byte {
+	t.Helper()
+	sn.Host.SetStreamHandler(p2p.HandshakeProtocol, func(stream network.Stream) {
+		key, err := protocol.HandleHandshake(ctx, stream, sn.Words(), sn.Logger)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		p.pair(rn.Host.ID(), key)
+	})
+	opts := Options{}
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	r := &receiver{node: rn, peer: sn.Host.ID(), opts: opts}
+	if err := r.handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return r.key
+}
+
+func randomData(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, streams := range []int{1, 3} {
+		sn, rn := localPair(t)
+		ctx := testContext(t)
+		data := randomData(t, 3<<20+123)
+		s := startServer(ctx, sn, BytesSource("x.bin", data), Options{}, ServeOptions{MaxParallel: 1})
+
+		dir := t.TempDir()
+		result, err := recv(ctx, rn, sn, DirSink(dir), Options{Streams: streams})
+		if err != nil {
+			t.Fatalf("streams %d: %v", streams, err)
+		}
+		if done := <-s.finished; done.err != nil {
+			t.Fatalf("streams %d: sender: %v", streams, done.err)
+		}
+		got, err := os.ReadFile(filepath.Join(dir, "x.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) || result.Size != int64(len(data)) {
+			t.Fatalf("streams %d: received %d bytes, reported %d, want %d", streams, len(got), result.Size, len(data))
+		}
+	}
+}
+
+func TestWrongCode(t *testing.T) {
+	sn, rn := localPair(t)
+	words := append([]string{}, sn.Words()...)
+	words[4] = "zzz"
+	if err := rn.SetWordsAndCid(words); err != nil {
+		t.Fatal(err)
+	}
+	ctx := testContext(t)
+	s := startServer(ctx, sn, BytesSource("x.bin", []byte("hi")), Options{}, ServeOptions{})
+
+	if _, err := recv(ctx, rn, sn, DirSink(t.TempDir()), Options{}); !errors.Is(err, ErrWrongCode) {
+		t.Fatalf("receiver got %v, want ErrWrongCode", err)
+	}
+	if done := <-s.finished; !errors.Is(done.err, ErrWrongCode) {
+		t.Fatalf("sender got %v, want ErrWrongCode", done.err)
+	}
+}
+
+func TestDecline(t *testing.T) {
+	sn, rn := localPair(t)
+	ctx := testContext(t)
+	s := startServer(ctx, sn, BytesSource("x.bin", []byte("hi")), Options{}, ServeOptions{})
+
+	dir := t.TempDir()
+	decline := func(context.Context, protocol.Metadata) (bool, error) { return false, nil }
+	if _, err := recv(ctx, rn, sn, DirSink(dir), Options{Accept: decline}); !errors.Is(err, ErrDeclined) {
+		t.Fatalf("receiver got %v, want ErrDeclined", err)
+	}
+	if done := <-s.finished; !errors.Is(done.err, ErrDeclined) {
+		t.Fatalf("sender got %v, want ErrDeclined", done.err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("declined file left %d entries behind", len(entries))
+	}
+}
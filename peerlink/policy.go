@@ -0,0 +1,122 @@
+package peerlink
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Policy holds the rules a receiver enforces on offered files. Files that
+// break a rule are declined without asking Options.Accept.
+type Policy struct {
+	// MaxSize declines files larger than this many bytes. Zero means no
+	// limit.
+	MaxSize int64
+
+	// AllowExtensions, if not empty, declines files whose name does not
+	// end in one of the extensions, such as "pdf" or "tar.gz".
+	// DenyExtensions declines files whose name does. Case is ignored.
+	AllowExtensions []string
+	DenyExtensions  []string
+
+	// AllowTypes, if not empty, declines files whose MIME type, as
+	// guessed from their extension, matches none of the types, such as
+	// "application/pdf" or "image/*". DenyTypes declines files whose
+	// type matches one of them.
+	AllowTypes []string
+	DenyTypes  []string
+
+	// Trusted lists senders whose files are accepted without asking
+	// Options.Accept, as long as they follow the other rules.
+	Trusted []peer.ID
+
+	// ExpectHash declines any file whose SHA-256 checksum differs. A file
+	// offered with another checksum is declined up front, and every file is
+	// checked again against the checksum of the data actually received,
+	// which the sender cannot fake; on a mismatch it is discarded instead
+	// of saved.
+	ExpectHash []byte
+}
+
+// check reports the first rule the file described by metadata breaks.
+func (p *Policy) check(metadata protocol.Metadata) error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxSize > 0 && metadata.Size > p.MaxSize {
+		return fmt.Errorf("%s is larger than the maximum size of %d bytes", metadata.Filename, p.MaxSize)
+	}
+
+	name := strings.ToLower(metadata.Filename)
+	hasExtension := func(ext string) bool {
+		return strings.HasSuffix(name, "."+strings.ToLower(strings.TrimPrefix(ext, ".")))
+	}
+	if slices.ContainsFunc(p.DenyExtensions, hasExtension) {
+		return fmt.Errorf("%s has a denied extension", metadata.Filename)
+	}
+	if len(p.AllowExtensions) > 0 && !slices.ContainsFunc(p.AllowExtensions, hasExtension) {
+		return fmt.Errorf("%s does not have an allowed extension", metadata.Filename)
+	}
+
+	mimeType := guessType(metadata.Filename)
+	hasType := func(pattern string) bool {
+		matched, err := path.Match(strings.ToLower(pattern), mimeType)
+		return err == nil && matched
+	}
+	if slices.ContainsFunc(p.DenyTypes, hasType) {
+		return fmt.Errorf("%s has the denied type %s", metadata.Filename, mimeType)
+	}
+	if len(p.AllowTypes) > 0 && !slices.ContainsFunc(p.AllowTypes, hasType) {
+		return fmt.Errorf("%s has the type %s, which is not allowed", metadata.Filename, mimeType)
+	}
+
+	if len(metadata.Hash) > 0 {
+		if err := p.verify(metadata.Hash); err != nil {
+			return fmt.Errorf("%s: %w", metadata.Filename, err)
+		}
+	}
+	return nil
+}
+
+// verify reports whether hash differs from the expected checksum. Only a
+// checksum calculated from the received data settles it; an offered one
+// merely lets a file be declined early.
+func (p *Policy) verify(hash []byte) error {
+	if p == nil || len(p.ExpectHash) == 0 || bytes.Equal(hash, p.ExpectHash) {
+		return nil
+	}
+	return fmt.Errorf("checksum %s differs from the expected %s", utils.BytesToHex(hash), utils.BytesToHex(p.ExpectHash))
+}
+
+// trusts reports whether files from sender are accepted without asking.
+func (p *Policy) trusts(sender peer.ID) bool {
+	return p != nil && slices.Contains(p.Trusted, sender)
+}
+
+// untrusting returns a copy of p that trusts no sender.
+func (p *Policy) untrusting() *Policy {
+	if p == nil {
+		return nil
+	}
+	untrusting := *p
+	untrusting.Trusted = nil
+	return &untrusting
+}
+
+// guessType returns the MIME type of a file from its extension, without
+// parameters such as the charset.
+func guessType(name string) string {
+	mimeType, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(name)))
+	if err != nil {
+		return "application/octet-stream"
+	}
+	return mimeType
+}
@@ -0,0 +1,82 @@
+package peerlink
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	hash := sha256.Sum256([]byte("hello"))
+	other := sha256.Sum256([]byte("other"))
+	for _, c := range []struct {
+		name   string
+		policy *Policy
+		hash   []byte
+		ok     bool
+	}{
+		{"a.txt", nil, nil, true},
+		{"a.txt", &Policy{MaxSize: 5}, nil, false},
+		{"a.txt", &Policy{MaxSize: 50}, nil, true},
+		{"a.EXE", &Policy{DenyExtensions: []string{"exe"}}, nil, false},
+		{"a.tar.gz", &Policy{AllowExtensions: []string{".tar.gz"}}, nil, true},
+		{"a.gz", &Policy{AllowExtensions: []string{"tar.gz"}}, nil, false},
+		{"a.png", &Policy{AllowTypes: []string{"image/*"}}, nil, true},
+		{"a.txt", &Policy{AllowTypes: []string{"image/*"}}, nil, false},
+		{"a.png", &Policy{DenyTypes: []string{"image/png"}}, nil, false},
+		{"a.txt", &Policy{ExpectHash: hash[:]}, hash[:], true},
+		{"a.txt", &Policy{ExpectHash: hash[:]}, other[:], false},
+		// Without an offered checksum, the file is checked once received
+		{"a.txt", &Policy{ExpectHash: hash[:]}, nil, true},
+	} {
+		err := c.policy.check(protocol.Metadata{Filename: c.name, Size: 10, Hash: c.hash})
+		if (err == nil) != c.ok {
+			t.Errorf("%s with %+v: got %v", c.name, c.policy, err)
+		}
+	}
+}
+
+func TestPolicyReceive(t *testing.T) {
+	data := []byte("hello policy")
+	hash := sha256.Sum256(data)
+	decline := func(context.Context, protocol.Metadata) (bool, error) { return false, nil }
+	receive := func(src Source, policy *Policy) (string, *ReceiveResult, error) {
+		sn, rn := localPair(t)
+		ctx := testContext(t)
+		s := startServer(ctx, sn, src, Options{}, ServeOptions{})
+		go func() { <-s.finished }()
+		if policy != nil && policy.Trusted != nil {
+			policy.Trusted = []peer.ID{sn.Host.ID()}
+		}
+		dir := t.TempDir()
+		result, err := recv(ctx, rn, sn, DirSink(dir), Options{Policy: policy, Accept: decline})
+		return dir, result, err
+	}
+
+	if _, _, err := receive(BytesSource("a.txt", data), &Policy{MaxSize: 5, Trusted: []peer.ID{}}); !errors.Is(err, ErrDeclined) {
+		t.Errorf("file above the maximum size: got %v, want ErrDeclined", err)
+	}
+	if _, _, err := receive(BytesSource("a.txt", data), &Policy{}); !errors.Is(err, ErrDeclined) {
+		t.Errorf("untrusted sender: got %v, want ErrDeclined", err)
+	}
+	if _, result, err := receive(BytesSource("a.txt", data), &Policy{ExpectHash: hash[:], Trusted: []peer.ID{}}); err != nil || !bytes.Equal(result.Hash, hash[:]) {
+		t.Errorf("trusted sender of the expected file: got %v", err)
+	}
+
+	// A sender announcing the expected checksum but sending something else
+	// gets nothing saved
+	src := &fickleSource{first: data, rest: []byte("hello forged")}
+	dir, _, err := receive(src, &Policy{ExpectHash: hash[:], Trusted: []peer.ID{}})
+	if !errors.Is(err, protocol.ErrIntegrity) {
+		t.Errorf("sender faking the expected checksum: got %v, want ErrIntegrity", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("the forged file left %d entries behind", len(entries))
+	}
+}
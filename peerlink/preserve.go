@@ -0,0 +1,208 @@
+package peerlink
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SyedMa3/peerlink/protocol"
+)
+
+// maxXattrBytes caps the extended attributes offered with a file, which
+// travel in the single frame of its metadata.
+const maxXattrBytes = 32 << 10
+
+// xattrPrefix is the namespace of the extended attributes that are
+// preserved. The others need privileges or grant them.
+const xattrPrefix = "user."
+
+// Attributer is implemented by sources that can report the attributes of
+// their file, which Send offers with Options.Preserve.
+type Attributer interface {
+	Attrs() (*protocol.Attrs, error)
+}
+
+// Linker is implemented by sinks that can create symbolic links, which
+// Receive uses for links offered with Options.Preserve.
+type Linker interface {
+	// Symlink creates the link described by metadata and returns its path.
+	Symlink(metadata protocol.Metadata) (string, error)
+}
+
+func (s *fileSource) Attrs() (*protocol.Attrs, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("Attrs: %w", err)
+	}
+	xattrs, err := readXattrs(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("Attrs: %w", err)
+	}
+	return &protocol.Attrs{
+		Mode:       unixMode(info.Mode()),
+		ModTime:    info.ModTime(),
+		AccessTime: accessTime(info),
+		Xattrs:     xattrs,
+	}, nil
+}
+
+type linkSource struct {
+	path   string
+	target string
+}
+
+// LinkSource offers the symbolic link at path as a link rather than the
+// file it points to. Its target is only sent with Options.Preserve, so
+// without it the receiver gets an empty file.
+func LinkSource(path string) (Source, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return nil, fmt.Errorf("LinkSource: %w", err)
+	}
+	return &linkSource{path: path, target: target}, nil
+}
+
+func (s *linkSource) Name() string { return filepath.Base(s.path) }
+func (s *linkSource) Size() int64  { return 0 }
+
+func (s *linkSource) Open() (io.ReadSeekCloser, error) {
+	return nopCloser{strings.NewReader("")}, nil
+}
+
+func (s *linkSource) Attrs() (*protocol.Attrs, error) {
+	info, err := os.Lstat(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("Attrs: %w", err)
+	}
+	return &protocol.Attrs{Mode: unixMode(info.Mode()), ModTime: info.ModTime(), Link: s.target}, nil
+}
+
+// Symlink creates the link under the offered name, picking a new name
+// instead of replacing an existing file.
+func (s *dirSink) Symlink(metadata protocol.Metadata) (string, error) {
+	path, err := s.path(metadata)
+	if err != nil {
+		return "", err
+	}
+	path, err = claimName(path, func(path string) error {
+		return os.Symlink(metadata.Attrs.Link, path)
+	})
+	if err != nil {
+		return "", fmt.Errorf("DirSink: %w", err)
+	}
+	return path, nil
+}
+
+// linkSink creates the offered symbolic link in place of a file.
+type linkSink struct {
+	linker Linker
+}
+
+func (s linkSink) Create(metadata protocol.Metadata) (io.WriteCloser, error) {
+	path, err := s.linker.Symlink(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &linkFile{path: path}, nil
+}
+
+// linkFile stands in for the content of a symbolic link, which has none.
+type linkFile struct {
+	path string
+}
+
+func (f *linkFile) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		return 0, errors.New("a symbolic link has no content")
+	}
+	return 0, nil
+}
+
+func (f *linkFile) Close() error { return nil }
+func (f *linkFile) Name() string { return f.path }
+func (f *linkFile) Abort() error { return os.Remove(f.path) }
+
+// applyAttrs gives the received file at path the attributes preserved by
+// the sender. The content is already in place, so failures are logged.
+func (r *receiver) applyAttrs(path string, attrs *protocol.Attrs) {
+	if attrs.Link != "" {
+		return
+	}
+	var errs []error
+	for name, value := range attrs.Xattrs {
+		if strings.HasPrefix(name, xattrPrefix) {
+			errs = append(errs, setXattr(path, name, value))
+		}
+	}
+	errs = append(errs, os.Chmod(path, fileMode(attrs.Mode)))
+	if !attrs.ModTime.IsZero() {
+		atime := attrs.AccessTime
+		if atime.IsZero() {
+			atime = attrs.ModTime
+		}
+		errs = append(errs, os.Chtimes(path, atime, attrs.ModTime))
+	}
+	if err := errors.Join(errs...); err != nil {
+		r.node.Logger.Warn("failed to apply file attributes", "path", path, "err", err)
+	}
+}
+
+// unixMode returns the permission bits of mode. The setuid and setgid bits
+// are left out, since the receiver must not grant privileges on the
+// sender's behalf.
+func unixMode(mode fs.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+	return bits
+}
+
+func fileMode(bits uint32) fs.FileMode {
+	mode := fs.FileMode(bits).Perm()
+	if bits&0o1000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// sparseBlock is the granularity at which runs of zeros become holes.
+const sparseBlock = 4096
+
+// writeSparse writes p at off, skipping the blocks that hold only zeros so
+// that they remain holes in a file already extended to its final size.
+func writeSparse(w io.WriterAt, p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		end := min(len(p), n+sparseBlock-int((off+int64(n))%sparseBlock))
+		if allZero(p[n:end]) {
+			n = end
+			continue
+		}
+		// Write the run of blocks holding data at once
+		start := n
+		for n = end; n < len(p); n = end {
+			end = min(len(p), n+sparseBlock)
+			if allZero(p[n:end]) {
+				break
+			}
+		}
+		if _, err := w.WriteAt(p[start:n], off+int64(start)); err != nil {
+			return start, err
+		}
+	}
+	return len(p), nil
+}
+
+func allZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,454 @@
+package peerlink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+)
+
+// Receive looks up the sender behind code, asks opts.Accept about the offered
+// file and, if accepted, writes it to sink.
+func (c *Client) Receive(ctx context.Context, code string, sink Sink, opts Options) (*ReceiveResult, error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+
+	words, err := protocol.ParseCode(code)
+	if err != nil {
+		return nil, fmt.Errorf("Receive: %w", err)
+	}
+
+	var stats Stats
+	start := time.Now()
+	node, err := c.newNode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Receive: %w", err)
+	}
+	defer node.Close()
+	stats.phase(PhaseBootstrap, start, time.Now())
+
+	if err := node.SetWordsAndCid(words); err != nil {
+		return nil, fmt.Errorf("Receive: failed to set words and CID: %w", err)
+	}
+
+	opts.emit(Event{Kind: EventQuerying})
+	queryCtx, cancel := phase(ctx, opts.Timeouts.Query)
+	start = time.Now()
+	providers, err := node.QueryAddress(queryCtx)
+	var sender *peer.AddrInfo
+	var kind p2p.ConnKind
+	if err == nil {
+		stats.phase(PhaseQuery, start, time.Now())
+		start = time.Now()
+		sender, kind, err = node.Connect(queryCtx, providers)
+	}
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("Receive: failed to query and connect to sender: %w", err)
+	}
+	opts.emit(Event{Kind: EventConnected, Peer: sender.ID, Connection: kind})
+	if kind != p2p.ConnDirect {
+		waitCtx, cancel := phase(ctx, opts.Timeouts.Phase)
+		kind = node.WaitForDirect(waitCtx, sender.ID)
+		cancel()
+		if kind == p2p.ConnDirect {
+			opts.emit(Event{Kind: EventUpgraded, Peer: sender.ID, Connection: kind})
+		}
+	}
+	stats.phase(PhaseConnect, start, time.Now())
+
+	r := &receiver{node: node, peer: sender.ID, opts: opts, stats: stats}
+	// Limited relay connections are fine for the short exchanges; the file
+	// itself is refused over them if it exceeds the relay's limit.
+	result, err := r.run(network.WithAllowLimitedConn(ctx, "peerlink"), sink)
+	if err != nil {
+		return nil, fmt.Errorf("Receive: %w", err)
+	}
+	opts.emit(Event{Kind: EventComplete, Peer: sender.ID})
+	return result, nil
+}
+
+// receiver drives the protocol against a single connected sender.
+type receiver struct {
+	node *p2p.Node
+	peer peer.ID
+	opts Options
+	key  []byte
+	// scope is that of the protocols the sender serves the file over, as
+	// described for p2p.Scoped.
+	scope string
+	// stats collects the phases of the transfer as they complete.
+	stats Stats
+}
+
+const (
+	// maxStreams caps the parallel streams picked automatically.
+	maxStreams = 8
+	// minStreamBytes is the least data worth a stream of its own.
+	minStreamBytes = 4 << 20
+	// rttPerStream is the round-trip time that warrants one more stream.
+	rttPerStream = 25 * time.Millisecond
+)
+
+// busyRetryInterval is how long Receive waits before knocking again on a
+// sender that is busy with other receivers.
+const busyRetryInterval = 2 * time.Second
+
+func (r *receiver) run(ctx context.Context, sink Sink) (*ReceiveResult, error) {
+	start := time.Now()
+	if err := r.handshakeWhenReady(ctx); err != nil {
+		return nil, err
+	}
+	r.stats.phase(PhaseHandshake, start, time.Now())
+	r.opts.emit(Event{Kind: EventHandshake, Peer: r.peer})
+	return r.fetch(ctx, sink)
+}
+
+// fetch asks the sender about its file once the handshake is done and, if
+// accepted, receives it. A file the sink or the cache already holds is not
+// transferred.
+func (r *receiver) fetch(ctx context.Context, sink Sink) (*ReceiveResult, error) {
+	metadata, found, err := r.exchangeMetadata(ctx, sink)
+	if err != nil {
+		return nil, err
+	}
+	r.opts.emit(Event{Kind: EventAccepted, Peer: r.peer, Metadata: &metadata})
+
+	result := &ReceiveResult{Peer: r.peer, Metadata: metadata}
+	if found != nil {
+		err = r.receivePresent(ctx, sink, found, result)
+	} else {
+		if attrs := metadata.Attrs; attrs != nil && attrs.Link != "" {
+			sink = linkSink{linker: sink.(Linker)}
+		}
+		err = r.receiveFile(ctx, sink, result)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// A file already in place is kept as it is; only one this transfer
+	// wrote, or copied from the cache, gets the preserved attributes
+	if metadata.Attrs != nil && result.Path != "" && (found == nil || found.path == "") {
+		r.applyAttrs(result.Path, metadata.Attrs)
+	}
+	if found == nil {
+		r.addToCache(result)
+	}
+	return result, nil
+}
+
+// handshakeWhenReady performs the handshake, waiting for a turn if the
+// sender is serving other receivers. The wait is bounded by the Accept
+// timeout, as both are about waiting for the other side.
+func (r *receiver) handshakeWhenReady(ctx context.Context) error {
+	ctx, cancel := phase(ctx, r.opts.Timeouts.Accept)
+	defer cancel()
+
+	for {
+		err := r.handshake(ctx)
+		if !errors.Is(err, protocol.ErrBusy) {
+			return err
+		}
+		r.opts.emit(Event{Kind: EventWaiting, Peer: r.peer})
+		select {
+		case <-time.After(busyRetryInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("handshake: %w: %w", protocol.ErrBusy, ctx.Err())
+		}
+	}
+}
+
+func (r *receiver) handshake(ctx context.Context) error {
+	ctx, cancel := phase(ctx, r.opts.Timeouts.Phase)
+	defer cancel()
+
+	stream, err := r.node.Host.NewStream(ctx, r.peer, p2p.Scoped(p2p.HandshakeProtocol, r.scope))
+	if err != nil {
+		return fmt.Errorf("handshake: failed to create handshake stream: %w", err)
+	}
+	defer stream.Close()
+
+	key, err := protocol.PerformHandshake(ctx, stream, r.node.Words(), r.node.Logger)
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	r.key = key
+	r.node.Logger.Info("handshake completed", "sender", r.peer)
+	return nil
+}
+
+// exchangeMetadata asks the user about the offered file. If sink is not nil
+// and it or the cache already holds the file, the sender is told so and the
+// copy is returned.
+func (r *receiver) exchangeMetadata(ctx context.Context, sink Sink) (protocol.Metadata, *presentCopy, error) {
+	ctx, cancel := phase(ctx, r.opts.Timeouts.Accept)
+	defer cancel()
+
+	stream, err := r.node.Host.NewStream(ctx, r.peer, p2p.Scoped(p2p.MetadataProtocol, r.scope))
+	if err != nil {
+		return protocol.Metadata{}, nil, fmt.Errorf("exchangeMetadata: failed to create metadata stream: %w", err)
+	}
+	defer stream.Close()
+
+	limited := false
+	// refused is why the file was declined without asking
+	var refused error
+	var found *presentCopy
+	metadata, answer, err := protocol.ReceiveMetadata(ctx, stream, r.key, func(ctx context.Context, metadata protocol.Metadata) (protocol.Answer, error) {
+		r.opts.emit(Event{Kind: EventMetadata, Peer: r.peer, Metadata: &metadata})
+		if attrs := metadata.Attrs; attrs != nil && attrs.Link != "" {
+			if _, ok := sink.(Linker); !ok || !r.opts.Preserve {
+				refused = fmt.Errorf("%s is a symbolic link, which is only received when preserving attributes", metadata.Filename)
+				return protocol.Declined, nil
+			}
+		}
+		if refused = r.opts.Policy.check(metadata); refused != nil {
+			return protocol.Declined, nil
+		}
+		if sink != nil {
+			found = r.findPresent(sink, metadata)
+		}
+		if checker, ok := sink.(SpaceChecker); ok && found == nil {
+			if refused = checker.CheckSpace(metadata.Size); refused != nil {
+				return protocol.Declined, nil
+			}
+		}
+		if found != nil && found.path != "" {
+			// The file is already where it would be saved
+			return protocol.Present, nil
+		}
+		if found == nil && r.node.ConnKind(r.peer) == p2p.ConnLimited && metadata.Size > p2p.RelayDataLimit {
+			limited = true
+			return protocol.RelayLimited, nil
+		}
+		accepted, err := r.opts.accept(ctx, r.peer, metadata)
+		switch {
+		case err != nil || !accepted:
+			return protocol.Declined, err
+		case found != nil:
+			return protocol.Present, nil
+		default:
+			return protocol.Accepted, nil
+		}
+	}, r.node.Logger)
+	if err != nil {
+		return protocol.Metadata{}, nil, fmt.Errorf("exchangeMetadata: %w", err)
+	}
+	if limited {
+		return protocol.Metadata{}, nil, fmt.Errorf("exchangeMetadata: %d byte file: %w", metadata.Size, p2p.ErrRelayLimited)
+	}
+	if refused != nil {
+		return protocol.Metadata{}, nil, fmt.Errorf("exchangeMetadata: %w: %w", refused, protocol.ErrDeclined)
+	}
+	if !r.opts.Preserve {
+		metadata.Attrs = nil
+	}
+	switch answer {
+	case protocol.Present:
+		return metadata, found, nil
+	case protocol.Accepted:
+		return metadata, nil, nil
+	default:
+		return protocol.Metadata{}, nil, protocol.ErrDeclined
+	}
+}
+
+func (r *receiver) receiveFile(ctx context.Context, sink Sink, result *ReceiveResult) (err error) {
+	w, err := sink.Create(result.Metadata)
+	if err != nil {
+		return fmt.Errorf("receiveFile: %w", err)
+	}
+	saved := false
+	defer func() {
+		if !saved {
+			finishSink(w, err, r.node.Logger)
+		}
+	}()
+
+	streams := r.streams(ctx, result.Metadata.Size)
+	// Parallel ranges are written at their offsets and read back to be
+	// verified together
+	wa, ok := w.(writerReaderAt)
+	if !ok {
+		streams = 1
+	}
+	ranges := protocol.SplitRanges(result.Metadata.Size, streams)
+
+	r.opts.emit(Event{Kind: EventTransferring, Peer: r.peer, Metadata: &result.Metadata})
+	start := time.Now()
+	meter := r.opts.meter(r.peer, result.Metadata.Size)
+	var n int64
+	var hash []byte
+	if len(ranges) == 1 {
+		n, hash, err = r.receiveRange(ctx, w, ranges[0], meter)
+	} else {
+		r.node.Logger.Info("receiving over parallel streams", "sender", r.peer, "streams", len(ranges))
+		n, hash, err = r.receiveRanges(ctx, wa, ranges, meter)
+	}
+	// hash was calculated from the data received, so it settles both the
+	// offered checksum and the one the policy expects
+	if err == nil && len(result.Metadata.Hash) > 0 && !bytes.Equal(hash, result.Metadata.Hash) {
+		err = fmt.Errorf("file does not match the offered checksum: %w", protocol.ErrIntegrity)
+	}
+	if err == nil {
+		if policyErr := r.opts.Policy.verify(hash); policyErr != nil {
+			err = fmt.Errorf("%w: %w", policyErr, protocol.ErrIntegrity)
+		}
+	}
+	if err == nil {
+		// Only a verified file is saved under its name
+		saved = true
+		if err = w.Close(); err != nil {
+			err = fmt.Errorf("failed to save file: %w", err)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, protocol.ErrIntegrity) || saved {
+			// Let the sender know instead of leaving it waiting
+			if checkErr := r.completeCheck(ctx, false); checkErr != nil {
+				r.node.Logger.Warn("failed to report failed file to sender", "err", checkErr)
+			}
+		}
+		return fmt.Errorf("receiveFile: %w", err)
+	}
+	if named, ok := w.(interface{ Name() string }); ok {
+		result.Path = named.Name()
+	}
+	result.Size = n
+	result.Hash = hash
+	r.stats.phase(PhaseTransfer, start, time.Now())
+	r.node.Logger.Info("file received", "sender", r.peer, "bytes", n, "path", result.Path)
+	r.opts.emit(Event{Kind: EventTransferred, Peer: r.peer, Metadata: &result.Metadata})
+
+	if err := r.completeCheck(ctx, true); err != nil {
+		return fmt.Errorf("receiveFile: %w", err)
+	}
+	result.Stats = r.stats
+	result.Stats.measure(r.node, r.peer, n, meter)
+	return nil
+}
+
+// receiveRange fetches one range of the file over a stream of its own.
+func (r *receiver) receiveRange(ctx context.Context, w io.Writer, rng protocol.Range, meter *rw.Meter) (int64, []byte, error) {
+	stream, err := r.node.Host.NewStream(ctx, r.peer, p2p.Scoped(p2p.FileTransferProtocol, r.scope))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create file transfer stream: %w", err)
+	}
+	defer stream.Close()
+	limited := protocol.WithLimit(ctx, protocol.WithIdleTimeout(stream, r.opts.Timeouts.Idle), r.opts.Limit)
+	return protocol.ReceiveFile(ctx, limited, w, rng, r.key, meter, r.node.Logger)
+}
+
+// receiveRanges fetches the ranges concurrently, writing each at its offset
+// in w. The first failing range cancels the others. Once they are all in,
+// the file is read back from w and its checksum returned, after checking it
+// against the one the sender announced.
+func (r *receiver) receiveRanges(ctx context.Context, w writerReaderAt, ranges []protocol.Range, meter *rw.Meter) (int64, []byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type rangeDone struct {
+		n    int64
+		hash []byte
+		err  error
+	}
+	results := make(chan rangeDone, len(ranges))
+	for _, rng := range ranges {
+		go func() {
+			n, hash, err := r.receiveRange(ctx, io.NewOffsetWriter(w, rng.Offset), rng, meter)
+			if err != nil {
+				err = fmt.Errorf("range at %d: %w", rng.Offset, err)
+			}
+			results <- rangeDone{n: n, hash: hash, err: err}
+		}()
+	}
+
+	var total int64
+	var hash []byte
+	var errs []error
+	for range ranges {
+		done := <-results
+		switch {
+		case done.err != nil:
+			if len(errs) == 0 || !errors.Is(done.err, context.Canceled) {
+				errs = append(errs, done.err)
+			}
+			cancel()
+		case hash != nil && !bytes.Equal(hash, done.hash):
+			errs = append(errs, fmt.Errorf("streams disagree on the file checksum: %w", protocol.ErrIntegrity))
+			cancel()
+		default:
+			total += done.n
+			hash = done.hash
+		}
+	}
+	if len(errs) > 0 {
+		return total, nil, errors.Join(errs...)
+	}
+	calculated, err := utils.CalculateHash(io.NewSectionReader(w, 0, total))
+	if err != nil {
+		return total, nil, fmt.Errorf("failed to read back the file: %w", err)
+	}
+	if !bytes.Equal(calculated, hash) {
+		r.node.Logger.Warn("file checksum mismatch", "expected", utils.BytesToHex(hash), "actual", utils.BytesToHex(calculated))
+		return total, nil, fmt.Errorf("file does not match its checksum: %w", protocol.ErrIntegrity)
+	}
+	return total, calculated, nil
+}
+
+// streams picks how many parallel streams to fetch a file of size bytes
+// over: the number configured in Options, or otherwise one more for every
+// rttPerStream of round-trip time, as per-stream flow control caps each
+// stream at about a window per round trip.
+func (r *receiver) streams(ctx context.Context, size int64) int {
+	if r.opts.Streams > 0 {
+		return min(r.opts.Streams, protocol.MaxStreams)
+	}
+	rtt := r.node.Host.Peerstore().LatencyEWMA(r.peer)
+	if rtt == 0 {
+		ctx, cancel := phase(ctx, r.opts.Timeouts.Phase)
+		defer cancel()
+		if res := <-ping.Ping(ctx, r.node.Host, r.peer); res.Error == nil {
+			rtt = res.RTT
+		}
+	}
+	n := 1 + int(rtt/rttPerStream)
+	n = min(n, maxStreams, int(size/minStreamBytes))
+	r.node.Logger.Debug("picked stream count", "sender", r.peer, "rtt", rtt, "streams", max(n, 1))
+	return max(n, 1)
+}
+
+func (r *receiver) completeCheck(ctx context.Context, ok bool) error {
+	ctx, cancel := phase(ctx, r.opts.Timeouts.Phase)
+	defer cancel()
+
+	stream, err := r.node.Host.NewStream(ctx, r.peer, p2p.Scoped(p2p.CompleteCheckProtocol, r.scope))
+	if err != nil {
+		return fmt.Errorf("completeCheck: failed to create complete check stream: %w", err)
+	}
+	defer stream.Close()
+	return protocol.SendCompleteCheck(ctx, stream, r.key, ok, r.node.Logger)
+}
+
+// finishSink closes w after a successful transfer and discards what was
+// written to it after a failed one.
+func finishSink(w io.WriteCloser, err error, logger *slog.Logger) {
+	aborter, ok := w.(Aborter)
+	if err == nil || !ok {
+		w.Close()
+		return
+	}
+	if abortErr := aborter.Abort(); abortErr != nil {
+		logger.Warn("failed to discard partial file", "err", abortErr)
+	}
+}
@@ -0,0 +1,147 @@
+package peerlink
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SyedMa3/peerlink/logging"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// fickleSource offers first on the first Open and then, to the same size,
+// rest: a file whose content changed after its checksum was offered.
+type fickleSource struct {
+	first, rest []byte
+
+	mu     sync.Mutex
+	opened bool
+}
+
+func (s *fickleSource) Name() string { return "x.bin" }
+func (s *fickleSource) Size() int64  { return int64(len(s.first)) }
+
+func (s *fickleSource) Open() (io.ReadSeekCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := s.rest
+	if !s.opened {
+		data, s.opened = s.first, true
+	}
+	return nopCloser{bytes.NewReader(data)}, nil
+}
+
+// TestReceiveVerifiesFile checks that a file received over parallel ranges
+// is saved only if it matches the checksum offered, even though every range
+// matches its own.
+func TestReceiveVerifiesFile(t *testing.T) {
+	sn, rn := localPair(t)
+	ctx := testContext(t)
+	first := randomData(t, 1<<20)
+	src := &fickleSource{first: first, rest: randomData(t, len(first))}
+	s := startServer(ctx, sn, src, Options{}, ServeOptions{})
+	go func() { <-s.finished }()
+
+	dir := t.TempDir()
+	if _, err := recv(ctx, rn, sn, DirSink(dir), Options{Streams: 2}); !errors.Is(err, protocol.ErrIntegrity) {
+		t.Fatalf("got %v, want ErrIntegrity", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("a file not matching its checksum left %d entries behind", len(entries))
+	}
+}
+
+// TestReceiveFileWholeChecksum checks that a range covering the whole file
+// is refused when the sender announces another checksum for the file than
+// the one of the data it sends.
+func TestReceiveFileWholeChecksum(t *testing.T) {
+	sn, rn := localPair(t)
+	ctx := testContext(t)
+	key := randomData(t, 32)
+	data := randomData(t, 100<<10)
+	const liar = "/peerlink-test/liar"
+
+	sn.Host.SetStreamHandler(liar, func(stream network.Stream) {
+		defer stream.Close()
+		request := make([]byte, rw.MaxFrameSize)
+		if _, err := rw.NewPReader(stream, key).Read(request); err != nil {
+			stream.Reset()
+			return
+		}
+		hash := sha256.Sum256(data)
+		forged := sha256.Sum256([]byte("something else"))
+		w := bufio.NewWriter(stream)
+		rw.NewPWriter(w, key).Write(append(hash[:], forged[:]...))
+		rw.WriteData(bytes.NewReader(data), key, w, nil, logging.Discard())
+		w.Flush()
+	})
+
+	stream, err := rn.Host.NewStream(ctx, sn.Host.ID(), liar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng := protocol.SplitRanges(int64(len(data)), 1)[0]
+	var got bytes.Buffer
+	if _, _, err := protocol.ReceiveFile(ctx, stream, &got, rng, key, nil, rn.Logger); !errors.Is(err, protocol.ErrIntegrity) {
+		t.Fatalf("got %v, want ErrIntegrity", err)
+	}
+}
+
+// TestReceivePresentKeepsAttrs checks that a file found already in place is
+// left as it is, rather than given the attributes preserved by the sender.
+func TestReceivePresentKeepsAttrs(t *testing.T) {
+	sn, rn := localPair(t)
+	ctx := testContext(t)
+	data := randomData(t, 64<<10)
+	src := filepath.Join(t.TempDir(), "x.bin")
+	writeFile(t, src, data)
+	if err := os.Chmod(src, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(src, old, old); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "x.bin")
+	writeFile(t, dst, data)
+	if err := os.Chmod(dst, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := FileSource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startServer(ctx, sn, source, Options{Preserve: true}, ServeOptions{MaxParallel: 1})
+	result, err := recv(ctx, rn, sn, DirSink(dir), Options{Preserve: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done := <-s.finished; done.err != nil {
+		t.Fatalf("sender: %v", done.err)
+	}
+	if !result.Skipped {
+		t.Fatal("the file in place was received again")
+	}
+	after, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+		t.Fatalf("the file in place went from %v at %v to %v at %v", before.Mode(), before.ModTime(), after.Mode(), after.ModTime())
+	}
+}
@@ -0,0 +1,673 @@
+package peerlink
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+)
+
+// RoomFile is a file published in a room, which any other member may fetch
+// with Room.Fetch.
+type RoomFile = protocol.RoomFile
+
+// RoomOptions configures OpenRoom.
+type RoomOptions struct {
+	// Code joins the room created with that code. Empty creates a new room
+	// and reports its code through an EventCode event.
+	Code string
+	// Sink stores the files fetched from other members.
+	Sink Sink
+	// OnOffer, if set, is called with every file another member publishes,
+	// including those published before this member joined.
+	OnOffer func(RoomFile)
+	// OnJoin and OnLeave, if set, are called as other members join and
+	// leave the room.
+	OnJoin  func(peer.ID)
+	OnLeave func(peer.ID)
+}
+
+// Room is a group of peers that joined with the same code, in which any
+// member may publish files and the others choose which ones to fetch. The
+// member that created the room relays the announcements and hands each
+// member that joins a random room key, sealed with the key agreed on in that
+// member's handshake. Files are then fetched straight from the member that
+// published them, encrypted with the room key, through the same metadata,
+// transfer and complete check exchanges as any other file, each fetch over
+// protocols of its own. The creator is the hub of the room: members only
+// hear of each other and of the files published through it, nobody takes
+// its place, and the room ends for everybody when it leaves.
+type Room struct {
+	node     *p2p.Node
+	code     string
+	opts     Options
+	roomOpts RoomOptions
+	// creator is set on the member that created the room.
+	creator bool
+	key     []byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// members holds the other members. On the creator, each comes with the
+	// stream its messages travel on; the other members only talk to the
+	// creator, over upstream.
+	members  map[peer.ID]*protocol.RoomStream
+	upstream *protocol.RoomStream
+	// handshakes holds the keys of the peers that shook hands with the
+	// creator until they join or disconnect.
+	handshakes map[peer.ID]chan []byte
+	notifee    *network.NotifyBundle
+	files      map[string]RoomFile
+	// sources holds the files this member published, by ID.
+	sources map[string]Source
+	// fetches holds the scopes of the files being fetched from this member.
+	fetches map[string]bool
+}
+
+// OpenRoom creates a room, or joins the one created with roomOpts.Code. ctx
+// bounds getting into the room; the room itself lasts until Close or, for
+// members that joined, until its creator leaves.
+func (c *Client) OpenRoom(ctx context.Context, opts Options, roomOpts RoomOptions) (_ *Room, err error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	if roomOpts.Sink == nil {
+		return nil, errors.New("OpenRoom: a sink is required")
+	}
+
+	node, err := c.newNode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("OpenRoom: %w", err)
+	}
+	r := newRoom(node, opts, roomOpts)
+	defer func() {
+		if err != nil {
+			r.Close()
+		}
+	}()
+
+	if r.creator {
+		err = r.create(ctx)
+	} else {
+		err = r.join(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("OpenRoom: %w", err)
+	}
+	r.code = node.Code()
+	return r, nil
+}
+
+func newRoom(node *p2p.Node, opts Options, roomOpts RoomOptions) *Room {
+	r := &Room{
+		node:       node,
+		opts:       opts,
+		roomOpts:   roomOpts,
+		creator:    roomOpts.Code == "",
+		members:    make(map[peer.ID]*protocol.RoomStream),
+		handshakes: make(map[peer.ID]chan []byte),
+		files:      make(map[string]RoomFile),
+		sources:    make(map[string]Source),
+		fetches:    make(map[string]bool),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	node.Host.SetStreamHandler(p2p.RoomFetchProtocol, r.handleFetch)
+	return r
+}
+
+// create publishes a fresh code for the room and starts admitting members.
+func (r *Room) create(ctx context.Context) error {
+	if err := r.node.GenerateWordsAndCid(); err != nil {
+		return fmt.Errorf("failed to generate words and CID: %w", err)
+	}
+	r.key = make([]byte, 32)
+	if _, err := rand.Read(r.key); err != nil {
+		return fmt.Errorf("failed to generate room key: %w", err)
+	}
+	r.admit()
+
+	r.opts.emit(Event{Kind: EventPublishing})
+	publishCtx, cancel := phase(ctx, r.opts.Timeouts.Publish)
+	err := r.node.PublishAddress(publishCtx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to publish address to DHT: %w", err)
+	}
+	r.opts.emit(Event{Kind: EventPublished})
+	r.opts.emit(Event{Kind: EventCode, Code: r.node.Code()})
+
+	r.wg.Add(1)
+	go r.republish()
+	return nil
+}
+
+// admit lets peers shake hands with the creator and join the room.
+func (r *Room) admit() {
+	r.notifee = &network.NotifyBundle{DisconnectedF: func(n network.Network, conn network.Conn) {
+		remote := conn.RemotePeer()
+		if n.Connectedness(remote) == network.Connected {
+			return
+		}
+		// A peer that leaves without joining takes its handshake along
+		r.mu.Lock()
+		delete(r.handshakes, remote)
+		r.mu.Unlock()
+	}}
+	r.node.Host.Network().Notify(r.notifee)
+	r.node.Host.SetStreamHandler(p2p.HandshakeProtocol, r.handleHandshake)
+	r.node.Host.SetStreamHandler(p2p.RoomProtocol, r.handleMember)
+}
+
+// republish publishes the room under the new rendezvous CID every day, so
+// that members joining after midnight find it.
+func (r *Room) republish() {
+	defer r.wg.Done()
+	midnight := time.NewTimer(untilNextDay())
+	defer midnight.Stop()
+	for {
+		select {
+		case <-midnight.C:
+			if changed, err := r.node.RefreshCid(); err == nil && changed {
+				publishCtx, cancel := phase(r.ctx, r.opts.Timeouts.Publish)
+				if err := r.node.PublishAddress(publishCtx); err != nil {
+					r.node.Logger.Warn("failed to republish room for the new day", "err", err)
+				}
+				cancel()
+			}
+			midnight.Reset(untilNextDay())
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// handshake returns the channel delivering the key agreed on with remote.
+// The lock must be held.
+func (r *Room) handshake(remote peer.ID) chan []byte {
+	ch, ok := r.handshakes[remote]
+	if !ok {
+		ch = make(chan []byte, 1)
+		r.handshakes[remote] = ch
+	}
+	return ch
+}
+
+func (r *Room) handleHandshake(stream network.Stream) {
+	remote := stream.Conn().RemotePeer()
+	ctx, cancel := phase(r.ctx, r.opts.Timeouts.Phase)
+	defer cancel()
+	key, err := protocol.HandleHandshake(ctx, stream, r.node.Words(), r.node.Logger)
+	if err != nil {
+		r.node.Logger.Warn("peer failed the handshake", "peer", remote, "err", err)
+		r.opts.emit(Event{Kind: EventFailed, Peer: remote, Error: err.Error()})
+		return
+	}
+	r.mu.Lock()
+	ch := r.handshake(remote)
+	r.mu.Unlock()
+	select {
+	case ch <- key:
+	default:
+	}
+}
+
+// handleMember admits a peer that completed the handshake and relays its
+// messages until it leaves.
+func (r *Room) handleMember(stream network.Stream) {
+	remote := stream.Conn().RemotePeer()
+	r.mu.Lock()
+	ch := r.handshake(remote)
+	r.mu.Unlock()
+	// The peer may open the stream before this side saw the handshake end
+	var key []byte
+	waitCtx, cancel := phase(r.ctx, r.opts.Timeouts.Phase)
+	select {
+	case key = <-ch:
+	case <-waitCtx.Done():
+	}
+	cancel()
+	r.mu.Lock()
+	delete(r.handshakes, remote)
+	r.mu.Unlock()
+	if key == nil {
+		stream.Reset()
+		return
+	}
+
+	rs := protocol.NewRoomStream(stream, key)
+	r.mu.Lock()
+	welcome := protocol.RoomMessage{
+		Kind:    protocol.RoomWelcome,
+		Key:     r.key,
+		Members: []peer.AddrInfo{{ID: r.node.Host.ID()}},
+	}
+	for id := range r.members {
+		welcome.Members = append(welcome.Members, r.addrInfo(id))
+	}
+	for _, f := range r.files {
+		welcome.Files = append(welcome.Files, f)
+	}
+	// Hold the lock so that no message overtakes the welcome
+	err := rs.Send(welcome)
+	if err == nil {
+		r.members[remote] = rs
+	}
+	r.mu.Unlock()
+	if err != nil {
+		r.node.Logger.Warn("failed to welcome member", "member", remote, "err", err)
+		rs.Close()
+		return
+	}
+	r.node.Logger.Info("member joined the room", "member", remote)
+	r.broadcast(remote, protocol.RoomMessage{Kind: protocol.RoomJoined, Members: []peer.AddrInfo{r.addrInfo(remote)}})
+	r.joined(remote)
+
+	for {
+		msg, err := rs.Receive()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && r.ctx.Err() == nil {
+				r.node.Logger.Warn("lost member", "member", remote, "err", err)
+			}
+			r.removeMember(remote)
+			return
+		}
+		if msg.Kind != protocol.RoomOffer {
+			continue
+		}
+		for _, f := range msg.Files {
+			// Members can only publish files of their own
+			f.From = remote
+			r.mu.Lock()
+			taken, ok := r.files[f.ID]
+			r.mu.Unlock()
+			if f.ID == "" || f.Metadata.Filename == "" || ok && taken.From != remote {
+				continue
+			}
+			r.offered(f)
+			r.broadcast(remote, protocol.RoomMessage{Kind: protocol.RoomOffer, Files: []RoomFile{f}})
+		}
+	}
+}
+
+// addrInfo returns the addresses this node knows member at.
+func (r *Room) addrInfo(member peer.ID) peer.AddrInfo {
+	return peer.AddrInfo{ID: member, Addrs: r.node.Host.Peerstore().Addrs(member)}
+}
+
+// removeMember forgets a member that left and tells the others.
+func (r *Room) removeMember(member peer.ID) {
+	r.mu.Lock()
+	rs, ok := r.members[member]
+	delete(r.members, member)
+	for id, f := range r.files {
+		if f.From == member {
+			delete(r.files, id)
+		}
+	}
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	if rs != nil {
+		rs.Close()
+	}
+	r.node.Logger.Info("member left the room", "member", member)
+	if r.creator {
+		r.broadcast(member, protocol.RoomMessage{Kind: protocol.RoomLeft, Members: []peer.AddrInfo{{ID: member}}})
+	}
+	if r.roomOpts.OnLeave != nil {
+		r.roomOpts.OnLeave(member)
+	}
+}
+
+// broadcast sends msg to every member but except.
+func (r *Room) broadcast(except peer.ID, msg protocol.RoomMessage) {
+	r.mu.Lock()
+	streams := make(map[peer.ID]*protocol.RoomStream, len(r.members))
+	for id, rs := range r.members {
+		if id != except && rs != nil {
+			streams[id] = rs
+		}
+	}
+	r.mu.Unlock()
+	for id, rs := range streams {
+		if err := rs.Send(msg); err != nil {
+			r.node.Logger.Warn("failed to relay room message", "member", id, "kind", msg.Kind, "err", err)
+		}
+	}
+}
+
+func (r *Room) joined(member peer.ID) {
+	if r.roomOpts.OnJoin != nil {
+		r.roomOpts.OnJoin(member)
+	}
+}
+
+// offered records a file published by another member and reports it.
+func (r *Room) offered(f RoomFile) {
+	r.mu.Lock()
+	_, known := r.files[f.ID]
+	r.files[f.ID] = f
+	r.mu.Unlock()
+	if !known && r.roomOpts.OnOffer != nil {
+		r.roomOpts.OnOffer(f)
+	}
+}
+
+// join looks up the creator of the room, performs the handshake with it and
+// waits to be welcomed.
+func (r *Room) join(ctx context.Context) error {
+	p := newPairing()
+	if err := p.join(ctx, r.node, r.roomOpts.Code, r.opts); err != nil {
+		return err
+	}
+	return r.enter(ctx, p.peer, p.key)
+}
+
+// enter asks the creator, which this member shook hands with, to be let into
+// the room.
+func (r *Room) enter(ctx context.Context, creator peer.ID, key []byte) error {
+	streamCtx, cancel := phase(network.WithAllowLimitedConn(ctx, "peerlink"), r.opts.Timeouts.Phase)
+	defer cancel()
+	stream, err := r.node.Host.NewStream(streamCtx, creator, p2p.RoomProtocol)
+	if err != nil {
+		return fmt.Errorf("failed to create room stream: %w", err)
+	}
+	rs := protocol.NewRoomStream(stream, key)
+	stop := context.AfterFunc(streamCtx, func() { rs.Close() })
+	welcome, err := rs.Receive()
+	if !stop() {
+		err = errors.Join(err, streamCtx.Err())
+	}
+	if err == nil && (welcome.Kind != protocol.RoomWelcome || len(welcome.Key) != 32) {
+		err = errors.New("unexpected first message from the room")
+	}
+	if err != nil {
+		rs.Close()
+		return fmt.Errorf("failed to join the room: %w", err)
+	}
+	r.key = welcome.Key
+	r.upstream = rs
+	r.learn(welcome.Members)
+	for _, f := range welcome.Files {
+		r.offered(f)
+	}
+
+	r.wg.Add(1)
+	go r.follow(creator, rs)
+	return nil
+}
+
+// learn records the addresses of members, which files are fetched from.
+func (r *Room) learn(members []peer.AddrInfo) {
+	for _, member := range members {
+		if member.ID == r.node.Host.ID() {
+			continue
+		}
+		r.node.Host.Peerstore().AddAddrs(member.ID, member.Addrs, peerstore.PermanentAddrTTL)
+		r.mu.Lock()
+		_, known := r.members[member.ID]
+		if !known {
+			r.members[member.ID] = nil
+		}
+		r.mu.Unlock()
+		if !known {
+			r.joined(member.ID)
+		}
+	}
+}
+
+// follow applies the messages the creator relays until it leaves, which
+// ends the room.
+func (r *Room) follow(creator peer.ID, rs *protocol.RoomStream) {
+	defer r.wg.Done()
+	defer r.cancel()
+	for {
+		msg, err := rs.Receive()
+		if err != nil {
+			if r.ctx.Err() == nil {
+				r.node.Logger.Info("the creator closed the room", "creator", creator, "err", err)
+			}
+			return
+		}
+		switch msg.Kind {
+		case protocol.RoomJoined:
+			r.learn(msg.Members)
+		case protocol.RoomLeft:
+			for _, member := range msg.Members {
+				if member.ID != creator {
+					r.removeMember(member.ID)
+				}
+			}
+		case protocol.RoomOffer:
+			for _, f := range msg.Files {
+				if f.From != r.node.Host.ID() {
+					r.offered(f)
+				}
+			}
+		}
+	}
+}
+
+// Code returns the code of the room.
+func (r *Room) Code() string {
+	return r.code
+}
+
+// Members returns the other members of the room.
+func (r *Room) Members() []peer.ID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members := make([]peer.ID, 0, len(r.members))
+	for id := range r.members {
+		members = append(members, id)
+	}
+	return members
+}
+
+// Files returns the files the other members published and are still in the
+// room.
+func (r *Room) Files() []RoomFile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	files := make([]RoomFile, 0, len(r.files))
+	for _, f := range r.files {
+		if f.From != r.node.Host.ID() {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// Done is closed when the room ends, because Close was called or its
+// creator left.
+func (r *Room) Done() <-chan struct{} {
+	return r.ctx.Done()
+}
+
+// Publish announces src to the other members, who may then fetch it for as
+// long as this member stays in the room.
+func (r *Room) Publish(src Source) (RoomFile, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return RoomFile{}, fmt.Errorf("Publish: %w", err)
+	}
+	f := RoomFile{
+		ID:       utils.BytesToHex(id),
+		From:     r.node.Host.ID(),
+		Metadata: protocol.Metadata{Filename: src.Name(), Size: src.Size()},
+	}
+	r.mu.Lock()
+	r.sources[f.ID] = src
+	if r.creator {
+		r.files[f.ID] = f
+	}
+	r.mu.Unlock()
+
+	msg := protocol.RoomMessage{Kind: protocol.RoomOffer, Files: []RoomFile{f}}
+	if r.creator {
+		r.broadcast("", msg)
+		return f, nil
+	}
+	if err := r.upstream.Send(msg); err != nil {
+		if r.ctx.Err() != nil {
+			err = p2p.ErrDisconnected
+		}
+		return RoomFile{}, fmt.Errorf("Publish: %w", err)
+	}
+	return f, nil
+}
+
+// Fetch fetches a file another member published into the sink of the room.
+// Choosing to fetch it is the decision to accept it, so Options.Accept is
+// not asked; Options.Policy still applies. Several files may be fetched at
+// once, from the same member or not.
+func (r *Room) Fetch(ctx context.Context, f RoomFile) (*ReceiveResult, error) {
+	if f.From == r.node.Host.ID() {
+		return nil, errors.New("Fetch: the file was published by this member")
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Fetch: %w", err)
+	}
+	request, err := json.Marshal(protocol.RoomFetch{ID: f.ID, Nonce: utils.BytesToHex(nonce)})
+	if err != nil {
+		return nil, fmt.Errorf("Fetch: %w", err)
+	}
+	ctx, cancel := context.WithCancel(network.WithAllowLimitedConn(ctx, "peerlink"))
+	defer cancel()
+	stop := context.AfterFunc(r.ctx, cancel)
+	defer stop()
+
+	queryCtx, cancelQuery := phase(ctx, r.opts.Timeouts.Query)
+	stream, err := r.node.Host.NewStream(queryCtx, f.From, p2p.RoomFetchProtocol)
+	cancelQuery()
+	if err != nil {
+		return nil, fmt.Errorf("Fetch: failed to reach %s: %w", f.From, err)
+	}
+	if err := protocol.RequestFile(ctx, stream, string(request), r.key, r.node.Logger); err != nil {
+		return nil, fmt.Errorf("Fetch: %w", err)
+	}
+
+	opts := r.opts
+	opts.Accept = nil
+	rcv := &receiver{node: r.node, peer: f.From, opts: opts, key: r.key, scope: fetchScope(utils.BytesToHex(nonce))}
+	result, err := rcv.fetch(ctx, r.roomOpts.Sink)
+	if err != nil {
+		if r.ctx.Err() != nil && ctx.Err() != nil {
+			return nil, fmt.Errorf("Fetch: %w", p2p.ErrDisconnected)
+		}
+		return nil, fmt.Errorf("Fetch: %w", err)
+	}
+	return result, nil
+}
+
+// handleFetch serves a file this member published to the member asking for
+// it.
+func (r *Room) handleFetch(stream network.Stream) {
+	remote := stream.Conn().RemotePeer()
+	r.mu.Lock()
+	_, member := r.members[remote]
+	key := r.key
+	r.mu.Unlock()
+	if !member || key == nil {
+		stream.Reset()
+		return
+	}
+	ctx, cancel := phase(r.ctx, r.opts.Timeouts.Phase)
+	request, err := protocol.ReadFileRequest(ctx, stream, key)
+	cancel()
+	var req protocol.RoomFetch
+	if err == nil {
+		err = json.Unmarshal([]byte(request), &req)
+	}
+	if nonce, _ := utils.HexToBytes(req.Nonce); err == nil && len(nonce) != 8 {
+		err = fmt.Errorf("invalid nonce %q", req.Nonce)
+	}
+	if err != nil {
+		r.node.Logger.Warn("failed to read room file request", "member", remote, "err", err)
+		stream.Reset()
+		return
+	}
+	scope := fetchScope(req.Nonce)
+	r.mu.Lock()
+	src := r.sources[req.ID]
+	taken := r.fetches[scope]
+	if src != nil && !taken {
+		r.fetches[scope] = true
+	}
+	r.mu.Unlock()
+	if src == nil || taken {
+		protocol.AnswerFileRequest(stream, key, false)
+		return
+	}
+	defer func() {
+		r.mu.Lock()
+		delete(r.fetches, scope)
+		r.mu.Unlock()
+	}()
+
+	srv := newServer(r.ctx, r.node, src, r.opts, ServeOptions{MaxReceivers: 1, MaxParallel: 1})
+	srv.scope = scope
+	srv.adopt(remote, key)
+	srv.register()
+	defer srv.unregister()
+	if err := protocol.AnswerFileRequest(stream, key, true); err != nil {
+		r.node.Logger.Warn("failed to answer room file request", "member", remote, "err", err)
+		return
+	}
+
+	select {
+	case done := <-srv.finished:
+		if done.err != nil {
+			r.node.Logger.Warn("member failed to fetch file", "member", remote, "file", src.Name(), "err", done.err)
+			r.opts.emit(Event{Kind: EventFailed, Peer: remote, Error: done.err.Error()})
+			return
+		}
+		r.node.Logger.Info("member fetched file", "member", remote, "file", src.Name())
+		r.opts.emit(Event{Kind: EventComplete, Peer: remote})
+	case <-r.ctx.Done():
+	}
+}
+
+// fetchScope returns the scope of the protocols the file fetched with nonce
+// is served over.
+func fetchScope(nonce string) string {
+	return "room-fetch/" + nonce
+}
+
+// Close leaves the room, interrupting any transfer in progress, and shuts
+// the node down. Closing the room its creator opened ends it for everybody.
+func (r *Room) Close() error {
+	r.cancel()
+	r.node.Host.RemoveStreamHandler(p2p.RoomProtocol)
+	r.node.Host.RemoveStreamHandler(p2p.RoomFetchProtocol)
+	r.node.Host.RemoveStreamHandler(p2p.HandshakeProtocol)
+	if r.notifee != nil {
+		r.node.Host.Network().StopNotify(r.notifee)
+	}
+	r.mu.Lock()
+	for _, rs := range r.members {
+		if rs != nil {
+			rs.Close()
+		}
+	}
+	if r.upstream != nil {
+		r.upstream.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return r.node.Close()
+}
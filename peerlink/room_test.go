@@ -0,0 +1,199 @@
+package peerlink
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedSource offers data, but only lets it be read once gate is closed.
+// Every Open is reported on opened.
+type gatedSource struct {
+	name   string
+	data   []byte
+	gate   chan struct{}
+	opened chan struct{}
+}
+
+func (s *gatedSource) Name() string { return s.name }
+func (s *gatedSource) Size() int64  { return int64(len(s.data)) }
+
+func (s *gatedSource) Open() (io.ReadSeekCloser, error) {
+	select {
+	case s.opened <- struct{}{}:
+	default:
+	}
+	<-s.gate
+	return nopCloser{bytes.NewReader(s.data)}, nil
+}
+
+// newLocalRoom returns a room on a local node. It is created if creator is
+// nil, and otherwise joined through creator, as if found through the DHT.
+func newLocalRoom(t *testing.T, creator *Room) *Room {
+	t.Helper()
+	ctx := testContext(t)
+	n := newLocalNode(t)
+	opts := Options{}
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	roomOpts := RoomOptions{Sink: DirSink(t.TempDir())}
+	if creator != nil {
+		roomOpts.Code = "joined"
+	}
+	r := newRoom(n, opts, roomOpts)
+	t.Cleanup(func() {
+		r.cancel()
+		r.mu.Lock()
+		for _, rs := range r.members {
+			if rs != nil {
+				rs.Close()
+			}
+		}
+		if r.upstream != nil {
+			r.upstream.Close()
+		}
+		r.mu.Unlock()
+		r.wg.Wait()
+	})
+
+	if creator == nil {
+		if err := n.GenerateWordsAndCid(); err != nil {
+			t.Fatal(err)
+		}
+		r.key = make([]byte, 32)
+		if _, err := rand.Read(r.key); err != nil {
+			t.Fatal(err)
+		}
+		r.admit()
+		return r
+	}
+
+	connect(t, creator.node, n)
+	if err := n.SetWordsAndCid(creator.node.Words()); err != nil {
+		t.Fatal(err)
+	}
+	rcv := &receiver{node: n, peer: creator.node.Host.ID(), opts: opts}
+	if err := rcv.handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.enter(ctx, creator.node.Host.ID(), rcv.key); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// waitFiles waits until r knows of n files published by other members.
+func waitFiles(t *testing.T, r *Room, n int) []RoomFile {
+	t.Helper()
+	ctx := testContext(t)
+	for {
+		if files := r.Files(); len(files) == n {
+			return files
+		}
+		select {
+		case <-time.After(20 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("the room holds %d files, want %d", len(r.Files()), n)
+		}
+	}
+}
+
+// TestRoomFetch checks that several files are fetched at once from the
+// same member, and that the creator still admits members while it serves
+// files of its own.
+func TestRoomFetch(t *testing.T) {
+	creator := newLocalRoom(t, nil)
+	a := newLocalRoom(t, creator)
+	b := newLocalRoom(t, creator)
+
+	gated := &gatedSource{
+		name:   "creator.bin",
+		data:   randomData(t, 512<<10),
+		gate:   make(chan struct{}),
+		opened: make(chan struct{}, 1),
+	}
+	if _, err := creator.Publish(gated); err != nil {
+		t.Fatal(err)
+	}
+	data := map[string][]byte{"creator.bin": gated.data}
+	for _, name := range []string{"one.bin", "two.bin"} {
+		data[name] = randomData(t, 1<<20)
+		if _, err := a.Publish(BytesSource(name, data[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := testContext(t)
+	var wg sync.WaitGroup
+	fetch := func(r *Room, f RoomFile) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := r.Fetch(ctx, f)
+			if err != nil {
+				t.Errorf("fetching %s: %v", f.Metadata.Filename, err)
+				return
+			}
+			if got, _ := os.ReadFile(result.Path); !bytes.Equal(got, data[f.Metadata.Filename]) {
+				t.Errorf("%s differs from the file published", f.Metadata.Filename)
+			}
+		}()
+	}
+	for _, f := range waitFiles(t, b, 3) {
+		fetch(b, f)
+	}
+	for _, f := range waitFiles(t, a, 1) {
+		fetch(a, f)
+	}
+
+	// A member joins while the creator is serving its file
+	select {
+	case <-gated.opened:
+	case <-ctx.Done():
+		t.Fatal("the creator's file was not fetched")
+	}
+	c := newLocalRoom(t, creator)
+	waitFiles(t, c, 3)
+	close(gated.gate)
+	wg.Wait()
+}
+
+// TestRoomForgetsHandshake checks that the creator forgets the handshake of
+// a peer that disconnects without joining.
+func TestRoomForgetsHandshake(t *testing.T) {
+	ctx := testContext(t)
+	creator := newLocalRoom(t, nil)
+	n := newLocalNode(t)
+	connect(t, creator.node, n)
+	if err := n.SetWordsAndCid(creator.node.Words()); err != nil {
+		t.Fatal(err)
+	}
+	rcv := &receiver{node: n, peer: creator.node.Host.ID(), opts: Options{Timeouts: DefaultTimeouts}}
+	if err := rcv.handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pending := func() int {
+		creator.mu.Lock()
+		defer creator.mu.Unlock()
+		return len(creator.handshakes)
+	}
+	for pending() == 0 {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("the creator did not record the handshake")
+		}
+	}
+
+	n.Host.Network().ClosePeer(creator.node.Host.ID())
+	for pending() > 0 {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("the creator kept the handshake of a peer that left")
+		}
+	}
+}
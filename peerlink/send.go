@@ -0,0 +1,37 @@
+package peerlink
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/SyedMa3/peerlink/protocol"
+)
+
+// Send offers src under a freshly generated code and blocks until a receiver
+// has fetched it, declined it, or ctx is done. The code is reported through
+// an EventCode event as soon as it has been published.
+func (c *Client) Send(ctx context.Context, src Source, opts Options) (*SendResult, error) {
+	served, err := c.serve(ctx, src, opts, ServeOptions{MaxReceivers: 1, MaxParallel: 1}, true, false)
+	if err != nil {
+		return nil, fmt.Errorf("Send: %w", err)
+	}
+	result := served.Receivers[0]
+	return &result, nil
+}
+
+// SendTo pushes src to the receiver listening on code, see Listen, and
+// blocks until it has fetched it, declined it, or ctx is done. The roles are
+// reversed only for finding each other: the receiver still performs the
+// handshake and fetches the file as in Receive.
+func (c *Client) SendTo(ctx context.Context, code string, src Source, opts Options) (*SendResult, error) {
+	if _, err := protocol.ParseCode(code); err != nil {
+		return nil, fmt.Errorf("SendTo: %w", err)
+	}
+	served, err := c.serve(ctx, src, opts, ServeOptions{MaxReceivers: 1, MaxParallel: 1, Code: code}, true, true)
+	if err != nil {
+		return nil, fmt.Errorf("SendTo: %w", err)
+	}
+	result := served.Receivers[0]
+	result.Code = code
+	return &result, nil
+}
@@ -0,0 +1,770 @@
+package peerlink
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ServeOptions limits how long and to whom Serve offers a file.
+type ServeOptions struct {
+	// MaxReceivers stops serving after that many receivers have fetched
+	// the file. Zero means no limit.
+	MaxReceivers int
+	// MaxParallel caps the receivers served at the same time; further
+	// receivers are asked to wait and retry. Zero means no limit and 1
+	// serves receivers one after another.
+	MaxParallel int
+	// Until stops accepting new receivers after this long. Transfers in
+	// progress are allowed to finish. Zero means no limit.
+	Until time.Duration
+	// Code serves under an existing code instead of a fresh one, so that
+	// several nodes holding the same file can serve it together and a
+	// swarm receiver can download from all of them at once.
+	Code string
+}
+
+// ServeResult describes the outcome of Serve.
+type ServeResult struct {
+	Code string
+	// Receivers lists the receivers that fetched the file, in the order
+	// they finished.
+	Receivers []SendResult
+	// Failed counts the receivers whose session failed or who declined.
+	Failed int
+}
+
+// Serve offers src under a single code to many receivers, running an
+// independent handshake and session for each. Every receiver that finishes
+// is reported through an EventComplete event and every failed one through
+// EventFailed. Serve returns once the limits in serveOpts are reached, or
+// with an error when ctx is done.
+func (c *Client) Serve(ctx context.Context, src Source, opts Options, serveOpts ServeOptions) (*ServeResult, error) {
+	result, err := c.serve(ctx, src, opts, serveOpts, false, false)
+	if err != nil {
+		return nil, fmt.Errorf("Serve: %w", err)
+	}
+	return result, nil
+}
+
+// serve offers src until the limits in serveOpts are reached. With push, the
+// receiver listening on serveOpts.Code is looked up and asked to fetch src
+// instead of publishing the code for receivers to look up.
+func (c *Client) serve(ctx context.Context, src Source, opts Options, serveOpts ServeOptions, failFast, push bool) (*ServeResult, error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+
+	start := time.Now()
+	node, err := c.newNode(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer node.Close()
+	bootstrapped := time.Now()
+
+	if serveOpts.Code != "" {
+		words, err := protocol.ParseCode(serveOpts.Code)
+		if err != nil {
+			return nil, err
+		}
+		if err := node.SetWordsAndCid(words); err != nil {
+			return nil, fmt.Errorf("failed to set words and CID: %w", err)
+		}
+	} else if err := node.GenerateWordsAndCid(); err != nil {
+		return nil, fmt.Errorf("failed to generate words and CID: %w", err)
+	}
+
+	serveCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	s := newServer(serveCtx, node, src, opts, serveOpts)
+	// The checksum is offered along with the file, so calculate it while
+	// the code is being published.
+	go s.fileHash()
+	s.stats.phase(PhaseBootstrap, start, bootstrapped)
+	s.register()
+	defer s.unregister()
+
+	if push {
+		if err := s.push(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		opts.emit(Event{Kind: EventPublishing})
+		start = time.Now()
+		if err := s.publish(ctx); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		s.published = time.Now()
+		s.stats.phase(PhasePublish, start, s.published)
+		s.mu.Unlock()
+		opts.emit(Event{Kind: EventPublished})
+		opts.emit(Event{Kind: EventCode, Code: node.Code()})
+	}
+
+	result := &ServeResult{Code: node.Code()}
+	var until <-chan time.Time
+	if serveOpts.Until > 0 {
+		timer := time.NewTimer(serveOpts.Until)
+		defer timer.Stop()
+		until = timer.C
+	}
+	midnight := time.NewTimer(untilNextDay())
+	defer midnight.Stop()
+
+	for {
+		select {
+		case done := <-s.finished:
+			if done.err != nil {
+				if failFast {
+					return nil, done.err
+				}
+				result.Failed++
+				node.Logger.Warn("receiver failed", "receiver", done.peer, "err", done.err)
+				opts.emit(Event{Kind: EventFailed, Peer: done.peer, Error: done.err.Error()})
+			} else {
+				done.result.Code = result.Code
+				result.Receivers = append(result.Receivers, done.result)
+				opts.emit(Event{Kind: EventComplete, Peer: done.peer})
+				if serveOpts.MaxReceivers > 0 && len(result.Receivers) >= serveOpts.MaxReceivers {
+					s.stopAccepting()
+				}
+			}
+		case <-until:
+			node.Logger.Info("no longer accepting receivers", "after", serveOpts.Until)
+			s.stopAccepting()
+			until = nil
+		case <-midnight.C:
+			// The rendezvous CID is derived from the date, so receivers
+			// starting after midnight look for a new one.
+			if !push {
+				s.republish(ctx)
+			}
+			midnight.Reset(untilNextDay())
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if s.drained() {
+			return result, nil
+		}
+	}
+}
+
+// untilNextDay returns the time left until shortly after the next UTC midnight.
+func untilNextDay() time.Duration {
+	now := time.Now().UTC()
+	return now.Truncate(24 * time.Hour).Add(24*time.Hour + time.Minute).Sub(now)
+}
+
+// sessionDone reports the outcome of one receiver's session.
+type sessionDone struct {
+	peer   peer.ID
+	result SendResult
+	err    error
+}
+
+// server serves the protocol handlers to any number of receivers, keeping a
+// separate session, and session key, for each of them.
+type server struct {
+	ctx      context.Context
+	node     *p2p.Node
+	src      Source
+	opts     Options
+	limits   ServeOptions
+	metadata protocol.Metadata
+	notifee  *network.NotifyBundle
+	finished chan sessionDone
+	// scope, if set, serves the file over protocols of its own, as
+	// described for p2p.Scoped.
+	scope string
+
+	// hash is calculated on the first request for part of the file.
+	hashOnce sync.Once
+	hash     []byte
+	hashErr  error
+
+	// manifest is built on the first request from a swarm receiver.
+	manifestOnce sync.Once
+	manifest     *protocol.Manifest
+	manifestErr  error
+
+	mu        sync.Mutex
+	sessions  map[peer.ID]*sendSession
+	accepting bool
+	// stats holds the phases shared by all sessions and published is
+	// when the code was first published.
+	stats     Stats
+	published time.Time
+}
+
+// sendSession is the state of the transfer to a single receiver.
+type sendSession struct {
+	server     *server
+	peer       peer.ID
+	key        []byte
+	handshaken chan struct{}
+	// transferred is closed once result holds the outcome of the transfer.
+	transferred  chan struct{}
+	transferOnce sync.Once
+	result       SendResult
+	once         sync.Once
+	// waiting ends the session if the receiver does not open its next
+	// stream in time. The server's lock guards it.
+	waiting *time.Timer
+
+	// When the session reached each phase, for its Stats.
+	started       time.Time
+	handshook     time.Time
+	transferStart time.Time
+	transferEnd   time.Time
+
+	// The file may be sent as several ranges over parallel streams. The
+	// first range sets how many streams the file is split across.
+	beginOnce sync.Once
+	meter     *rw.Meter
+	rangesMu  sync.Mutex
+	streams   int
+	ranges    []bool
+	sent      int64
+}
+
+func newServer(ctx context.Context, node *p2p.Node, src Source, opts Options, limits ServeOptions) *server {
+	s := &server{
+		ctx:    ctx,
+		node:   node,
+		src:    src,
+		opts:   opts,
+		limits: limits,
+		metadata: protocol.Metadata{
+			Filename: src.Name(),
+			Size:     src.Size(),
+		},
+		finished:  make(chan sessionDone),
+		sessions:  make(map[peer.ID]*sendSession),
+		accepting: true,
+	}
+	if src, ok := src.(Attributer); ok && opts.Preserve {
+		attrs, err := src.Attrs()
+		if err != nil {
+			node.Logger.Warn("failed to read file attributes", "err", err)
+		}
+		s.metadata.Attrs = attrs
+	}
+	s.notifee = &network.NotifyBundle{DisconnectedF: s.disconnected}
+	return s
+}
+
+func (s *server) register() {
+	s.node.Host.SetStreamHandler(p2p.Scoped(p2p.HandshakeProtocol, s.scope), s.handleHandshake)
+	s.node.Host.SetStreamHandler(p2p.Scoped(p2p.MetadataProtocol, s.scope), s.handleMetadata)
+	s.node.Host.SetStreamHandler(p2p.Scoped(p2p.FileTransferProtocol, s.scope), s.handleFileTransfer)
+	s.node.Host.SetStreamHandler(p2p.Scoped(p2p.CompleteCheckProtocol, s.scope), s.handleCompleteCheck)
+	s.node.Host.SetStreamHandler(p2p.Scoped(p2p.ManifestProtocol, s.scope), s.handleManifest)
+	s.node.Host.SetStreamHandler(p2p.Scoped(p2p.ChunkProtocol, s.scope), s.handleChunks)
+	s.node.Host.Network().Notify(s.notifee)
+}
+
+// unregister stops serving the file, so that receivers finding the code
+// afterwards fail straight away.
+func (s *server) unregister() {
+	s.node.Host.Network().StopNotify(s.notifee)
+	s.node.RemoveScopedHandlers(s.scope)
+}
+
+func (s *server) publish(ctx context.Context) error {
+	ctx, cancel := phase(ctx, s.opts.Timeouts.Publish)
+	defer cancel()
+	if err := s.node.PublishAddress(ctx); err != nil {
+		return fmt.Errorf("failed to publish address to DHT: %w", err)
+	}
+	return nil
+}
+
+// push looks up the receiver listening on the code, connects to it and
+// knocks, so that it fetches the file from the server as usual.
+func (s *server) push(ctx context.Context) error {
+	s.opts.emit(Event{Kind: EventQuerying})
+	queryCtx, cancel := phase(ctx, s.opts.Timeouts.Query)
+	defer cancel()
+	start := time.Now()
+	providers, err := s.node.QueryAddress(queryCtx)
+	if err != nil {
+		return fmt.Errorf("failed to query DHT: %w", err)
+	}
+	queried := time.Now()
+	receiver, kind, err := s.node.Connect(queryCtx, providers)
+	if err != nil {
+		return fmt.Errorf("failed to connect to receiver: %w", err)
+	}
+	s.opts.emit(Event{Kind: EventConnected, Peer: receiver.ID, Connection: kind})
+	if kind != p2p.ConnDirect {
+		waitCtx, cancel := phase(ctx, s.opts.Timeouts.Phase)
+		kind = s.node.WaitForDirect(waitCtx, receiver.ID)
+		cancel()
+		if kind == p2p.ConnDirect {
+			s.opts.emit(Event{Kind: EventUpgraded, Peer: receiver.ID, Connection: kind})
+		}
+	}
+
+	knockCtx, cancel := phase(network.WithAllowLimitedConn(ctx, "peerlink"), s.opts.Timeouts.Phase)
+	defer cancel()
+	stream, err := s.node.Host.NewStream(knockCtx, receiver.ID, p2p.PushProtocol)
+	if err != nil {
+		return fmt.Errorf("failed to create push stream: %w", err)
+	}
+	if err := protocol.Knock(knockCtx, stream); err != nil {
+		return err
+	}
+	s.node.Logger.Info("knocked on receiver", "receiver", receiver.ID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.published = time.Now()
+	s.stats.phase(PhaseQuery, start, queried)
+	s.stats.phase(PhaseConnect, queried, s.published)
+	return nil
+}
+
+func (s *server) republish(ctx context.Context) {
+	changed, err := s.node.RefreshCid()
+	if err != nil || !changed {
+		return
+	}
+	go func() {
+		if err := s.publish(ctx); err != nil {
+			s.node.Logger.Warn("failed to republish address for the new day", "err", err)
+		}
+	}()
+}
+
+func (s *server) stopAccepting() {
+	s.mu.Lock()
+	s.accepting = false
+	s.mu.Unlock()
+}
+
+// drained reports whether the server stopped accepting receivers and has
+// no session left in progress.
+func (s *server) drained() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.accepting && len(s.sessions) == 0
+}
+
+// session returns the session of the receiver stream belongs to once its
+// handshake has completed, or nil after resetting stream.
+func (s *server) session(stream network.Stream) *sendSession {
+	s.mu.Lock()
+	sess := s.sessions[stream.Conn().RemotePeer()]
+	s.mu.Unlock()
+	if sess == nil {
+		stream.Reset()
+		return nil
+	}
+
+	select {
+	case <-sess.handshaken:
+		sess.stir()
+		return sess
+	case <-s.ctx.Done():
+		stream.Reset()
+		return nil
+	}
+}
+
+func (s *server) disconnected(n network.Network, conn network.Conn) {
+	remote := conn.RemotePeer()
+	s.mu.Lock()
+	sess := s.sessions[remote]
+	s.mu.Unlock()
+	if sess != nil && n.Connectedness(remote) != network.Connected {
+		sess.finish(fmt.Errorf("receiver %s: %w", remote, p2p.ErrDisconnected))
+	}
+}
+
+// expect ends the session unless the receiver opens a stream for what it
+// does next within the phase timeout, so that an idle receiver does not keep
+// its place among the MaxParallel served at once.
+func (sess *sendSession) expect(next string) {
+	s := sess.server
+	d := s.opts.Timeouts.Phase
+	if d <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess.waiting != nil {
+		sess.waiting.Stop()
+	}
+	sess.waiting = time.AfterFunc(d, func() {
+		s.node.Logger.Info("receiver went idle", "receiver", sess.peer, "expected", next)
+		s.node.Host.Network().ClosePeer(sess.peer)
+		sess.finish(fmt.Errorf("receiver %s did not ask for the %s: %w", sess.peer, next, protocol.ErrTimeout))
+	})
+}
+
+// stir notes that the receiver opened a stream.
+func (sess *sendSession) stir() {
+	s := sess.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess.waiting != nil {
+		sess.waiting.Stop()
+		sess.waiting = nil
+	}
+}
+
+// markTransferred records the outcome of the transfer for the complete check.
+func (sess *sendSession) markTransferred(size int64, hash []byte) {
+	sess.transferOnce.Do(func() {
+		// The receiver may hang up meanwhile, finishing the session
+		s := sess.server
+		s.mu.Lock()
+		sess.transferEnd = time.Now()
+		sess.result.Metadata = s.metadata
+		sess.result.Metadata.Size = size
+		sess.result.Hash = hash
+		s.mu.Unlock()
+		close(sess.transferred)
+	})
+}
+
+// begin is called by every stream carrying part of the file. The first one
+// announces the transfer and sets up the meter the streams share.
+func (sess *sendSession) begin() *rw.Meter {
+	sess.beginOnce.Do(func() {
+		s := sess.server
+		sess.transferStart = time.Now()
+		sess.meter = s.opts.meter(sess.peer, s.metadata.Size)
+		s.opts.emit(Event{Kind: EventTransferring, Peer: sess.peer, Metadata: &s.metadata})
+	})
+	return sess.meter
+}
+
+// rangeSent accounts for a range sent to the receiver and reports whether
+// the ranges sent so far make up the whole file. Every range of the split
+// must be sent exactly once, so that the receiver cannot have its transfer
+// counted as done, and its slot freed, while ranges are still flowing.
+func (sess *sendSession) rangeSent(rng protocol.Range, n int64, hash []byte) (bool, error) {
+	sess.rangesMu.Lock()
+	defer sess.rangesMu.Unlock()
+	if sess.ranges == nil {
+		sess.streams = rng.Streams
+		sess.ranges = make([]bool, rng.Streams)
+	}
+	i := rng.Index(sess.server.metadata.Size)
+	if rng.Streams != sess.streams || i < 0 || sess.ranges[i] {
+		return false, fmt.Errorf("receiver requested range %+v, which is not part of its split across %d streams", rng, sess.streams)
+	}
+	sess.ranges[i] = true
+	sess.sent += n
+	if slices.Contains(sess.ranges, false) {
+		return false, nil
+	}
+	sess.markTransferred(sess.sent, hash)
+	return true, nil
+}
+
+// finish ends the session and reports its outcome to serve.
+func (sess *sendSession) finish(err error) {
+	sess.once.Do(func() {
+		s := sess.server
+		s.mu.Lock()
+		if s.sessions[sess.peer] == sess {
+			delete(s.sessions, sess.peer)
+		}
+		if sess.waiting != nil {
+			sess.waiting.Stop()
+		}
+		if err == nil {
+			sess.result.Stats = sess.stats()
+		}
+		result := sess.result
+		s.mu.Unlock()
+
+		select {
+		case s.finished <- sessionDone{peer: sess.peer, result: result, err: err}:
+		case <-s.ctx.Done():
+		}
+	})
+}
+
+// stats summarizes the completed session. The server's lock must be held.
+func (sess *sendSession) stats() Stats {
+	s := sess.server
+	stats := Stats{Phases: slices.Clone(s.stats.Phases)}
+	if !s.published.IsZero() && sess.started.After(s.published) {
+		stats.phase(PhaseWait, s.published, sess.started)
+	}
+	if !sess.started.IsZero() {
+		stats.phase(PhaseHandshake, sess.started, sess.handshook)
+	}
+	payload := int64(0)
+	if !sess.transferStart.IsZero() {
+		stats.phase(PhaseTransfer, sess.transferStart, sess.transferEnd)
+		payload = sess.result.Metadata.Size
+	}
+	stats.measure(s.node, sess.peer, payload, sess.meter)
+	return stats
+}
+
+// adopt starts a session with a receiver the node already shook hands with
+// and stops accepting other receivers.
+func (s *server) adopt(remote peer.ID, key []byte) {
+	sess := &sendSession{
+		server:      s,
+		peer:        remote,
+		key:         key,
+		handshaken:  make(chan struct{}),
+		transferred: make(chan struct{}),
+		result:      SendResult{Peer: remote},
+	}
+	close(sess.handshaken)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[remote] = sess
+	s.accepting = false
+}
+
+func (s *server) handleHandshake(stream network.Stream) {
+	remote := stream.Conn().RemotePeer()
+
+	s.mu.Lock()
+	if !s.accepting || s.sessions[remote] != nil {
+		s.mu.Unlock()
+		stream.Reset()
+		return
+	}
+	if s.limits.MaxParallel > 0 && len(s.sessions) >= s.limits.MaxParallel {
+		s.mu.Unlock()
+		s.node.Logger.Info("turning receiver away while busy", "receiver", remote)
+		if err := protocol.RejectHandshake(stream); err != nil {
+			stream.Reset()
+		}
+		return
+	}
+	sess := &sendSession{
+		server:      s,
+		peer:        remote,
+		handshaken:  make(chan struct{}),
+		transferred: make(chan struct{}),
+		started:     time.Now(),
+	}
+	s.sessions[remote] = sess
+	s.mu.Unlock()
+
+	ctx, cancel := phase(s.ctx, s.opts.Timeouts.Phase)
+	defer cancel()
+	key, err := protocol.HandleHandshake(ctx, stream, s.node.Words(), s.node.Logger)
+	if err != nil {
+		sess.finish(fmt.Errorf("handshake failed: %w", err))
+		return
+	}
+	sess.key = key
+	sess.result.Peer = remote
+	sess.handshook = time.Now()
+	close(sess.handshaken)
+	s.node.Logger.Info("handshake completed", "receiver", remote)
+	s.opts.emit(Event{Kind: EventHandshake, Peer: remote, Connection: s.node.ConnKind(remote)})
+	sess.expect("metadata")
+}
+
+func (s *server) handleMetadata(stream network.Stream) {
+	sess := s.session(stream)
+	if sess == nil {
+		return
+	}
+
+	metadata := s.metadata
+	hash, err := s.fileHash()
+	if err != nil {
+		stream.Reset()
+		sess.finish(err)
+		return
+	}
+	metadata.Hash = hash
+
+	ctx, cancel := phase(s.ctx, s.opts.Timeouts.Accept)
+	defer cancel()
+	answer, err := protocol.SendMetadata(ctx, stream, metadata, sess.key, s.node.Logger)
+	if err != nil {
+		sess.finish(fmt.Errorf("metadata exchange failed: %w", err))
+		return
+	}
+	switch answer {
+	case protocol.RelayLimited:
+		s.node.Logger.Info("receiver refused the file over a limited relay", "receiver", sess.peer)
+		sess.finish(fmt.Errorf("receiver %s: %w", sess.peer, p2p.ErrRelayLimited))
+	case protocol.Declined:
+		s.node.Logger.Info("receiver declined the file transfer", "receiver", sess.peer)
+		sess.finish(protocol.ErrDeclined)
+	case protocol.Present:
+		s.node.Logger.Info("receiver already has the file", "receiver", sess.peer)
+		s.opts.emit(Event{Kind: EventPresent, Peer: sess.peer, Metadata: &s.metadata})
+		s.mu.Lock()
+		sess.result.Skipped = true
+		s.mu.Unlock()
+		sess.markTransferred(s.metadata.Size, hash)
+	default:
+		s.opts.emit(Event{Kind: EventAccepted, Peer: sess.peer, Metadata: &s.metadata})
+		sess.expect("file")
+	}
+}
+
+func (s *server) handleFileTransfer(stream network.Stream) {
+	sess := s.session(stream)
+	if sess == nil {
+		return
+	}
+	select {
+	case <-sess.transferred:
+		// The whole file was sent already
+		stream.Reset()
+		return
+	default:
+	}
+
+	file, err := s.src.Open()
+	if err != nil {
+		stream.Reset()
+		sess.finish(fmt.Errorf("failed to open source: %w", err))
+		return
+	}
+	defer file.Close()
+
+	meter := sess.begin()
+	stream = protocol.WithLimit(s.ctx, protocol.WithIdleTimeout(stream, s.opts.Timeouts.Idle), s.opts.Limit)
+	rng, n, hash, err := protocol.SendFile(s.ctx, stream, file, s.metadata.Size, sess.key, s.fileHash, meter, s.node.Logger)
+	if err != nil {
+		sess.finish(fmt.Errorf("file transfer failed: %w", err))
+		return
+	}
+	s.node.Logger.Debug("range sent", "receiver", sess.peer, "offset", rng.Offset, "bytes", n)
+	last, err := sess.rangeSent(rng, n, hash)
+	if err != nil {
+		sess.finish(err)
+		return
+	}
+	if !last {
+		return
+	}
+	s.node.Logger.Info("file sent", "receiver", sess.peer, "bytes", sess.result.Metadata.Size, "streams", rng.Streams)
+	s.opts.emit(Event{Kind: EventTransferred, Peer: sess.peer, Metadata: &s.metadata})
+}
+
+// fileHash returns the checksum of the source, calculating it on first use.
+func (s *server) fileHash() ([]byte, error) {
+	s.hashOnce.Do(func() {
+		file, err := s.src.Open()
+		if err != nil {
+			s.hashErr = fmt.Errorf("failed to open source: %w", err)
+			return
+		}
+		defer file.Close()
+		s.hash, s.hashErr = utils.CalculateHash(file)
+	})
+	return s.hash, s.hashErr
+}
+
+// loadManifest returns the manifest of the source, building it on first use.
+func (s *server) loadManifest() (*protocol.Manifest, error) {
+	s.manifestOnce.Do(func() {
+		file, err := s.src.Open()
+		if err != nil {
+			s.manifestErr = fmt.Errorf("failed to open source: %w", err)
+			return
+		}
+		defer file.Close()
+		start := time.Now()
+		s.manifest, s.manifestErr = protocol.BuildManifest(file, protocol.DefaultChunkSize)
+		if s.manifestErr == nil {
+			s.node.Logger.Info("built manifest", "chunks", len(s.manifest.Chunks), "duration", time.Since(start))
+		}
+	})
+	return s.manifest, s.manifestErr
+}
+
+func (s *server) handleManifest(stream network.Stream) {
+	sess := s.session(stream)
+	if sess == nil {
+		return
+	}
+
+	manifest, err := s.loadManifest()
+	if err != nil {
+		stream.Reset()
+		sess.finish(err)
+		return
+	}
+	ctx, cancel := phase(s.ctx, s.opts.Timeouts.Phase)
+	defer cancel()
+	if err := protocol.SendManifest(ctx, stream, manifest, sess.key, s.node.Logger); err != nil {
+		sess.finish(fmt.Errorf("manifest exchange failed: %w", err))
+	}
+}
+
+// handleChunks serves the chunks a swarm receiver asks for. The receiver
+// fetches the other chunks from other providers, so only part of the file
+// may be sent.
+func (s *server) handleChunks(stream network.Stream) {
+	sess := s.session(stream)
+	if sess == nil {
+		return
+	}
+
+	manifest, err := s.loadManifest()
+	if err != nil {
+		stream.Reset()
+		sess.finish(err)
+		return
+	}
+	file, err := s.src.Open()
+	if err != nil {
+		stream.Reset()
+		sess.finish(fmt.Errorf("failed to open source: %w", err))
+		return
+	}
+	defer file.Close()
+
+	meter := sess.begin()
+	stream = protocol.WithLimit(s.ctx, protocol.WithIdleTimeout(stream, s.opts.Timeouts.Idle), s.opts.Limit)
+	n, err := protocol.ServeChunks(s.ctx, stream, file, manifest, sess.key, meter, s.node.Logger)
+	if err != nil {
+		sess.finish(fmt.Errorf("chunk transfer failed: %w", err))
+		return
+	}
+	sess.markTransferred(n, manifest.Hash)
+	s.node.Logger.Info("chunks sent", "receiver", sess.peer, "bytes", n)
+	s.opts.emit(Event{Kind: EventTransferred, Peer: sess.peer, Metadata: &s.metadata})
+}
+
+func (s *server) handleCompleteCheck(stream network.Stream) {
+	sess := s.session(stream)
+	if sess == nil {
+		return
+	}
+	defer stream.Close()
+
+	ctx, cancel := phase(s.ctx, s.opts.Timeouts.Phase)
+	defer cancel()
+	select {
+	case <-sess.transferred:
+	case <-ctx.Done():
+		stream.Reset()
+		sess.finish(fmt.Errorf("complete check arrived before the transfer finished: %w", protocol.ErrTimeout))
+		return
+	}
+	if err := protocol.ReceiveCompleteCheck(ctx, stream, sess.key, s.node.Logger); err != nil {
+		sess.finish(fmt.Errorf("complete check failed: %w", err))
+		return
+	}
+	sess.finish(nil)
+}
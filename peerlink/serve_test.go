@@ -0,0 +1,187 @@
+package peerlink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestServeMany(t *testing.T) {
+	for _, parallel := range []int{0, 1} {
+		sn := newLocalNode(t)
+		if err := sn.GenerateWordsAndCid(); err != nil {
+			t.Fatal(err)
+		}
+		ctx := testContext(t)
+		data := randomData(t, 1<<20)
+		s := startServer(ctx, sn, BytesSource("x.bin", data), Options{}, ServeOptions{MaxParallel: parallel})
+
+		const receivers = 3
+		var wg sync.WaitGroup
+		errs := make(chan error, receivers)
+		for range receivers {
+			rn := newLocalNode(t)
+			connect(t, sn, rn)
+			if err := rn.SetWordsAndCid(sn.Words()); err != nil {
+				t.Fatal(err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := recv(ctx, rn, sn, DirSink(t.TempDir()), Options{})
+				errs <- err
+			}()
+		}
+		for range receivers {
+			if done := <-s.finished; done.err != nil {
+				t.Fatalf("parallel %d: sender: %v", parallel, done.err)
+			}
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("parallel %d: receiver: %v", parallel, err)
+			}
+		}
+	}
+}
+
+// TestServeSessionIsolation checks that a receiver only reaches the file
+// through a session of its own, and that one breaking the protocol fails its
+// session without disturbing the others.
+func TestServeSessionIsolation(t *testing.T) {
+	sn := newLocalNode(t)
+	if err := sn.GenerateWordsAndCid(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := testContext(t)
+	data := randomData(t, 1<<20)
+	s := startServer(ctx, sn, BytesSource("x.bin", data), Options{}, ServeOptions{})
+
+	joined := func() *p2p.Node {
+		n := newLocalNode(t)
+		connect(t, sn, n)
+		if err := n.SetWordsAndCid(sn.Words()); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// A peer that skipped the handshake gets nothing
+	stranger := joined()
+	stream, err := stranger.Host.NewStream(ctx, sn.Host.ID(), p2p.FileTransferProtocol)
+	if err == nil {
+		if _, err := io.ReadAll(stream); err == nil {
+			t.Fatal("a peer without a session read from the file transfer stream")
+		}
+	}
+
+	// A receiver asking for part of the file as if it were all of it fails
+	// its own session
+	cheater := joined()
+	opts := Options{}
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	r := &receiver{node: cheater, peer: sn.Host.ID(), opts: opts}
+	if err := r.handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stream, err = cheater.Host.NewStream(ctx, sn.Host.ID(), p2p.FileTransferProtocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := protocol.Range{Offset: 0, Length: int64(len(data) / 2), Streams: 1}
+	if _, _, err := protocol.ReceiveFile(ctx, stream, io.Discard, half, r.key, nil, cheater.Logger); err == nil {
+		t.Fatal("the sender served a range that is not part of a split")
+	}
+
+	// An honest receiver is served as usual
+	honest := joined()
+	dir := t.TempDir()
+	if _, err := recv(ctx, honest, sn, DirSink(dir), Options{Streams: 2}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "x.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("honest receiver got %d bytes, %v", len(got), err)
+	}
+
+	outcomes := make(map[peer.ID]error)
+	for range 2 {
+		done := <-s.finished
+		outcomes[done.peer] = done.err
+	}
+	if outcomes[cheater.Host.ID()] == nil {
+		t.Error("the session of the receiver breaking the protocol succeeded")
+	}
+	if err := outcomes[honest.Host.ID()]; err != nil {
+		t.Errorf("the session of the honest receiver failed: %v", err)
+	}
+}
+
+func TestServeRejectsRepeatedRange(t *testing.T) {
+	sn, rn := localPair(t)
+	ctx := testContext(t)
+	data := randomData(t, 1<<20)
+	s := startServer(ctx, sn, BytesSource("x.bin", data), Options{}, ServeOptions{})
+
+	opts := Options{}
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	r := &receiver{node: rn, peer: sn.Host.ID(), opts: opts}
+	if err := r.handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Sending the first of two ranges twice must not count as the whole
+	// file
+	first := protocol.SplitRanges(int64(len(data)), 2)[0]
+	for range 2 {
+		stream, err := rn.Host.NewStream(ctx, sn.Host.ID(), p2p.FileTransferProtocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		protocol.ReceiveFile(context.WithoutCancel(ctx), stream, io.Discard, first, r.key, nil, rn.Logger)
+	}
+	if done := <-s.finished; done.err == nil {
+		t.Fatal("the session ended successfully after the same range was sent twice")
+	}
+}
+
+// TestServeIdleReceiver checks that a receiver going quiet after the
+// handshake gives up its place to the next one.
+func TestServeIdleReceiver(t *testing.T) {
+	sn := newLocalNode(t)
+	if err := sn.GenerateWordsAndCid(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := testContext(t)
+	opts := Options{Timeouts: Timeouts{Phase: 200 * time.Millisecond}}
+	s := startServer(ctx, sn, BytesSource("x.bin", randomData(t, 1<<10)), opts, ServeOptions{MaxParallel: 1})
+
+	idle := newLocalNode(t)
+	connect(t, sn, idle)
+	if err := idle.SetWordsAndCid(sn.Words()); err != nil {
+		t.Fatal(err)
+	}
+	r := &receiver{node: idle, peer: sn.Host.ID(), opts: Options{Timeouts: DefaultTimeouts}}
+	if err := r.handshake(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case done := <-s.finished:
+		if !errors.Is(done.err, protocol.ErrTimeout) {
+			t.Fatalf("the idle receiver's session ended with %v, want a timeout", done.err)
+		}
+	case <-ctx.Done():
+		t.Fatal("the idle receiver kept its place")
+	}
+}
@@ -0,0 +1,272 @@
+package peerlink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SessionOptions configures OpenSession.
+type SessionOptions struct {
+	// Code joins the session the peer opened with that code. Empty opens
+	// a new session and reports its code through an EventCode event.
+	Code string
+	// Sink stores the files the peer sends. opts.Accept is asked about
+	// each of them first.
+	Sink Sink
+	// OnReceive, if set, is called with the outcome of every file the
+	// peer sent, accepted or not.
+	OnReceive func(*ReceiveResult, error)
+	// Resume is how long the session survives the connection to the peer
+	// dropping. Meanwhile both sides dial each other again and, once
+	// connected, carry on with the key agreed on in the handshake; the
+	// peer must allow it too. Zero ends the session as soon as the
+	// connection drops.
+	Resume time.Duration
+}
+
+// Session is a connection to a peer, authenticated once with a code, over
+// which both sides may send each other any number of files. Each file goes
+// through the usual metadata, transfer and complete check exchanges with
+// the key agreed on in the handshake, so it may be declined on its own.
+type Session struct {
+	node      *p2p.Node
+	pairing   *pairing
+	code      string
+	opts      Options
+	sink      Sink
+	onReceive func(*ReceiveResult, error)
+	resume    time.Duration
+
+	// away is set while the session tries to reconnect to the peer.
+	awayMu sync.Mutex
+	away   bool
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	notifee *network.NotifyBundle
+	sendMu  sync.Mutex
+
+	// receives counts the files being received. Once closed is set, no
+	// more are started.
+	mu       sync.Mutex
+	closed   bool
+	receives sync.WaitGroup
+}
+
+// OpenSession opens a session with a peer, or joins the one it opened if
+// sessOpts.Code is set. ctx bounds getting the session established; the
+// session itself lasts until Close or until the peer leaves it.
+func (c *Client) OpenSession(ctx context.Context, opts Options, sessOpts SessionOptions) (_ *Session, err error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	if sessOpts.Sink == nil {
+		return nil, errors.New("OpenSession: a sink is required")
+	}
+
+	node, err := c.newNode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("OpenSession: %w", err)
+	}
+	s := newSession(node, opts, sessOpts)
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	if sessOpts.Code != "" {
+		err = s.pairing.join(ctx, node, sessOpts.Code, opts)
+	} else {
+		err = s.pairing.host(ctx, node, opts)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("OpenSession: %w", err)
+	}
+	s.code = node.Code()
+	s.watch()
+	return s, nil
+}
+
+// newSession prepares a session on node, ready for the pairing with the
+// peer.
+func newSession(node *p2p.Node, opts Options, sessOpts SessionOptions) *Session {
+	s := &Session{
+		node:      node,
+		pairing:   newPairing(),
+		opts:      opts,
+		sink:      sessOpts.Sink,
+		onReceive: sessOpts.OnReceive,
+		resume:    sessOpts.Resume,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	node.Host.SetStreamHandler(p2p.PushProtocol, s.handleKnock)
+	return s
+}
+
+// watch ends the session when the paired peer disconnects, or tries to
+// reconnect to it if the session resumes.
+func (s *Session) watch() {
+	remote := s.pairing.peer
+	s.notifee = &network.NotifyBundle{DisconnectedF: func(n network.Network, conn network.Conn) {
+		if conn.RemotePeer() != remote || n.Connectedness(remote) == network.Connected {
+			return
+		}
+		if s.resume <= 0 {
+			s.node.Logger.Info("peer left the session", "peer", remote)
+			s.cancel()
+			return
+		}
+		s.awayMu.Lock()
+		defer s.awayMu.Unlock()
+		if !s.away {
+			s.away = true
+			go s.reconnect(remote)
+		}
+	}}
+	s.node.Host.Network().Notify(s.notifee)
+}
+
+// reconnect dials remote with a growing delay until it is connected again,
+// and ends the session if that takes longer than s.resume.
+func (s *Session) reconnect(remote peer.ID) {
+	s.node.Logger.Info("lost the connection to the peer, reconnecting", "peer", remote, "resume", s.resume)
+	s.opts.emit(Event{Kind: EventReconnecting, Peer: remote})
+	ctx, cancel := context.WithTimeout(network.WithAllowLimitedConn(s.ctx, "peerlink"), s.resume)
+	defer cancel()
+	delay := minRetryDelay
+	for {
+		dialCtx, cancelDial := phase(ctx, s.opts.Timeouts.Phase)
+		err := s.node.Host.Connect(dialCtx, peer.AddrInfo{ID: remote})
+		cancelDial()
+
+		// A drop noticed before away is cleared would be missed, so the
+		// connection is checked under the same lock
+		s.awayMu.Lock()
+		if err == nil && s.node.Host.Network().Connectedness(remote) == network.Connected {
+			s.away = false
+			s.awayMu.Unlock()
+			s.node.Logger.Info("reconnected to the peer", "peer", remote)
+			s.opts.emit(Event{Kind: EventReconnected, Peer: remote, Connection: s.node.ConnKind(remote)})
+			return
+		}
+		s.awayMu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			if s.ctx.Err() == nil {
+				s.node.Logger.Info("peer did not come back to the session", "peer", remote)
+				s.cancel()
+			}
+			return
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// Peer returns the peer at the other end of the session.
+func (s *Session) Peer() peer.ID {
+	return s.pairing.peer
+}
+
+// Code returns the code the session was opened with.
+func (s *Session) Code() string {
+	return s.code
+}
+
+// Done is closed when the session ends, because Close was called or the
+// peer left and, if the session resumes, did not come back in time.
+func (s *Session) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Send offers src to the peer and blocks until it has fetched it, declined
+// it, or ctx is done. Files are sent one at a time: concurrent calls wait
+// for their turn.
+func (s *Session) Send(ctx context.Context, src Source) (*SendResult, error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.ctx, cancel)
+	defer stop()
+
+	srv := newServer(ctx, s.node, src, s.opts, ServeOptions{MaxReceivers: 1, MaxParallel: 1})
+	srv.adopt(s.pairing.peer, s.pairing.key)
+	srv.register()
+	defer srv.unregister()
+
+	knockCtx, cancelKnock := phase(network.WithAllowLimitedConn(ctx, "peerlink"), s.opts.Timeouts.Phase)
+	defer cancelKnock()
+	stream, err := s.node.Host.NewStream(knockCtx, s.pairing.peer, p2p.PushProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("Send: failed to create push stream: %w", err)
+	}
+	if err := protocol.Knock(knockCtx, stream); err != nil {
+		return nil, fmt.Errorf("Send: %w", err)
+	}
+
+	select {
+	case done := <-srv.finished:
+		if done.err != nil {
+			return nil, fmt.Errorf("Send: %w", done.err)
+		}
+		done.result.Code = s.code
+		return &done.result, nil
+	case <-ctx.Done():
+		if s.ctx.Err() != nil {
+			return nil, fmt.Errorf("Send: %w", p2p.ErrDisconnected)
+		}
+		return nil, fmt.Errorf("Send: %w", ctx.Err())
+	}
+}
+
+// handleKnock receives a file the peer offers.
+func (s *Session) handleKnock(stream network.Stream) {
+	key := s.pairing.keyFor(s.ctx, stream)
+	if key == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		stream.Reset()
+		return
+	}
+	s.receives.Add(1)
+	s.mu.Unlock()
+	defer s.receives.Done()
+	protocol.AnswerKnock(stream, true)
+
+	r := &receiver{node: s.node, peer: s.pairing.peer, opts: s.opts, key: key}
+	result, err := r.fetch(network.WithAllowLimitedConn(s.ctx, "peerlink"), s.sink)
+	if err == nil {
+		s.opts.emit(Event{Kind: EventComplete, Peer: r.peer})
+	}
+	if s.onReceive != nil {
+		s.onReceive(result, err)
+	}
+}
+
+// Close ends the session, interrupting any transfer in progress, and shuts
+// the node down.
+func (s *Session) Close() error {
+	s.cancel()
+	s.node.Host.RemoveStreamHandler(p2p.PushProtocol)
+	if s.notifee != nil {
+		s.node.Host.Network().StopNotify(s.notifee)
+	}
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.receives.Wait()
+	return s.node.Close()
+}
@@ -0,0 +1,203 @@
+package peerlink
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// pairSessions returns two sessions paired with each other between local
+// nodes, the first hosting and the second joining, and their nodes. Files
+// the second receives are saved in dir and their outcomes sent to got.
+func pairSessions(t *testing.T, ctx context.Context, resume time.Duration, dir string, got chan<- error) (*Session, *Session, *p2p.Node, *p2p.Node) {
+	t.Helper()
+	an, bn := localPair(t)
+	opts := Options{}
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	as := newSession(an, opts, SessionOptions{Sink: DirSink(t.TempDir()), Resume: resume})
+	key := pairLocal(t, ctx, an, bn, as.pairing)
+	<-as.pairing.done
+	as.watch()
+
+	bs := newSession(bn, opts, SessionOptions{Sink: DirSink(dir), Resume: resume, OnReceive: func(_ *ReceiveResult, err error) {
+		got <- err
+	}})
+	bs.pairing.pair(an.Host.ID(), key)
+	bs.watch()
+	t.Cleanup(func() {
+		as.cancel()
+		bs.cancel()
+		bs.mu.Lock()
+		bs.closed = true
+		bs.mu.Unlock()
+		bs.receives.Wait()
+	})
+	return as, bs, an, bn
+}
+
+func TestSessionEndsOnDrop(t *testing.T) {
+	ctx := testContext(t)
+	as, bs, an, bn := pairSessions(t, ctx, 0, t.TempDir(), make(chan error, 1))
+	an.Host.Network().ClosePeer(bn.Host.ID())
+	for _, s := range []*Session{as, bs} {
+		select {
+		case <-s.Done():
+		case <-ctx.Done():
+			t.Fatal("the session outlived the connection")
+		}
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	ctx := testContext(t)
+	dir := t.TempDir()
+	got := make(chan error, 1)
+	as, bs, an, bn := pairSessions(t, ctx, time.Minute, dir, got)
+
+	an.Host.Network().ClosePeer(bn.Host.ID())
+	for an.Host.Network().Connectedness(bn.Host.ID()) != network.Connected {
+		select {
+		case <-as.Done():
+			t.Fatal("the session ended instead of reconnecting")
+		case <-bs.Done():
+			t.Fatal("the session ended instead of reconnecting")
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("the peers did not reconnect")
+		}
+	}
+
+	data := randomData(t, 100<<10)
+	if _, err := as.Send(ctx, BytesSource("after.bin", data)); err != nil {
+		t.Fatalf("sending after reconnecting: %v", err)
+	}
+	if err := <-got; err != nil {
+		t.Fatalf("receiving after reconnecting: %v", err)
+	}
+	if received, _ := os.ReadFile(filepath.Join(dir, "after.bin")); !bytes.Equal(received, data) {
+		t.Fatal("the file sent after reconnecting differs")
+	}
+}
+
+// TestWatchSurvivesDrop checks that a watch carries on with the files
+// waiting to be sent after the connection to the peer drops.
+func TestWatchSurvivesDrop(t *testing.T) {
+	ctx := testContext(t)
+	dir := t.TempDir()
+	as, _, an, bn := pairSessions(t, ctx, time.Minute, dir, make(chan error, 4))
+
+	wdir := t.TempDir()
+	writeFile(t, filepath.Join(wdir, "first.txt"), []byte("first"))
+	record, err := openRecord(filepath.Join(wdir, recordName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer record.close()
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	changes, err := watchChanges(wctx, wdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan string, 4)
+	w := &watcher{
+		dir:  wdir,
+		sess: as,
+		opts: as.opts,
+		watchOpts: WatchOptions{Settle: 200 * time.Millisecond, OnSend: func(path string, _ *SendResult, err error) {
+			if err != nil {
+				t.Errorf("sending %s: %v", path, err)
+			}
+			sent <- filepath.Base(path)
+		}},
+		record:   record,
+		pending:  make(map[string]pendingFile),
+		declined: make(map[string]fileVersion),
+	}
+	done := make(chan error, 1)
+	go func() { done <- w.run(wctx, changes) }()
+
+	wait := func(name string) {
+		t.Helper()
+		select {
+		case got := <-sent:
+			if got != name {
+				t.Fatalf("sent %s, want %s", got, name)
+			}
+		case err := <-done:
+			t.Fatalf("the watch ended: %v", err)
+		case <-ctx.Done():
+			t.Fatalf("%s was not sent", name)
+		}
+	}
+	wait("first.txt")
+	an.Host.Network().ClosePeer(bn.Host.ID())
+	writeFile(t, filepath.Join(wdir, "second.txt"), []byte("second"))
+	wait("second.txt")
+
+	// The record is complete once the watch is over
+	cancel()
+	<-done
+	for _, name := range []string{"first.txt", "second.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+		version, _ := w.stat(name)
+		if !record.has(name, version) {
+			t.Fatalf("%s is missing from the record", name)
+		}
+	}
+}
+
+// TestWatchRetryWaitsItsTurn checks that a file waiting to be sent again
+// after a failure does not hold up the files behind it.
+func TestWatchRetryWaitsItsTurn(t *testing.T) {
+	ctx := testContext(t)
+	dir := t.TempDir()
+	as, _, _, _ := pairSessions(t, ctx, 0, dir, make(chan error, 2))
+
+	wdir := t.TempDir()
+	record, err := openRecord(filepath.Join(wdir, recordName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer record.close()
+	w := &watcher{
+		dir:       wdir,
+		sess:      as,
+		opts:      as.opts,
+		watchOpts: WatchOptions{Settle: time.Millisecond},
+		record:    record,
+		pending:   make(map[string]pendingFile),
+		declined:  make(map[string]fileVersion),
+	}
+	since := time.Now().Add(-time.Minute)
+	for _, name := range []string{"stuck.txt", "next.txt"} {
+		writeFile(t, filepath.Join(wdir, name), []byte(name))
+		version, _ := w.stat(name)
+		w.pending[name] = pendingFile{version: version, since: since}
+		since = since.Add(time.Second)
+	}
+	stuck := w.pending["stuck.txt"]
+	stuck.retry, stuck.delay = time.Now().Add(time.Hour), 2*minRetryDelay
+	w.pending["stuck.txt"] = stuck
+
+	if err := w.sendSettled(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "next.txt")); err != nil {
+		t.Fatalf("the file behind the one waiting to be retried was not sent: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stuck.txt")); err == nil {
+		t.Fatal("the file waiting to be retried was sent early")
+	}
+	if w.pending["stuck.txt"] != stuck {
+		t.Fatal("the file waiting to be retried lost its place")
+	}
+}
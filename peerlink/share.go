@@ -0,0 +1,435 @@
+package peerlink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// ShareEntry is a file or directory in a shared directory.
+type ShareEntry = protocol.ShareEntry
+
+// ShareResult describes a share once the peer browsing it left.
+type ShareResult struct {
+	Code string
+	Peer peer.ID
+	// Fetched lists the files the peer fetched, by their slash-separated
+	// path in the directory.
+	Fetched []string
+}
+
+// Share lets the peer that joins with a freshly generated code browse the
+// directory tree under dir and fetch the files it picks. Nothing outside of
+// dir is reachable, not even through symbolic links, and nothing can be
+// written to it. Share blocks until the peer leaves or ctx is done. The code
+// is reported through an EventCode event.
+func (c *Client) Share(ctx context.Context, dir string, opts Options) (*ShareResult, error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	root, err := filepath.Abs(dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Share: %w", err)
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("Share: not a directory: %s", dir)
+	}
+
+	node, err := c.newNode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Share: %w", err)
+	}
+	defer node.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := newShareServer(ctx, node, root, opts)
+	s.register()
+	defer s.unregister()
+
+	if err := s.pairing.host(ctx, node, opts); err != nil {
+		return nil, fmt.Errorf("Share: %w", err)
+	}
+
+	select {
+	case <-s.left:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Share: %w", ctx.Err())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.result.Code = node.Code()
+	s.result.Peer = s.pairing.peer
+	return &s.result, nil
+}
+
+// shareServer answers the listing and fetch requests of the peer browsing a
+// shared directory.
+type shareServer struct {
+	ctx     context.Context
+	node    *p2p.Node
+	root    string
+	opts    Options
+	pairing *pairing
+	notifee *network.NotifyBundle
+
+	once sync.Once
+	left chan struct{}
+	// uploadMu serves the files one at a time.
+	uploadMu sync.Mutex
+
+	mu     sync.Mutex
+	result ShareResult
+}
+
+func newShareServer(ctx context.Context, node *p2p.Node, root string, opts Options) *shareServer {
+	s := &shareServer{
+		ctx:     ctx,
+		node:    node,
+		root:    root,
+		opts:    opts,
+		pairing: newPairing(),
+		left:    make(chan struct{}),
+	}
+	s.notifee = &network.NotifyBundle{DisconnectedF: func(n network.Network, conn network.Conn) {
+		remote := conn.RemotePeer()
+		select {
+		case <-s.pairing.done:
+		default:
+			return
+		}
+		if remote == s.pairing.peer && n.Connectedness(remote) != network.Connected {
+			s.node.Logger.Info("peer stopped browsing", "peer", remote)
+			s.once.Do(func() { close(s.left) })
+		}
+	}}
+	return s
+}
+
+func (s *shareServer) register() {
+	s.node.Host.SetStreamHandler(p2p.ListProtocol, s.handleList)
+	s.node.Host.SetStreamHandler(p2p.ShareFetchProtocol, s.handleFetch)
+	s.node.Host.Network().Notify(s.notifee)
+}
+
+func (s *shareServer) unregister() {
+	s.node.Host.Network().StopNotify(s.notifee)
+	s.node.Host.RemoveStreamHandler(p2p.ListProtocol)
+	s.node.Host.RemoveStreamHandler(p2p.ShareFetchProtocol)
+}
+
+// resolve returns where the slash-separated path rel of the share is on
+// disk, with its symbolic links followed. Paths that lead out of the shared
+// directory are refused.
+func (s *shareServer) resolve(rel string) (string, error) {
+	if rel != "." && !protocol.ValidPath(rel) {
+		return "", fmt.Errorf("invalid path %q", rel)
+	}
+	target, err := filepath.EvalSymlinks(filepath.Join(s.root, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", fmt.Errorf("%s: no such file or directory", rel)
+	}
+	inside, err := filepath.Rel(s.root, target)
+	if err != nil || inside != "." && !filepath.IsLocal(inside) {
+		return "", fmt.Errorf("%s: not in the shared directory", rel)
+	}
+	return target, nil
+}
+
+// openInside opens the file or directory rel of the share. A symbolic link
+// swapped in between resolving the path and opening it could lead the open
+// out of the share, so the path is resolved again afterwards and the file
+// opened must be the one it leads to.
+func (s *shareServer) openInside(rel string) (*os.File, error) {
+	target, err := s.resolve(rel)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(target)
+	if err != nil {
+		return nil, fmt.Errorf("%s: no such file or directory", rel)
+	}
+	opened, err := file.Stat()
+	if err == nil {
+		target, err = s.resolve(rel)
+	}
+	var current os.FileInfo
+	if err == nil {
+		current, err = os.Stat(target)
+	}
+	if err != nil || !os.SameFile(opened, current) {
+		file.Close()
+		return nil, fmt.Errorf("%s: changed while being opened", rel)
+	}
+	return file, nil
+}
+
+// list returns the files and directories in the directory rel. Entries
+// that are neither, or that lead out of the share, are left out.
+func (s *shareServer) list(rel string) ([]ShareEntry, error) {
+	dir, err := s.openInside(rel)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	if info, err := dir.Stat(); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", rel)
+	}
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot be listed", rel)
+	}
+	listing := make([]ShareEntry, 0, len(entries))
+	for _, entry := range entries {
+		target, err := s.resolve(path.Join(rel, entry.Name()))
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(target)
+		if err != nil || !info.IsDir() && !info.Mode().IsRegular() {
+			continue
+		}
+		e := ShareEntry{Name: entry.Name(), Dir: info.IsDir(), ModTime: info.ModTime()}
+		if !e.Dir {
+			e.Size = info.Size()
+		}
+		listing = append(listing, e)
+	}
+	return listing, nil
+}
+
+// open opens the regular file rel, which is then served from the file
+// opened rather than by name, under its name in the share. The caller
+// closes it.
+func (s *shareServer) open(rel string) (*shareSource, error) {
+	file, err := s.openInside(rel)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("%s: not a regular file", rel)
+	}
+	return &shareSource{file: file, name: path.Base(rel), size: info.Size()}, nil
+}
+
+func (s *shareServer) handleList(stream network.Stream) {
+	key := s.pairing.keyFor(s.ctx, stream)
+	if key == nil {
+		return
+	}
+	ctx, cancel := phase(s.ctx, s.opts.Timeouts.Phase)
+	defer cancel()
+	if _, err := protocol.ServeListing(ctx, stream, key, s.list, s.node.Logger); err != nil {
+		s.node.Logger.Warn("failed to serve listing", "peer", s.pairing.peer, "err", err)
+	}
+}
+
+// handleFetch serves a file of the share to the peer asking for it.
+func (s *shareServer) handleFetch(stream network.Stream) {
+	key := s.pairing.keyFor(s.ctx, stream)
+	if key == nil {
+		return
+	}
+	ctx, cancel := phase(s.ctx, s.opts.Timeouts.Phase)
+	rel, err := protocol.ReadFileRequest(ctx, stream, key)
+	cancel()
+	if err != nil {
+		s.node.Logger.Warn("failed to read share file request", "peer", s.pairing.peer, "err", err)
+		stream.Reset()
+		return
+	}
+	src, err := s.open(rel)
+	if err != nil {
+		s.node.Logger.Info("refused share file request", "peer", s.pairing.peer, "path", rel, "err", err)
+		protocol.AnswerFileRequest(stream, key, false)
+		return
+	}
+	defer src.Close()
+
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+	srv := newServer(s.ctx, s.node, src, s.opts, ServeOptions{MaxReceivers: 1, MaxParallel: 1})
+	srv.adopt(s.pairing.peer, key)
+	srv.register()
+	defer srv.unregister()
+	if err := protocol.AnswerFileRequest(stream, key, true); err != nil {
+		s.node.Logger.Warn("failed to answer share file request", "peer", s.pairing.peer, "err", err)
+		return
+	}
+
+	metadata := protocol.Metadata{Filename: src.Name(), Size: src.Size()}
+	select {
+	case done := <-srv.finished:
+		if done.err != nil {
+			s.node.Logger.Warn("peer failed to fetch file", "peer", s.pairing.peer, "path", rel, "err", done.err)
+			s.opts.emit(Event{Kind: EventFailed, Peer: s.pairing.peer, Metadata: &metadata, Error: done.err.Error()})
+			return
+		}
+		s.mu.Lock()
+		s.result.Fetched = append(s.result.Fetched, rel)
+		s.mu.Unlock()
+		s.node.Logger.Info("peer fetched file", "peer", s.pairing.peer, "path", rel)
+		s.opts.emit(Event{Kind: EventComplete, Peer: s.pairing.peer, Metadata: &metadata})
+	case <-s.ctx.Done():
+	}
+}
+
+// shareSource offers a file of a share from the file opened when it was
+// asked for, under the name it has in the share, which may be that of the
+// symbolic link it was reached through. Replacing the file on disk
+// afterwards does not change what is sent.
+type shareSource struct {
+	file *os.File
+	name string
+	size int64
+}
+
+func (s *shareSource) Name() string { return s.name }
+func (s *shareSource) Size() int64  { return s.size }
+
+func (s *shareSource) Open() (io.ReadSeekCloser, error) {
+	return nopCloser{io.NewSectionReader(s.file, 0, s.size)}, nil
+}
+
+func (s *shareSource) Close() error {
+	return s.file.Close()
+}
+
+// Browser is a connection to a peer sharing a directory with Share.
+type Browser struct {
+	node    *p2p.Node
+	pairing *pairing
+	code    string
+	opts    Options
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	notifee *network.NotifyBundle
+}
+
+// Browse joins the directory the peer shares with code. ctx bounds getting
+// connected; the connection lasts until Close or until the peer leaves.
+func (c *Client) Browse(ctx context.Context, code string, opts Options) (_ *Browser, err error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	node, err := c.newNode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Browse: %w", err)
+	}
+	b := &Browser{node: node, pairing: newPairing(), opts: opts}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	defer func() {
+		if err != nil {
+			b.Close()
+		}
+	}()
+
+	if err := b.pairing.join(ctx, node, code, opts); err != nil {
+		return nil, fmt.Errorf("Browse: %w", err)
+	}
+	b.code = node.Code()
+	remote := b.pairing.peer
+	b.notifee = &network.NotifyBundle{DisconnectedF: func(n network.Network, conn network.Conn) {
+		if conn.RemotePeer() == remote && n.Connectedness(remote) != network.Connected {
+			b.node.Logger.Info("peer stopped sharing", "peer", remote)
+			b.cancel()
+		}
+	}}
+	node.Host.Network().Notify(b.notifee)
+	return b, nil
+}
+
+// Peer returns the peer sharing the directory.
+func (b *Browser) Peer() peer.ID {
+	return b.pairing.peer
+}
+
+// Code returns the code the share was joined with.
+func (b *Browser) Code() string {
+	return b.code
+}
+
+// Done is closed when the connection ends, because Close was called or the
+// peer stopped sharing.
+func (b *Browser) Done() <-chan struct{} {
+	return b.ctx.Done()
+}
+
+// List returns the entries of the directory at the slash-separated path p
+// of the share, "." being the shared directory itself.
+func (b *Browser) List(ctx context.Context, p string) ([]ShareEntry, error) {
+	ctx, cancel := context.WithCancel(network.WithAllowLimitedConn(ctx, "peerlink"))
+	defer cancel()
+	stop := context.AfterFunc(b.ctx, cancel)
+	defer stop()
+
+	ctx, cancelPhase := phase(ctx, b.opts.Timeouts.Phase)
+	defer cancelPhase()
+	stream, err := b.node.Host.NewStream(ctx, b.pairing.peer, p2p.ListProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("List: failed to reach %s: %w", b.pairing.peer, err)
+	}
+	entries, err := protocol.RequestListing(ctx, stream, p, b.pairing.key, b.node.Logger)
+	if err != nil {
+		if b.ctx.Err() != nil {
+			return nil, fmt.Errorf("List: %w", p2p.ErrDisconnected)
+		}
+		return nil, fmt.Errorf("List: %w", err)
+	}
+	return entries, nil
+}
+
+// Get fetches the file at the slash-separated path p of the share into sink.
+// opts.Accept is not asked, since the file was picked.
+func (b *Browser) Get(ctx context.Context, p string, sink Sink) (*ReceiveResult, error) {
+	ctx, cancel := context.WithCancel(network.WithAllowLimitedConn(ctx, "peerlink"))
+	defer cancel()
+	stop := context.AfterFunc(b.ctx, cancel)
+	defer stop()
+
+	openCtx, cancelOpen := phase(ctx, b.opts.Timeouts.Phase)
+	stream, err := b.node.Host.NewStream(openCtx, b.pairing.peer, p2p.ShareFetchProtocol)
+	cancelOpen()
+	if err != nil {
+		return nil, fmt.Errorf("Get: failed to reach %s: %w", b.pairing.peer, err)
+	}
+	if err := protocol.RequestFile(ctx, stream, p, b.pairing.key, b.node.Logger); err != nil {
+		if errors.Is(err, protocol.ErrDeclined) {
+			return nil, fmt.Errorf("Get: %s is not a file in the share: %w", p, protocol.ErrDeclined)
+		}
+		return nil, fmt.Errorf("Get: %w", err)
+	}
+
+	opts := b.opts
+	opts.Accept = nil
+	r := &receiver{node: b.node, peer: b.pairing.peer, opts: opts, key: b.pairing.key}
+	result, err := r.fetch(ctx, sink)
+	if err != nil {
+		if b.ctx.Err() != nil {
+			return nil, fmt.Errorf("Get: %w", p2p.ErrDisconnected)
+		}
+		return nil, fmt.Errorf("Get: %w", err)
+	}
+	return result, nil
+}
+
+// Close disconnects from the sharing peer and shuts the node down.
+func (b *Browser) Close() error {
+	b.cancel()
+	if b.notifee != nil {
+		b.node.Host.Network().StopNotify(b.notifee)
+	}
+	return b.node.Close()
+}
@@ -0,0 +1,132 @@
+package peerlink
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// shareLocal shares dir between two local nodes and returns the server and
+// a browser paired with it.
+func shareLocal(t *testing.T, ctx context.Context, dir string) (*shareServer, *Browser) {
+	t.Helper()
+	an, bn := localPair(t)
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{}
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	s := newShareServer(ctx, an, root, opts)
+	s.register()
+	t.Cleanup(s.unregister)
+	key := pairLocal(t, ctx, an, bn, s.pairing)
+	<-s.pairing.done
+
+	b := &Browser{node: bn, pairing: newPairing(), opts: opts}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	t.Cleanup(b.cancel)
+	b.pairing.pair(an.Host.ID(), key)
+	return s, b
+}
+
+func TestShare(t *testing.T) {
+	ctx := testContext(t)
+	dir, outside := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), []byte("hello"))
+	writeFile(t, filepath.Join(dir, "sub/deep/b.txt"), []byte("world"))
+	writeFile(t, filepath.Join(outside, "secret"), []byte("secret"))
+	for link, target := range map[string]string{
+		"escape":    filepath.Join(outside, "secret"),
+		"escapedir": outside,
+		"inlink":    "sub/deep/b.txt",
+	} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, b := shareLocal(t, ctx, dir)
+
+	entries, err := b.List(ctx, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if slices.Sort(names); !slices.Equal(names, []string{"a.txt", "inlink", "sub"}) {
+		t.Fatalf("listed %v, want a.txt, inlink and sub", names)
+	}
+	for _, p := range []string{"..", "/etc", "escapedir", "sub/../..", "a.txt", "nope"} {
+		if _, err := b.List(ctx, p); err == nil {
+			t.Errorf("listed %s", p)
+		}
+	}
+
+	dst := t.TempDir()
+	for p, want := range map[string]string{"a.txt": "hello", "sub/deep/b.txt": "world", "inlink": "world"} {
+		result, err := b.Get(ctx, p, DirSink(dst))
+		if err != nil {
+			t.Fatalf("fetching %s: %v", p, err)
+		}
+		if result.Metadata.Filename != filepath.Base(p) {
+			t.Errorf("%s was offered as %s", p, result.Metadata.Filename)
+		}
+		if got, _ := os.ReadFile(result.Path); string(got) != want {
+			t.Errorf("%s holds %q, want %q", p, got, want)
+		}
+	}
+	for _, p := range []string{"escape", "escapedir/secret", "sub", "nope"} {
+		if _, err := b.Get(ctx, p, DirSink(dst)); err == nil {
+			t.Errorf("fetched %s", p)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.result.Fetched) != 3 {
+		t.Errorf("recorded %v as fetched, want 3 files", s.result.Fetched)
+	}
+}
+
+// TestShareOpenedFile checks that a file is sent from the file opened when
+// it was asked for, even if a symbolic link leading out of the share takes
+// its place meanwhile.
+func TestShareOpenedFile(t *testing.T) {
+	dir, outside := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), []byte("hello"))
+	writeFile(t, filepath.Join(outside, "secret"), []byte("secret"))
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &shareServer{root: root}
+
+	src, err := s.open("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(outside, "secret"), link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(link, filepath.Join(dir, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := src.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got, _ := io.ReadAll(r); string(got) != "hello" {
+		t.Fatalf("sent %q, want the file as it was opened", got)
+	}
+	if _, err := s.open("a.txt"); err == nil {
+		t.Fatal("opened a file outside of the share")
+	}
+}
@@ -0,0 +1,272 @@
+package peerlink
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/utils"
+)
+
+// Source supplies the file offered by Send.
+type Source interface {
+	Name() string
+	Size() int64
+	// Open returns a fresh reader over the whole content. It may be called
+	// more than once.
+	Open() (io.ReadSeekCloser, error)
+}
+
+// Sink stores the file accepted by Receive.
+type Sink interface {
+	// Create returns the writer the content described by metadata is
+	// written to. If the writer has a Name method, its result is reported
+	// as ReceiveResult.Path.
+	Create(metadata protocol.Metadata) (io.WriteCloser, error)
+}
+
+// SpaceChecker is implemented by sinks that can tell whether a file of the
+// given size fits, which Receive checks before accepting it.
+type SpaceChecker interface {
+	CheckSpace(size int64) error
+}
+
+// Finder is implemented by sinks that can tell whether they already hold the
+// content described by metadata, such as a file with the same checksum at
+// the path it would be saved to. Receive then skips the transfer and
+// reports the path Find returns.
+type Finder interface {
+	Find(metadata protocol.Metadata) (path string, ok bool)
+}
+
+type fileSource struct {
+	path string
+	size int64
+}
+
+// FileSource offers the regular file at path.
+func FileSource(path string) (Source, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("FileSource: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("FileSource: not a regular file: %s", path)
+	}
+	return &fileSource{path: path, size: info.Size()}, nil
+}
+
+func (s *fileSource) Name() string { return filepath.Base(s.path) }
+func (s *fileSource) Size() int64  { return s.size }
+
+func (s *fileSource) Open() (io.ReadSeekCloser, error) {
+	return os.Open(s.path)
+}
+
+type bytesSource struct {
+	name string
+	data []byte
+}
+
+// BytesSource offers data under the given name.
+func BytesSource(name string, data []byte) Source {
+	return &bytesSource{name: name, data: data}
+}
+
+func (s *bytesSource) Name() string { return s.name }
+func (s *bytesSource) Size() int64  { return int64(len(s.data)) }
+
+func (s *bytesSource) Open() (io.ReadSeekCloser, error) {
+	return nopCloser{bytes.NewReader(s.data)}, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Aborter is implemented by sink writers that can discard what they have
+// written so far. Receive calls Abort instead of Close when the transfer
+// fails or is cancelled.
+type Aborter interface {
+	Abort() error
+}
+
+// sinkFile is a temporary file created by DirSink next to the file it is
+// saved as. Close syncs it to disk and moves it into place, while Abort
+// removes it.
+type sinkFile struct {
+	*os.File
+	// path is where the file is saved, which Close may number to avoid
+	// an existing file.
+	path string
+	// sparse is set when the file was extended to its final size up
+	// front, after which blocks of zeros are skipped to leave holes.
+	sparse bool
+	off    int64
+}
+
+func (f *sinkFile) Write(p []byte) (int, error) {
+	if !f.sparse {
+		return f.File.Write(p)
+	}
+	n, err := f.WriteAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+func (f *sinkFile) WriteAt(p []byte, off int64) (int, error) {
+	if !f.sparse {
+		return f.File.WriteAt(p, off)
+	}
+	return writeSparse(f.File, p, off)
+}
+
+// Name returns the path the file is saved as, which is final once it was
+// closed.
+func (f *sinkFile) Name() string { return f.path }
+
+func (f *sinkFile) Close() error {
+	tmp := f.File.Name()
+	err := errors.Join(f.File.Sync(), f.File.Close())
+	if err == nil {
+		f.path, err = claimName(f.path, func(path string) error {
+			return moveNew(tmp, path)
+		})
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("DirSink: failed to save %s: %w", f.path, err)
+	}
+	return nil
+}
+
+func (f *sinkFile) Abort() error {
+	return errors.Join(f.File.Close(), os.Remove(f.File.Name()))
+}
+
+// moveNew renames the file at src to dst unless dst exists.
+func moveNew(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return os.Remove(src)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	// The file system cannot link, so check and rename instead
+	if _, err := os.Lstat(dst); err == nil {
+		return fs.ErrExist
+	}
+	return os.Rename(src, dst)
+}
+
+// claimName calls create with path and then with numbered variants of it,
+// such as "name(1).ext", for as long as it reports that the path exists.
+// It returns the last path tried.
+func claimName(path string, create func(string) error) (string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for counter := 1; ; counter++ {
+		err := create(path)
+		if !errors.Is(err, fs.ErrExist) {
+			return path, err
+		}
+		path = fmt.Sprintf("%s(%d)%s", base, counter, ext)
+	}
+}
+
+type dirSink struct {
+	dir string
+}
+
+// DirSink saves received files into dir, picking a new name instead of
+// overwriting an existing file. Each file is written to a temporary file
+// in dir first and only takes its name once it was received completely.
+func DirSink(dir string) Sink {
+	return &dirSink{dir: dir}
+}
+
+// path returns where the file described by metadata is saved.
+func (s *dirSink) path(metadata protocol.Metadata) (string, error) {
+	name := filepath.Base(filepath.Clean("/" + metadata.Filename))
+	if name == "/" || name == "." {
+		return "", fmt.Errorf("DirSink: invalid filename %q", metadata.Filename)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+func (s *dirSink) Create(metadata protocol.Metadata) (io.WriteCloser, error) {
+	path, err := s.path(metadata)
+	if err != nil {
+		return nil, err
+	}
+	var file *os.File
+	_, err = claimName(filepath.Join(s.dir, "."+filepath.Base(path)+".peerlink"), func(tmp string) error {
+		file, err = os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("DirSink: failed to create file: %w", err)
+	}
+
+	f := &sinkFile{File: file, path: path}
+	// Preserved files keep their holes, while the others have their space
+	// reserved up front.
+	if metadata.Attrs != nil {
+		f.sparse = true
+		err = file.Truncate(metadata.Size)
+	} else {
+		err = preallocate(file, metadata.Size)
+	}
+	if err != nil {
+		f.Abort()
+		return nil, fmt.Errorf("DirSink: failed to allocate %d bytes: %w", metadata.Size, err)
+	}
+	return f, nil
+}
+
+// CheckSpace reports an error if dir lacks the room for size more bytes.
+func (s *dirSink) CheckSpace(size int64) error {
+	free, err := freeSpace(s.dir)
+	if err != nil || free >= size {
+		return nil
+	}
+	return fmt.Errorf("DirSink: %d bytes needed but only %d free in %s", size, free, s.dir)
+}
+
+// Find reports whether the file saved under the offered name already has
+// the offered content.
+func (s *dirSink) Find(metadata protocol.Metadata) (string, bool) {
+	path, err := s.path(metadata)
+	if err != nil || len(metadata.Hash) == 0 {
+		return "", false
+	}
+	if !sameContent(path, metadata.Size, metadata.Hash) {
+		return "", false
+	}
+	return path, true
+}
+
+// sameContent reports whether the regular file at path has the given size
+// and checksum.
+func sameContent(path string, size int64, hash []byte) bool {
+	info, err := os.Lstat(path)
+	if err != nil || !info.Mode().IsRegular() || info.Size() != size {
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	sum, err := utils.CalculateHash(file)
+	return err == nil && bytes.Equal(sum, hash)
+}
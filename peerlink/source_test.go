@@ -0,0 +1,100 @@
+package peerlink
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SyedMa3/peerlink/protocol"
+)
+
+func readDirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// TestDirSinkAtomic checks that a file only takes its name once it is
+// closed, next to an existing file rather than over it, and that an aborted
+// one leaves nothing behind.
+func TestDirSinkAtomic(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.bin"), []byte("old"))
+	data := []byte("new content")
+	sink := DirSink(dir)
+
+	w, err := sink.Create(protocol.Metadata{Filename: "a.bin", Size: int64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a(1).bin")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the file took its name before it was closed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if path := w.(interface{ Name() string }).Name(); path != filepath.Join(dir, "a(1).bin") {
+		t.Fatalf("saved as %s, want a(1).bin", path)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "a(1).bin")); !bytes.Equal(got, data) {
+		t.Fatalf("saved %q, want %q", got, data)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "a.bin")); string(got) != "old" {
+		t.Fatalf("the existing file was overwritten with %q", got)
+	}
+
+	w, err = sink.Create(protocol.Metadata{Filename: "b.bin", Size: int64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(Aborter).Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if names := readDirNames(t, dir); len(names) != 2 {
+		t.Fatalf("directory holds %v, want a.bin and a(1).bin", names)
+	}
+}
+
+// TestReceiveAtomic checks that a file received over parallel streams is
+// saved next to an existing file of the same name and that no temporary
+// file is left behind.
+func TestReceiveAtomic(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.bin"), []byte("old"))
+	data := randomData(t, 2<<20)
+
+	sn, rn := localPair(t)
+	ctx := testContext(t)
+	s := startServer(ctx, sn, BytesSource("a.bin", data), Options{}, ServeOptions{})
+	result, err := recv(ctx, rn, sn, DirSink(dir), Options{Streams: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done := <-s.finished; done.err != nil {
+		t.Fatalf("sender: %v", done.err)
+	}
+	if result.Path != filepath.Join(dir, "a(1).bin") {
+		t.Fatalf("saved as %s, want a(1).bin", result.Path)
+	}
+	if got, _ := os.ReadFile(result.Path); !bytes.Equal(got, data) {
+		t.Fatal("the saved file differs from the one sent")
+	}
+	if names := readDirNames(t, dir); len(names) != 2 {
+		t.Fatalf("directory holds %v, want a.bin and a(1).bin", names)
+	}
+}
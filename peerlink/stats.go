@@ -0,0 +1,82 @@
+package peerlink
+
+import (
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Phases of a transfer reported in Stats.
+const (
+	PhaseBootstrap = "bootstrap"
+	PhasePublish   = "publish"
+	PhaseQuery     = "query"
+	// PhaseConnect is the receiver dialing the sender, including waiting
+	// for hole punching to replace a relayed connection.
+	PhaseConnect = "connect"
+	// PhaseWait is the side that published the code waiting for the
+	// other one to show up.
+	PhaseWait      = "wait"
+	PhaseHandshake = "handshake"
+	PhaseTransfer  = "transfer"
+)
+
+// ConnHolePunched is a direct connection that replaced a relayed one.
+const ConnHolePunched = p2p.ConnHolePunched
+
+// Phase is the time one phase of a transfer took.
+type Phase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Stats summarizes how a completed transfer went.
+type Stats struct {
+	// Phases lists the phases of the transfer in the order they ran.
+	Phases []Phase `json:"phases"`
+	// Payload is the size of the file data transferred and Wire what was
+	// exchanged with the peer for it, encryption and protocol overhead
+	// included.
+	Payload int64 `json:"payload"`
+	Wire    int64 `json:"wire"`
+	// Average and Peak are the throughput of the file data in bytes per
+	// second.
+	Average float64 `json:"average"`
+	Peak    float64 `json:"peak"`
+	// RTT is the round-trip time to the peer, or zero if it is unknown.
+	RTT time.Duration `json:"rtt,omitempty"`
+	// Path tells how the peers were connected at the end of the transfer:
+	// ConnDirect, ConnHolePunched, ConnRelayed or ConnLimited. It is empty
+	// for swarm downloads, which use several peers.
+	Path ConnKind `json:"path,omitempty"`
+}
+
+// phase records that the named phase ran from start until end.
+func (s *Stats) phase(name string, start, end time.Time) {
+	s.Phases = append(s.Phases, Phase{Name: name, Duration: end.Sub(start)})
+}
+
+// Phase returns how long the named phase took, or zero if it did not run.
+func (s *Stats) Phase(name string) time.Duration {
+	for _, p := range s.Phases {
+		if p.Name == name {
+			return p.Duration
+		}
+	}
+	return 0
+}
+
+// measure fills in what the node and the meter know about the transfer of
+// payload bytes with peer p.
+func (s *Stats) measure(node *p2p.Node, p peer.ID, payload int64, meter *rw.Meter) {
+	s.Payload = payload
+	s.Wire = node.WireBytes(p)
+	s.Peak = meter.Peak()
+	s.RTT = node.Host.Peerstore().LatencyEWMA(p)
+	s.Path = node.Path(p)
+	if d := s.Phase(PhaseTransfer); d > 0 {
+		s.Average = float64(payload) / d.Seconds()
+	}
+}
@@ -0,0 +1,695 @@
+package peerlink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SwarmOptions tunes ReceiveSwarm.
+type SwarmOptions struct {
+	// MaxProviders caps the providers downloaded from at once. Zero means
+	// no limit.
+	MaxProviders int
+}
+
+const (
+	// slowProviderFactor retires a provider from the download once its
+	// rate falls below the rate of the fastest one divided by this factor.
+	slowProviderFactor = 4
+	// minRatedChunks is how many chunks a provider must deliver before its
+	// rate is compared with the others.
+	minRatedChunks = 2
+	// stragglerGrace is how long ReceiveSwarm waits, once every chunk has
+	// arrived, for providers still fetching a duplicate chunk to finish.
+	stragglerGrace = 5 * time.Second
+	// manifestWindow is how long ReceiveSwarm waits, after the first
+	// provider offered its manifest, for the others to offer theirs before
+	// choosing the manifest to follow.
+	manifestWindow = 3 * time.Second
+)
+
+// ReceiveSwarm looks up every provider serving code and downloads different
+// chunks of the file from several of them at once. The providers must serve
+// identical content: each of them sends a manifest of chunk checksums, the
+// manifest offered by most of them is followed and providers offering
+// another one are dropped. Every chunk is verified on arrival, and
+// providers that are much slower than the others stop getting new chunks.
+// opts.Accept is asked once, for the first provider; the others are only
+// used if they offer the same file. The writer created by sink must
+// implement io.WriterAt, as chunks arrive out of order, and io.ReaderAt, so
+// that the whole file is verified before it is saved.
+func (c *Client) ReceiveSwarm(ctx context.Context, code string, sink Sink, opts Options, swarmOpts SwarmOptions) (*ReceiveResult, error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+
+	words, err := protocol.ParseCode(code)
+	if err != nil {
+		return nil, fmt.Errorf("ReceiveSwarm: %w", err)
+	}
+
+	var stats Stats
+	start := time.Now()
+	node, err := c.newNode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("ReceiveSwarm: %w", err)
+	}
+	defer node.Close()
+	stats.phase(PhaseBootstrap, start, time.Now())
+
+	if err := node.SetWordsAndCid(words); err != nil {
+		return nil, fmt.Errorf("ReceiveSwarm: failed to set words and CID: %w", err)
+	}
+
+	opts.emit(Event{Kind: EventQuerying})
+	queryCtx, cancel := phase(ctx, opts.Timeouts.Query)
+	start = time.Now()
+	providers, err := node.QueryAndConnectAll(queryCtx, swarmOpts.MaxProviders)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("ReceiveSwarm: failed to query and connect to providers: %w", err)
+	}
+	stats.phase(PhaseQuery, start, time.Now())
+
+	result, err := newSwarm(node, sink, opts, stats).run(ctx, providers)
+	if err != nil {
+		return nil, fmt.Errorf("ReceiveSwarm: %w", err)
+	}
+	opts.emit(Event{Kind: EventComplete, Peer: result.Peer})
+	return result, nil
+}
+
+// writerReaderAt is a sink writer the chunks can be written to in any order
+// and read back from once they are all in.
+type writerReaderAt interface {
+	io.WriterAt
+	io.ReaderAt
+}
+
+// swarm schedules the chunks of one file across several providers.
+type swarm struct {
+	stats Stats
+	node  *p2p.Node
+	sink  Sink
+	opts  Options
+
+	// decideMu makes sure the user is asked about the file only once.
+	decideMu sync.Mutex
+	decided  bool
+	offered  protocol.Metadata
+	accepted bool
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	manifest *protocol.Manifest
+	w        io.WriteCloser
+	wa       writerReaderAt
+	meter    *rw.Meter
+	// pending lists the chunks nobody is fetching yet, fetching counts the
+	// providers fetching each chunk and done marks the stored ones.
+	pending   []int
+	fetching  map[int]int
+	done      []bool
+	remaining int
+	// candidates counts the providers that may still offer a manifest and
+	// ballots holds the manifests offered so far, in order of arrival.
+	candidates int
+	ballots    []ballot
+	chosen     bool
+	startErr   error
+	rates      map[peer.ID]*providerRate
+	started    time.Time
+	result     ReceiveResult
+	complete   chan struct{}
+	// verdict is closed once the assembled file has been checked, with
+	// verdictErr holding the outcome.
+	verdict    chan struct{}
+	verdictErr error
+	settled    bool
+}
+
+func newSwarm(node *p2p.Node, sink Sink, opts Options, stats Stats) *swarm {
+	s := &swarm{
+		stats:    stats,
+		node:     node,
+		sink:     sink,
+		opts:     opts,
+		rates:    make(map[peer.ID]*providerRate),
+		complete: make(chan struct{}),
+		verdict:  make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ballot is the manifest offered by one provider.
+type ballot struct {
+	peer     peer.ID
+	manifest *protocol.Manifest
+	root     string
+}
+
+// providerRate tracks how fast a provider delivers chunks. A retired
+// provider stands by in case the others fail, a gone one has failed.
+type providerRate struct {
+	chunks  int
+	rate    float64 // bytes per second
+	retired bool
+	gone    bool
+}
+
+func (s *swarm) run(ctx context.Context, providers []peer.AddrInfo) (_ *ReceiveResult, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(providers))
+	s.candidates = len(providers)
+	for _, p := range providers {
+		s.opts.emit(Event{Kind: EventConnected, Peer: p.ID})
+		go func() {
+			err := s.work(ctx, p.ID)
+			if err != nil {
+				s.leave(p.ID)
+				// Hanging up ends the provider's session instead of
+				// leaving it waiting for a verdict.
+				s.node.Host.Network().ClosePeer(p.ID)
+				err = fmt.Errorf("provider %s: %w", p.ID, err)
+			}
+			errs <- err
+		}()
+	}
+
+	var (
+		failures  []error
+		running   = len(providers)
+		straggler <-chan time.Time
+		complete  = s.complete
+	)
+	for running > 0 {
+		select {
+		case err := <-errs:
+			running--
+			if err != nil && !s.finished() {
+				s.node.Logger.Warn("provider failed", "err", err)
+				s.opts.emit(Event{Kind: EventFailed, Error: err.Error()})
+				failures = append(failures, err)
+			}
+		case <-complete:
+			complete = nil
+			s.mu.Lock()
+			s.settleLocked()
+			s.mu.Unlock()
+			straggler = time.After(stragglerGrace)
+		case <-straggler:
+			// The chunks those providers are fetching already arrived
+			// from faster ones.
+			cancel()
+			straggler = nil
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.remaining > 0 || s.manifest == nil {
+		err := ctx.Err()
+		if err == nil {
+			err = errors.Join(failures...)
+		}
+		if err == nil {
+			err = errors.New("the providers left before the file was complete")
+		}
+		if s.w != nil {
+			finishSink(s.w, err, s.node.Logger)
+		}
+		return nil, err
+	}
+	if err := s.settleLocked(); err != nil {
+		finishSink(s.w, err, s.node.Logger)
+		return nil, err
+	}
+	// Only a complete file is saved under its name
+	if err := s.w.Close(); err != nil {
+		return nil, fmt.Errorf("failed to save file: %w", err)
+	}
+	if named, ok := s.w.(interface{ Name() string }); ok {
+		s.result.Path = named.Name()
+	}
+	s.meter.Finish()
+	s.result.Metadata = s.offered
+	s.result.Metadata.Hash = s.manifest.Hash
+	s.result.Size = s.manifest.Size
+	s.result.Hash = s.manifest.Hash
+	s.result.Stats = s.summarize()
+	s.node.Logger.Info("file received from swarm", "providers", len(s.result.Providers), "bytes", s.result.Size, "path", s.result.Path)
+	s.opts.emit(Event{Kind: EventTransferred, Metadata: &s.result.Metadata})
+	return &s.result, nil
+}
+
+// settleLocked checks the assembled file, once, and passes the verdict on
+// to the providers waiting for it. Every chunk matches the manifest, but the
+// manifest itself is only trusted once the file matches its checksum.
+// s.mu must be held.
+func (s *swarm) settleLocked() error {
+	if !s.settled {
+		s.settled = true
+		s.verdictErr = s.verify()
+		close(s.verdict)
+	}
+	return s.verdictErr
+}
+
+// verify checks the assembled file against the checksum of the manifest
+// and the policy. s.mu must be held.
+func (s *swarm) verify() error {
+	hash, err := utils.CalculateHash(io.NewSectionReader(s.wa, 0, s.manifest.Size))
+	if err != nil {
+		return fmt.Errorf("failed to read back the file: %w", err)
+	}
+	if !bytes.Equal(hash, s.manifest.Hash) {
+		s.node.Logger.Warn("file checksum mismatch", "expected", utils.BytesToHex(s.manifest.Hash), "actual", utils.BytesToHex(hash))
+		return fmt.Errorf("the file does not match the checksum of the manifest: %w", protocol.ErrIntegrity)
+	}
+	if err := s.opts.Policy.verify(hash); err != nil {
+		return fmt.Errorf("%w: %w", err, protocol.ErrIntegrity)
+	}
+	return nil
+}
+
+// work downloads chunks from provider p until no chunk is left for it.
+func (s *swarm) work(ctx context.Context, p peer.ID) error {
+	opts := s.opts
+	// Every offer goes through decide, which applies the trust instead
+	opts.Accept = func(ctx context.Context, metadata protocol.Metadata) (bool, error) {
+		return s.decide(ctx, p, metadata)
+	}
+	opts.Policy = opts.Policy.untrusting()
+	r := &receiver{node: s.node, peer: p, opts: opts}
+	voted := false
+	defer func() {
+		if !voted {
+			s.abstain()
+		}
+	}()
+	if err := r.handshakeWhenReady(ctx); err != nil {
+		return err
+	}
+	s.opts.emit(Event{Kind: EventHandshake, Peer: p})
+
+	metadata, _, err := r.exchangeMetadata(ctx, nil)
+	if err != nil {
+		return err
+	}
+	manifest, err := r.fetchManifest(ctx)
+	if err != nil {
+		return err
+	}
+	if len(metadata.Hash) > 0 && !bytes.Equal(manifest.Hash, metadata.Hash) {
+		return fmt.Errorf("manifest checksum does not match the offered checksum: %w", protocol.ErrIntegrity)
+	}
+	voted = true
+	if err := s.adopt(p, manifest); err != nil {
+		return err
+	}
+
+	for {
+		if err := s.fetchChunks(ctx, r, manifest); err != nil {
+			return err
+		}
+		if !s.standBy(p) {
+			break
+		}
+	}
+	// The provider only hears that the transfer succeeded once the whole
+	// file matches its checksum
+	select {
+	case <-s.verdict:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return r.completeCheck(ctx, s.verdictErr == nil)
+}
+
+// fetchChunks downloads chunks from the provider of r until no chunk is
+// left for it or it is retired.
+func (s *swarm) fetchChunks(ctx context.Context, r *receiver, manifest *protocol.Manifest) error {
+	p := r.peer
+	stream, err := s.node.Host.NewStream(ctx, p, p2p.Scoped(p2p.ChunkProtocol, r.scope))
+	if err != nil {
+		return fmt.Errorf("failed to create chunk stream: %w", err)
+	}
+	limited := protocol.WithLimit(ctx, protocol.WithIdleTimeout(stream, s.opts.Timeouts.Idle), s.opts.Limit)
+	chunks := protocol.NewChunkStream(limited, manifest, r.key, s.node.Logger)
+	buf := make([]byte, manifest.ChunkSize)
+	for {
+		index, ok := s.next(p)
+		if !ok {
+			break
+		}
+		start := time.Now()
+		chunk, err := chunks.Fetch(ctx, index, buf)
+		if err != nil {
+			s.release(index)
+			chunks.Close()
+			if errors.Is(err, protocol.ErrIntegrity) {
+				// Let the provider know instead of leaving it waiting
+				if checkErr := r.completeCheck(ctx, false); checkErr != nil {
+					s.node.Logger.Warn("failed to report corrupted chunk to provider", "err", checkErr)
+				}
+			}
+			return err
+		}
+		if err := s.store(p, index, chunk, time.Since(start)); err != nil {
+			chunks.Close()
+			return err
+		}
+	}
+	// The stream is not kept open while the provider stands by, as the
+	// provider would time it out
+	return chunks.Close()
+}
+
+// decide asks the user about the first offer, unless provider p is
+// trusted, and accepts later offers only if they have the same name and
+// size. Their checksums may differ: the content downloaded is settled by
+// the vote on the manifests, so that the first provider to answer does not
+// get to exclude the others.
+func (s *swarm) decide(ctx context.Context, p peer.ID, metadata protocol.Metadata) (bool, error) {
+	s.decideMu.Lock()
+	defer s.decideMu.Unlock()
+	if s.decided {
+		return s.accepted && metadata.Filename == s.offered.Filename && metadata.Size == s.offered.Size, nil
+	}
+	accepted, err := s.opts.accept(ctx, p, metadata)
+	if err != nil {
+		return false, err
+	}
+	s.decided, s.offered, s.accepted = true, metadata, accepted
+	return accepted, nil
+}
+
+// adopt records the manifest offered by provider p and waits until the
+// manifest the download follows is chosen: the one offered by the most
+// providers among those answering within manifestWindow of the first. It
+// fails if p offers different content.
+func (s *swarm) adopt(p peer.ID, manifest *protocol.Manifest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.chosen {
+		s.ballots = append(s.ballots, ballot{peer: p, manifest: manifest, root: string(manifest.Root())})
+		if len(s.ballots) == 1 {
+			time.AfterFunc(manifestWindow, s.choose)
+		}
+		if len(s.ballots) >= s.candidates {
+			s.chooseLocked()
+		}
+		for !s.chosen {
+			s.cond.Wait()
+		}
+	}
+	if s.startErr != nil {
+		return s.startErr
+	}
+	if !s.manifest.Equal(manifest) {
+		return fmt.Errorf("provider offers different content: %w", protocol.ErrIntegrity)
+	}
+	return nil
+}
+
+// abstain notes that a provider failed before offering a manifest, so the
+// choice need not wait for it.
+func (s *swarm) abstain() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.candidates--
+	if !s.chosen && len(s.ballots) > 0 && len(s.ballots) >= s.candidates {
+		s.chooseLocked()
+	}
+}
+
+func (s *swarm) choose() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.chosen {
+		s.chooseLocked()
+	}
+}
+
+// chooseLocked starts the download with the manifest offered by the most
+// providers, preferring the earliest on a tie. s.mu must be held.
+func (s *swarm) chooseLocked() {
+	s.chosen = true
+	defer s.cond.Broadcast()
+
+	votes := make(map[string]int)
+	var winner ballot
+	for _, b := range s.ballots {
+		votes[b.root]++
+		if votes[b.root] > votes[winner.root] || winner.manifest == nil {
+			winner = b
+		}
+	}
+	if len(votes) > 1 {
+		s.node.Logger.Warn("providers offer different content", "variants", len(votes), "chosen_by", votes[winner.root])
+	}
+	s.startErr = s.start(winner.peer, winner.manifest)
+}
+
+// start prepares the download of the content described by manifest.
+// s.mu must be held.
+func (s *swarm) start(p peer.ID, manifest *protocol.Manifest) error {
+	if manifest.Size != s.offered.Size {
+		return fmt.Errorf("manifest size %d does not match the offered size %d: %w", manifest.Size, s.offered.Size, protocol.ErrIntegrity)
+	}
+	if err := s.opts.Policy.verify(manifest.Hash); err != nil {
+		return fmt.Errorf("%w: %w", err, protocol.ErrIntegrity)
+	}
+
+	w, err := s.sink.Create(s.offered)
+	if err != nil {
+		return err
+	}
+	wa, ok := w.(writerReaderAt)
+	if !ok {
+		err := errors.New("the sink does not support writing and reading at offsets")
+		finishSink(w, err, s.node.Logger)
+		return err
+	}
+
+	s.manifest = manifest
+	s.w, s.wa = w, wa
+	s.meter = s.opts.meter("", manifest.Size)
+	s.started = time.Now()
+	s.remaining = len(manifest.Chunks)
+	s.done = make([]bool, len(manifest.Chunks))
+	s.fetching = make(map[int]int)
+	s.pending = make([]int, len(manifest.Chunks))
+	for i := range s.pending {
+		s.pending[i] = i
+	}
+	s.result.Peer = p
+	if s.remaining == 0 {
+		close(s.complete)
+	}
+	s.opts.emit(Event{Kind: EventTransferring, Metadata: &s.offered})
+	return nil
+}
+
+// next picks the chunk provider p should fetch next. Once no chunk is left
+// unclaimed, idle providers duplicate the chunks others are still fetching,
+// so a slow provider cannot hold up the end of the download. It reports
+// false when nothing is left for p.
+func (s *swarm) next(p peer.ID) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		rate := s.rate(p)
+		if s.remaining == 0 || rate.retired {
+			return 0, false
+		}
+		if len(s.pending) > 0 {
+			index := s.pending[0]
+			s.pending = s.pending[1:]
+			s.fetching[index]++
+			return index, true
+		}
+		for index, n := range s.fetching {
+			if n == 1 && !s.done[index] {
+				s.fetching[index]++
+				return index, true
+			}
+		}
+		// Wait for a chunk to be released by a failing provider.
+		s.cond.Wait()
+	}
+}
+
+// standBy waits while provider p is retired, in case it is needed again.
+// It reports whether p was brought back before the download completed.
+func (s *swarm) standBy(p peer.ID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.remaining > 0 {
+		if !s.rate(p).retired {
+			return true
+		}
+		s.cond.Wait()
+	}
+	return false
+}
+
+// leave notes that provider p failed. Once only retired providers remain,
+// they are brought back rather than giving up on the download.
+func (s *swarm) leave(p peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rate(p).gone = true
+	for _, rate := range s.rates {
+		if !rate.retired && !rate.gone {
+			return
+		}
+	}
+	for other, rate := range s.rates {
+		if rate.retired {
+			rate.retired = false
+			s.node.Logger.Info("bringing back retired provider", "provider", other)
+		}
+	}
+	s.cond.Broadcast()
+}
+
+// release gives up on fetching chunk index, putting it back in the queue
+// unless another provider is still on it.
+func (s *swarm) release(index int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetching[index]--
+	if s.fetching[index] <= 0 && !s.done[index] {
+		delete(s.fetching, index)
+		s.pending = append(s.pending, index)
+	}
+	s.cond.Broadcast()
+}
+
+// store writes a verified chunk from provider p and updates its rate.
+func (s *swarm) store(p peer.ID, index int, chunk []byte, took time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.cond.Broadcast()
+
+	s.fetching[index]--
+	if s.fetching[index] <= 0 {
+		delete(s.fetching, index)
+	}
+	if s.done[index] {
+		return nil
+	}
+
+	off, _ := s.manifest.ChunkRange(index)
+	if _, err := s.wa.WriteAt(chunk, off); err != nil {
+		return fmt.Errorf("failed to write chunk %d: %w", index, err)
+	}
+	s.done[index] = true
+	s.remaining--
+	s.meter.Write(chunk)
+
+	rate := s.rate(p)
+	if rate.chunks == 0 {
+		s.result.Providers = append(s.result.Providers, p)
+	}
+	instant := float64(len(chunk)) / max(took.Seconds(), 1e-3)
+	if rate.chunks == 0 {
+		rate.rate = instant
+	} else {
+		rate.rate = 0.3*instant + 0.7*rate.rate
+	}
+	rate.chunks++
+	s.rebalance(p)
+
+	if s.remaining == 0 {
+		close(s.complete)
+	}
+	return nil
+}
+
+// rebalance retires p if it is much slower than the fastest provider, as
+// long as another provider remains to take over.
+func (s *swarm) rebalance(p peer.ID) {
+	rate := s.rate(p)
+	if rate.chunks < minRatedChunks {
+		return
+	}
+	var fastest float64
+	active := 0
+	for _, other := range s.rates {
+		if other.retired || other.gone {
+			continue
+		}
+		active++
+		if other.chunks >= minRatedChunks {
+			fastest = max(fastest, other.rate)
+		}
+	}
+	if active > 1 && rate.rate*slowProviderFactor < fastest {
+		rate.retired = true
+		s.node.Logger.Info("retiring slow provider", "provider", p, "rate", rate.rate, "fastest", fastest)
+	}
+}
+
+func (s *swarm) rate(p peer.ID) *providerRate {
+	rate := s.rates[p]
+	if rate == nil {
+		rate = &providerRate{}
+		s.rates[p] = rate
+	}
+	return rate
+}
+
+// finished reports whether every chunk has arrived.
+func (s *swarm) finished() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.manifest != nil && s.remaining == 0
+}
+
+func (r *receiver) fetchManifest(ctx context.Context) (*protocol.Manifest, error) {
+	// The provider may need to read the whole file to build the manifest,
+	// so this waits as long as for the other side's decision.
+	ctx, cancel := phase(ctx, r.opts.Timeouts.Accept)
+	defer cancel()
+
+	stream, err := r.node.Host.NewStream(ctx, r.peer, p2p.Scoped(p2p.ManifestProtocol, r.scope))
+	if err != nil {
+		return nil, fmt.Errorf("fetchManifest: failed to create manifest stream: %w", err)
+	}
+	manifest, err := protocol.ReceiveManifest(ctx, stream, r.key, r.node.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("fetchManifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// summarize completes the stats of the download. s.mu must be held.
+func (s *swarm) summarize() Stats {
+	stats := s.stats
+	stats.phase(PhaseTransfer, s.started, time.Now())
+	stats.Payload = s.manifest.Size
+	stats.Peak = s.meter.Peak()
+	if d := stats.Phase(PhaseTransfer); d > 0 {
+		stats.Average = float64(stats.Payload) / d.Seconds()
+	}
+	for _, p := range s.result.Providers {
+		stats.Wire += s.node.WireBytes(p)
+	}
+	return stats
+}
@@ -0,0 +1,142 @@
+package peerlink
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// startProviders serves each source from a node of its own under one code,
+// connected to rn, and returns the servers. The outcomes of their sessions
+// are discarded.
+func startProviders(t *testing.T, ctx context.Context, rn *p2p.Node, srcs ...Source) []*server {
+	t.Helper()
+	var servers []*server
+	for _, src := range srcs {
+		sn := newLocalNode(t)
+		if servers == nil {
+			if err := sn.GenerateWordsAndCid(); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := sn.SetWordsAndCid(servers[0].node.Words()); err != nil {
+			t.Fatal(err)
+		}
+		connect(t, sn, rn)
+		s := newServer(ctx, sn, src, Options{Timeouts: DefaultTimeouts}, ServeOptions{})
+		go func() {
+			for {
+				select {
+				case <-s.finished:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		servers = append(servers, s)
+	}
+	if err := rn.SetWordsAndCid(servers[0].node.Words()); err != nil {
+		t.Fatal(err)
+	}
+	return servers
+}
+
+func runSwarm(ctx context.Context, rn *p2p.Node, sink Sink, servers []*server) (*ReceiveResult, error) {
+	var providers []peer.AddrInfo
+	for _, s := range servers {
+		s.register()
+		providers = append(providers, peer.AddrInfo{ID: s.node.Host.ID()})
+	}
+	return newSwarm(rn, sink, Options{Timeouts: DefaultTimeouts}, Stats{}).run(ctx, providers)
+}
+
+func TestSwarm(t *testing.T) {
+	rn := newLocalNode(t)
+	ctx := testContext(t)
+	data := randomData(t, 5<<20+5)
+	other := append([]byte{}, data...)
+	other[100] ^= 1
+	servers := startProviders(t, ctx, rn,
+		BytesSource("x.bin", data),
+		BytesSource("x.bin", data),
+		BytesSource("x.bin", data),
+		BytesSource("x.bin", other),
+	)
+
+	dir := t.TempDir()
+	result, err := runSwarm(ctx, rn, DirSink(dir), servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "x.bin"))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes, %v", len(got), err)
+	}
+	for _, p := range result.Providers {
+		if p == servers[3].node.Host.ID() {
+			t.Fatal("chunks were fetched from the provider offering other content")
+		}
+	}
+}
+
+// TestSwarmForgedManifest checks that a file whose chunks match the manifest
+// is still refused when it does not match the checksum the manifest claims.
+func TestSwarmForgedManifest(t *testing.T) {
+	rn := newLocalNode(t)
+	ctx := testContext(t)
+	data := randomData(t, 2<<20+7)
+	servers := startProviders(t, ctx, rn, BytesSource("x.bin", data))
+
+	manifest, err := protocol.BuildManifest(bytes.NewReader(data), protocol.DefaultChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := sha256.Sum256([]byte("something else"))
+	manifest.Hash = forged[:]
+	s := servers[0]
+	s.manifestOnce.Do(func() { s.manifest = manifest })
+	s.hashOnce.Do(func() { s.hash = forged[:] })
+
+	dir := t.TempDir()
+	if _, err := runSwarm(ctx, rn, DirSink(dir), servers); !errors.Is(err, protocol.ErrIntegrity) {
+		t.Fatalf("got %v, want ErrIntegrity", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("a file not matching its checksum left %d entries behind", len(entries))
+	}
+}
+
+// TestSwarmBringsBackRetired checks that a retired provider stands by
+// until the last active provider fails, and is then brought back.
+func TestSwarmBringsBackRetired(t *testing.T) {
+	s := newSwarm(newLocalNode(t), nil, Options{}, Stats{})
+	slow, fast := peer.ID("slow"), peer.ID("fast")
+	s.remaining = 1
+	s.rate(slow).retired = true
+	s.rate(fast)
+
+	back := make(chan bool)
+	go func() { back <- s.standBy(slow) }()
+	select {
+	case <-back:
+		t.Fatal("a retired provider came back while another was active")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.leave(fast)
+	select {
+	case ok := <-back:
+		if !ok {
+			t.Fatal("the retired provider was not brought back")
+		}
+	case <-testContext(t).Done():
+		t.Fatal("the retired provider was not brought back")
+	}
+}
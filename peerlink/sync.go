@@ -0,0 +1,489 @@
+package peerlink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// SyncResult describes a completed directory sync.
+type SyncResult struct {
+	Code string
+	Peer peer.ID
+	// Updated lists the files that were created or changed, by their
+	// slash-separated path in the directory.
+	Updated []string
+	// Unchanged counts the files the receiver already had.
+	Unchanged int
+	// Literal is the file data sent as it is and Matched the data the
+	// receiver reused from its own copies of the changed files.
+	Literal int64
+	Matched int64
+}
+
+// SendDir offers the regular files under dir under a freshly generated code
+// and blocks until a receiver has synced its copy of the directory with
+// ReceiveDir, declined, or ctx is done. Only the files the receiver lacks
+// or has a different version of are sent, and of those only the parts that
+// changed. The code is reported through an EventCode event.
+func (c *Client) SendDir(ctx context.Context, dir string, opts Options) (*SyncResult, error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	manifest, err := scanDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("SendDir: %w", err)
+	}
+
+	node, err := c.newNode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("SendDir: %w", err)
+	}
+	defer node.Close()
+	node.Logger.Info("scanned directory", "dir", dir, "files", len(manifest.Files), "size", manifest.Size())
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := newDirServer(ctx, node, dir, manifest, opts)
+	s.register()
+	defer s.unregister()
+
+	if err := s.pairing.host(ctx, node, opts); err != nil {
+		return nil, fmt.Errorf("SendDir: %w", err)
+	}
+
+	select {
+	case err := <-s.done:
+		if err != nil {
+			return nil, fmt.Errorf("SendDir: %w", err)
+		}
+	case <-ctx.Done():
+		return nil, fmt.Errorf("SendDir: %w", ctx.Err())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.result.Code = node.Code()
+	s.result.Peer = s.pairing.peer
+	s.result.Unchanged = len(manifest.Files) - len(s.result.Updated)
+	return &s.result, nil
+}
+
+// scanDir lists the regular files under dir with their checksums. Symbolic
+// links and other special files are left out.
+func scanDir(dir string) (*protocol.DirManifest, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	m := &protocol.DirManifest{Name: filepath.Base(abs)}
+	err = filepath.WalkDir(abs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(abs, path)
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		hash, err := utils.CalculateHash(file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		m.Files = append(m.Files, protocol.DirEntry{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Hash:    hash,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan directory: %w", err)
+	}
+	return m, nil
+}
+
+// dirServer answers the requests of the receiver syncing a directory.
+type dirServer struct {
+	ctx      context.Context
+	node     *p2p.Node
+	dir      string
+	manifest *protocol.DirManifest
+	files    map[string]protocol.DirEntry
+	opts     Options
+	pairing  *pairing
+	notifee  *network.NotifyBundle
+
+	once sync.Once
+	done chan error
+
+	mu     sync.Mutex
+	result SyncResult
+}
+
+func newDirServer(ctx context.Context, node *p2p.Node, dir string, manifest *protocol.DirManifest, opts Options) *dirServer {
+	s := &dirServer{
+		ctx:      ctx,
+		node:     node,
+		dir:      dir,
+		manifest: manifest,
+		files:    make(map[string]protocol.DirEntry, len(manifest.Files)),
+		opts:     opts,
+		pairing:  newPairing(),
+		done:     make(chan error, 1),
+	}
+	for _, f := range manifest.Files {
+		s.files[f.Path] = f
+	}
+	s.notifee = &network.NotifyBundle{DisconnectedF: func(n network.Network, conn network.Conn) {
+		remote := conn.RemotePeer()
+		select {
+		case <-s.pairing.done:
+		default:
+			return
+		}
+		if remote == s.pairing.peer && n.Connectedness(remote) != network.Connected {
+			s.finish(fmt.Errorf("receiver %s: %w", remote, p2p.ErrDisconnected))
+		}
+	}}
+	return s
+}
+
+func (s *dirServer) register() {
+	s.node.Host.SetStreamHandler(p2p.DirManifestProtocol, s.handleManifest)
+	s.node.Host.SetStreamHandler(p2p.DeltaProtocol, s.handleDelta)
+	s.node.Host.SetStreamHandler(p2p.CompleteCheckProtocol, s.handleCompleteCheck)
+	s.node.Host.Network().Notify(s.notifee)
+}
+
+func (s *dirServer) unregister() {
+	s.node.Host.Network().StopNotify(s.notifee)
+	s.node.Host.RemoveStreamHandler(p2p.DirManifestProtocol)
+	s.node.Host.RemoveStreamHandler(p2p.DeltaProtocol)
+	s.node.Host.RemoveStreamHandler(p2p.CompleteCheckProtocol)
+}
+
+// finish reports the outcome of the sync to SendDir.
+func (s *dirServer) finish(err error) {
+	s.once.Do(func() { s.done <- err })
+}
+
+func (s *dirServer) handleManifest(stream network.Stream) {
+	key := s.pairing.keyFor(s.ctx, stream)
+	if key == nil {
+		return
+	}
+	ctx, cancel := phase(s.ctx, s.opts.Timeouts.Accept)
+	defer cancel()
+	accepted, err := protocol.SendDirManifest(ctx, stream, s.manifest, key, s.node.Logger)
+	if err != nil {
+		s.finish(fmt.Errorf("manifest exchange failed: %w", err))
+		return
+	}
+	if !accepted {
+		s.node.Logger.Info("receiver declined the sync", "receiver", s.pairing.peer)
+		s.finish(protocol.ErrDeclined)
+		return
+	}
+	s.opts.emit(Event{Kind: EventAccepted, Peer: s.pairing.peer, Metadata: &protocol.Metadata{Filename: s.manifest.Name, Size: s.manifest.Size()}})
+}
+
+func (s *dirServer) handleDelta(stream network.Stream) {
+	key := s.pairing.keyFor(s.ctx, stream)
+	if key == nil {
+		return
+	}
+	open := func(path string) (io.ReadCloser, *rw.Meter, error) {
+		entry, ok := s.files[path]
+		if !ok {
+			return nil, nil, fmt.Errorf("%q is not part of the directory", path)
+		}
+		file, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(path)))
+		if err != nil {
+			return nil, nil, err
+		}
+		metadata := protocol.Metadata{Filename: path, Size: entry.Size}
+		s.opts.emit(Event{Kind: EventTransferring, Peer: s.pairing.peer, Metadata: &metadata})
+		return file, s.opts.meter(s.pairing.peer, entry.Size), nil
+	}
+
+	stream = protocol.WithLimit(s.ctx, protocol.WithIdleTimeout(stream, s.opts.Timeouts.Idle), s.opts.Limit)
+	req, stats, err := protocol.ServeDelta(s.ctx, stream, open, key, s.node.Logger)
+	if err != nil {
+		s.finish(fmt.Errorf("delta transfer failed: %w", err))
+		return
+	}
+	s.mu.Lock()
+	s.result.Updated = append(s.result.Updated, req.Path)
+	s.result.Literal += stats.Literal
+	s.result.Matched += stats.Matched
+	s.mu.Unlock()
+	s.node.Logger.Info("file synced", "receiver", s.pairing.peer, "path", req.Path, "literal", stats.Literal, "matched", stats.Matched)
+	metadata := protocol.Metadata{Filename: req.Path, Size: s.files[req.Path].Size}
+	s.opts.emit(Event{Kind: EventTransferred, Peer: s.pairing.peer, Metadata: &metadata})
+}
+
+func (s *dirServer) handleCompleteCheck(stream network.Stream) {
+	key := s.pairing.keyFor(s.ctx, stream)
+	if key == nil {
+		return
+	}
+	ctx, cancel := phase(s.ctx, s.opts.Timeouts.Phase)
+	defer cancel()
+	s.finish(protocol.ReceiveCompleteCheck(ctx, stream, key, s.node.Logger))
+}
+
+// ReceiveDir syncs dir with the directory offered under code by SendDir.
+// Files the receiver already has, judged by their size and modification
+// time or else by their checksum, are left alone; changed ones are rebuilt
+// from the parts of the existing copy the sender still has plus the bytes
+// it sends, verified, and swapped in place. opts.Accept is asked once, with
+// the name of the directory and the size of the files to update. Files
+// that only exist in dir are kept. A file is not synced through a symbolic
+// link to a directory under dir, which could point out of it.
+func (c *Client) ReceiveDir(ctx context.Context, code, dir string, opts Options) (*SyncResult, error) {
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("ReceiveDir: %w", err)
+	}
+
+	node, err := c.newNode(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("ReceiveDir: %w", err)
+	}
+	defer node.Close()
+
+	p := newPairing()
+	if err := p.join(ctx, node, code, opts); err != nil {
+		return nil, fmt.Errorf("ReceiveDir: %w", err)
+	}
+	r := &receiver{node: node, peer: p.peer, opts: opts, key: p.key}
+	result, err := r.syncDir(network.WithAllowLimitedConn(ctx, "peerlink"), dir)
+	if err != nil {
+		return nil, fmt.Errorf("ReceiveDir: %w", err)
+	}
+	result.Code = code
+	return result, nil
+}
+
+// syncDir fetches the sender's manifest and brings the files under dir up
+// to date with it.
+func (r *receiver) syncDir(ctx context.Context, dir string) (*SyncResult, error) {
+	var stale []protocol.DirEntry
+	manifest, err := r.exchangeDirManifest(ctx, func(ctx context.Context, m *protocol.DirManifest) (bool, error) {
+		var size int64
+		for _, entry := range m.Files {
+			if !upToDate(dir, entry) {
+				stale = append(stale, entry)
+				size += entry.Size
+			}
+		}
+		if len(stale) == 0 {
+			return true, nil
+		}
+		metadata := protocol.Metadata{Filename: m.Name, Size: size}
+		r.opts.emit(Event{Kind: EventMetadata, Peer: r.peer, Metadata: &metadata})
+		return r.opts.accept(ctx, r.peer, metadata)
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.opts.emit(Event{Kind: EventAccepted, Peer: r.peer, Metadata: &protocol.Metadata{Filename: manifest.Name, Size: manifest.Size()}})
+
+	result := &SyncResult{Peer: r.peer, Unchanged: len(manifest.Files) - len(stale)}
+	for _, entry := range stale {
+		updated, stats, err := r.syncFile(ctx, dir, entry)
+		if err != nil {
+			if errors.Is(err, protocol.ErrIntegrity) {
+				if checkErr := r.completeCheck(ctx, false); checkErr != nil {
+					r.node.Logger.Warn("failed to report corrupted file to sender", "err", checkErr)
+				}
+			}
+			return nil, fmt.Errorf("syncDir: %s: %w", entry.Path, err)
+		}
+		if !updated {
+			result.Unchanged++
+			continue
+		}
+		result.Updated = append(result.Updated, entry.Path)
+		result.Literal += stats.Literal
+		result.Matched += stats.Matched
+	}
+
+	if err := r.completeCheck(ctx, true); err != nil {
+		return nil, fmt.Errorf("syncDir: %w", err)
+	}
+	return result, nil
+}
+
+func (r *receiver) exchangeDirManifest(ctx context.Context, accept func(context.Context, *protocol.DirManifest) (bool, error)) (*protocol.DirManifest, error) {
+	ctx, cancel := phase(ctx, r.opts.Timeouts.Accept)
+	defer cancel()
+
+	stream, err := r.node.Host.NewStream(ctx, r.peer, p2p.DirManifestProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("exchangeDirManifest: failed to create manifest stream: %w", err)
+	}
+	defer stream.Close()
+	manifest, accepted, err := protocol.ReceiveDirManifest(ctx, stream, r.key, accept, r.node.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("exchangeDirManifest: %w", err)
+	}
+	if !accepted {
+		return nil, protocol.ErrDeclined
+	}
+	return manifest, nil
+}
+
+// localPath returns where the file at path of the manifest goes under dir.
+// The directories on the way must be real directories, since following a
+// symbolic link among them could lead out of dir; those that do not exist
+// yet are created by syncFile.
+func localPath(dir, path string) (string, error) {
+	parts := strings.Split(path, "/")
+	parent := dir
+	for _, part := range parts[:len(parts)-1] {
+		parent = filepath.Join(parent, part)
+		info, err := os.Lstat(parent)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("%s is a symbolic link or not a directory", parent)
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(path)), nil
+}
+
+// upToDate reports whether the copy of entry under dir has the same size
+// and modification time, which is taken as having the same content.
+func upToDate(dir string, entry protocol.DirEntry) bool {
+	path, err := localPath(dir, entry.Path)
+	if err != nil {
+		return false
+	}
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode().IsRegular() && info.Size() == entry.Size && info.ModTime().Equal(entry.ModTime)
+}
+
+// syncFile brings the copy of entry under dir up to date and reports
+// whether it had to be rewritten. A copy with the right content only gets
+// its modification time fixed.
+func (r *receiver) syncFile(ctx context.Context, dir string, entry protocol.DirEntry) (_ bool, _ protocol.DeltaStats, err error) {
+	var stats protocol.DeltaStats
+	path, err := localPath(dir, entry.Path)
+	if err != nil {
+		return false, stats, err
+	}
+
+	// The existing copy, if any, is what the delta is computed against.
+	var base *os.File
+	mode := fs.FileMode(0o644)
+	var baseSize int64
+	if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+		if base, err = os.Open(path); err != nil {
+			return false, stats, err
+		}
+		defer base.Close()
+		mode = info.Mode().Perm()
+		baseSize = info.Size()
+		if info.Size() == entry.Size {
+			hash, err := utils.CalculateHash(base)
+			if err != nil {
+				return false, stats, err
+			}
+			if bytes.Equal(hash, entry.Hash) {
+				return false, stats, os.Chtimes(path, entry.ModTime, entry.ModTime)
+			}
+			if _, err := base.Seek(0, io.SeekStart); err != nil {
+				return false, stats, err
+			}
+		}
+	}
+	var sig *protocol.Signature
+	var baseReader io.ReaderAt = bytes.NewReader(nil)
+	if base != nil && baseSize <= protocol.MaxSignatureBlocks*int64(protocol.BlockSize(entry.Size)) {
+		if sig, err = protocol.BuildSignature(base, entry.Size); err != nil {
+			return false, stats, err
+		}
+		baseReader = base
+	} else {
+		sig = &protocol.Signature{BlockSize: protocol.BlockSize(0)}
+	}
+
+	// Rebuild the file next to the old copy and only swap it in once it
+	// has been verified.
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return false, stats, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".peerlink-*")
+	if err != nil {
+		return false, stats, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	metadata := protocol.Metadata{Filename: entry.Path, Size: entry.Size}
+	r.opts.emit(Event{Kind: EventTransferring, Peer: r.peer, Metadata: &metadata})
+	stream, err := r.node.Host.NewStream(ctx, r.peer, p2p.DeltaProtocol)
+	if err != nil {
+		return false, stats, fmt.Errorf("failed to create delta stream: %w", err)
+	}
+	defer stream.Close()
+	limited := protocol.WithLimit(ctx, protocol.WithIdleTimeout(stream, r.opts.Timeouts.Idle), r.opts.Limit)
+	meter := r.opts.meter(r.peer, entry.Size)
+	n, hash, stats, err := protocol.RequestDelta(ctx, limited, entry.Path, entry.Size, sig, baseReader, tmp, r.key, meter, r.node.Logger)
+	if err != nil {
+		return false, stats, err
+	}
+	if n != entry.Size || !bytes.Equal(hash, entry.Hash) {
+		r.node.Logger.Warn("synced file does not match the manifest", "path", entry.Path, "size", n, "expected", entry.Size)
+		return false, stats, protocol.ErrIntegrity
+	}
+
+	if err := tmp.Chmod(mode); err != nil {
+		return false, stats, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return false, stats, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, stats, err
+	}
+	if err := os.Chtimes(tmp.Name(), entry.ModTime, entry.ModTime); err != nil {
+		return false, stats, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, stats, err
+	}
+	r.node.Logger.Info("file synced", "sender", r.peer, "path", entry.Path, "literal", stats.Literal, "matched", stats.Matched)
+	r.opts.emit(Event{Kind: EventTransferred, Peer: r.peer, Metadata: &metadata})
+	return true, stats, nil
+}
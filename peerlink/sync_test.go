@@ -0,0 +1,154 @@
+package peerlink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// syncDirs syncs dst with src between two local nodes and returns the
+// outcome on both sides.
+func syncDirs(t *testing.T, src, dst string) (*SyncResult, error, error) {
+	t.Helper()
+	sn, rn := localPair(t)
+	ctx := testContext(t)
+	m, err := scanDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{}
+	opts.Timeouts = opts.Timeouts.withDefaults()
+	s := newDirServer(ctx, sn, src, m, opts)
+	s.register()
+	defer s.unregister()
+	key := pairLocal(t, ctx, sn, rn, s.pairing)
+
+	r := &receiver{node: rn, peer: sn.Host.ID(), opts: opts, key: key}
+	result, err := r.syncDir(ctx, dst)
+	if err != nil {
+		// The sender only learns about some failures when the receiver
+		// hangs up
+		rn.Host.Network().ClosePeer(sn.Host.ID())
+	}
+	return result, err, <-s.done
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	big := randomData(t, 3<<20+777)
+	writeFile(t, filepath.Join(src, "big.bin"), big)
+	writeFile(t, filepath.Join(src, "sub/deep/a.txt"), []byte("hello"))
+	writeFile(t, filepath.Join(src, "empty"), nil)
+
+	result, err, sendErr := syncDirs(t, src, dst)
+	if err != nil || sendErr != nil {
+		t.Fatalf("receiver: %v, sender: %v", err, sendErr)
+	}
+	if len(result.Updated) != 3 {
+		t.Fatalf("updated %v, want 3 files", result.Updated)
+	}
+
+	// Change a few bytes in the middle and touch a file without changing it
+	copy(big[1<<20:], "CHANGED!")
+	writeFile(t, filepath.Join(src, "big.bin"), big)
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "sub/deep/a.txt"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	result, err, sendErr = syncDirs(t, src, dst)
+	if err != nil || sendErr != nil {
+		t.Fatalf("receiver: %v, sender: %v", err, sendErr)
+	}
+	if len(result.Updated) != 1 || result.Unchanged != 2 || result.Literal > 200<<10 {
+		t.Fatalf("second sync: %+v", result)
+	}
+
+	for _, p := range []string{"big.bin", "sub/deep/a.txt", "empty"} {
+		want, _ := os.ReadFile(filepath.Join(src, p))
+		got, err := os.ReadFile(filepath.Join(dst, p))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s differs: %v", p, err)
+		}
+		srcInfo, _ := os.Stat(filepath.Join(src, p))
+		dstInfo, _ := os.Stat(filepath.Join(dst, p))
+		if !srcInfo.ModTime().Equal(dstInfo.ModTime()) {
+			t.Fatalf("%s has modification time %v, want %v", p, dstInfo.ModTime(), srcInfo.ModTime())
+		}
+	}
+}
+
+// TestSyncSymlinkedParent checks that a symbolic link planted under the
+// receiving directory does not lead the sync out of it.
+func TestSyncSymlinkedParent(t *testing.T) {
+	src, dst, outside := t.TempDir(), t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(src, "sub/deep/a.txt"), []byte("hello"))
+	if err := os.Symlink(outside, filepath.Join(dst, "sub")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err, _ := syncDirs(t, src, dst); err == nil {
+		t.Fatal("synced through a symbolic link")
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Fatalf("the sync wrote %d entries outside the directory", len(entries))
+	}
+}
+
+// TestRequestDeltaOverlong checks that a sender streaming more than the
+// size of the file is stopped as soon as it goes over.
+func TestRequestDeltaOverlong(t *testing.T) {
+	sn, rn := localPair(t)
+	ctx := testContext(t)
+	key := randomData(t, 32)
+	const flood = "/peerlink-test/flood"
+
+	sn.Host.SetStreamHandler(flood, func(stream network.Stream) {
+		defer stream.Close()
+		w := bufio.NewWriter(stream)
+		delta := bufio.NewWriterSize(rw.NewPWriter(w, key), rw.MaxFrameSize)
+		literal := make([]byte, 1<<10)
+		for range 1 << 10 {
+			delta.WriteByte('d')
+			binary.Write(delta, binary.BigEndian, uint32(len(literal)))
+			if _, err := delta.Write(literal); err != nil {
+				return
+			}
+		}
+		delta.WriteByte('e')
+		delta.Flush()
+		w.Flush()
+	})
+
+	stream, err := rn.Host.NewStream(ctx, sn.Host.ID(), flood)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := &protocol.Signature{BlockSize: protocol.BlockSize(0)}
+	var got bytes.Buffer
+	_, _, _, err = protocol.RequestDelta(ctx, stream, "a", 4<<10, sig, bytes.NewReader(nil), &got, key, nil, rn.Logger)
+	if !errors.Is(err, protocol.ErrIntegrity) {
+		t.Fatalf("got %v, want ErrIntegrity", err)
+	}
+	if got.Len() > 4<<10 {
+		t.Fatalf("wrote %d bytes of a 4 KiB file", got.Len())
+	}
+}
@@ -0,0 +1,57 @@
+package peerlink
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts bounds the individual phases of a transfer; the transfer as a
+// whole is bounded by the context passed to Send or Receive. A zero field
+// selects the value from DefaultTimeouts and a negative one disables the
+// limit.
+type Timeouts struct {
+	// Publish bounds announcing the code on the DHT.
+	Publish time.Duration
+	// Query bounds looking up and connecting to the sender.
+	Query time.Duration
+	// Phase bounds each short protocol exchange, such as the handshake
+	// and the final completion check.
+	Phase time.Duration
+	// Accept bounds how long the receiver may take to accept a file.
+	Accept time.Duration
+	// Idle bounds how long a peer may stay silent while data is flowing.
+	Idle time.Duration
+}
+
+// DefaultTimeouts are used for the fields of Timeouts left at zero.
+var DefaultTimeouts = Timeouts{
+	Publish: 60 * time.Second,
+	Query:   30 * time.Second,
+	Phase:   30 * time.Second,
+	Accept:  10 * time.Minute,
+	Idle:    60 * time.Second,
+}
+
+func (t Timeouts) withDefaults() Timeouts {
+	pick := func(d, def time.Duration) time.Duration {
+		if d == 0 {
+			return def
+		}
+		return d
+	}
+	return Timeouts{
+		Publish: pick(t.Publish, DefaultTimeouts.Publish),
+		Query:   pick(t.Query, DefaultTimeouts.Query),
+		Phase:   pick(t.Phase, DefaultTimeouts.Phase),
+		Accept:  pick(t.Accept, DefaultTimeouts.Accept),
+		Idle:    pick(t.Idle, DefaultTimeouts.Idle),
+	}
+}
+
+// phase returns ctx bounded by d, or merely cancellable if d is not positive.
+func phase(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
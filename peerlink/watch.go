@@ -0,0 +1,374 @@
+package peerlink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/SyedMa3/peerlink/p2p"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// defaultSettle is how long a watched file must stay unchanged before
+	// it is sent, unless WatchOptions.Settle says otherwise.
+	defaultSettle = 2 * time.Second
+
+	// minRetryDelay and maxRetryDelay bound the wait before sending a
+	// watched file again after a failure, or reconnecting to the peer of a
+	// session. It doubles with each attempt.
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+
+	// defaultWatchResume is how long Watch reconnects to the peer of its
+	// session, unless WatchOptions.Resume says otherwise.
+	defaultWatchResume = 10 * time.Minute
+
+	// recordName is the default record of the files sent from a watched
+	// directory, kept in the directory itself.
+	recordName = ".peerlink-sent"
+)
+
+// WatchOptions configures Watch.
+type WatchOptions struct {
+	// Code joins the session the peer opened with that code.
+	Code string
+	// Settle is how long a file must keep the same size and modification
+	// time before it is sent. Zero means two seconds.
+	Settle time.Duration
+	// Record is the file listing the files sent so far, which are only
+	// sent again once they change. Empty means .peerlink-sent in the
+	// watched directory.
+	Record string
+	// Resume is how long Watch keeps reconnecting to the peer after the
+	// connection dropped, as in SessionOptions.Resume. Zero means ten
+	// minutes.
+	Resume time.Duration
+	// OnSend, if set, is called with the outcome of every file sent or
+	// declined by the peer. Failures that are retried are reported through
+	// EventRetrying events instead.
+	OnSend func(path string, result *SendResult, err error)
+}
+
+// Watch joins the session the peer opened with watchOpts.Code and sends it
+// every regular file in dir, as well as every file written or moved there
+// later, once it has stopped changing. Subdirectories are not watched, and
+// files whose name starts with a dot are left out. A file that fails to
+// send is retried after a growing delay until it is sent, declined or
+// changed, while the other files go ahead. When the connection drops, the session is resumed as described
+// for SessionOptions.Resume, and the files waiting to be sent keep their
+// place. The files offered by the peer are declined. Watch runs until ctx
+// is done or the peer leaves the session for good.
+func (c *Client) Watch(ctx context.Context, dir string, opts Options, watchOpts WatchOptions) error {
+	if watchOpts.Code == "" {
+		return errors.New("Watch: a code is required")
+	}
+	if watchOpts.Settle <= 0 {
+		watchOpts.Settle = defaultSettle
+	}
+	if watchOpts.Record == "" {
+		watchOpts.Record = filepath.Join(dir, recordName)
+	}
+	if watchOpts.Resume <= 0 {
+		watchOpts.Resume = defaultWatchResume
+	}
+	record, err := openRecord(watchOpts.Record)
+	if err != nil {
+		return fmt.Errorf("Watch: %w", err)
+	}
+	defer record.close()
+
+	// Watch before listing the directory, so that no file falls between.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	changes, err := watchChanges(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("Watch: %w", err)
+	}
+
+	opts.Accept = func(context.Context, protocol.Metadata) (bool, error) { return false, nil }
+	opts.Policy = nil
+	sess, err := c.OpenSession(ctx, opts, SessionOptions{Code: watchOpts.Code, Sink: DirSink(dir), Resume: watchOpts.Resume})
+	if err != nil {
+		return fmt.Errorf("Watch: %w", err)
+	}
+	defer sess.Close()
+
+	w := &watcher{
+		dir:       dir,
+		sess:      sess,
+		opts:      opts,
+		watchOpts: watchOpts,
+		record:    record,
+		pending:   make(map[string]pendingFile),
+		declined:  make(map[string]fileVersion),
+	}
+	if err := w.run(ctx, changes); err != nil {
+		return fmt.Errorf("Watch: %w", err)
+	}
+	return nil
+}
+
+// fileVersion tells the versions of a file apart.
+type fileVersion struct {
+	size    int64
+	modTime int64
+}
+
+// pendingFile is a file waiting to stop changing, or to be sent again
+// after a failure.
+type pendingFile struct {
+	version fileVersion
+	since   time.Time
+	// retry is when the file may be sent again, and delay how long the
+	// next failure puts it off.
+	retry time.Time
+	delay time.Duration
+}
+
+// watcher sends the files of a watched directory over a session.
+type watcher struct {
+	dir       string
+	sess      *Session
+	opts      Options
+	watchOpts WatchOptions
+	record    *sendRecord
+	pending   map[string]pendingFile
+	// declined holds the versions the peer declined, which are not offered
+	// again.
+	declined map[string]fileVersion
+}
+
+// run notes the files that change and sends those that settled. Without
+// change notifications, the directory is scanned periodically instead.
+func (w *watcher) run(ctx context.Context, changes <-chan string) error {
+	w.scan()
+	tick := time.NewTicker(max(w.watchOpts.Settle/4, 10*time.Millisecond))
+	defer tick.Stop()
+	for {
+		select {
+		case name, ok := <-changes:
+			switch {
+			case !ok:
+				changes = nil
+			case name == "":
+				w.scan()
+			default:
+				w.note(name)
+			}
+		case <-tick.C:
+			if changes == nil {
+				w.scan()
+			}
+			if err := w.sendSettled(ctx); err != nil {
+				return err
+			}
+		case <-w.sess.Done():
+			return p2p.ErrDisconnected
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (w *watcher) scan() {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		w.sess.node.Logger.Warn("failed to scan watched directory", "dir", w.dir, "err", err)
+		return
+	}
+	for _, entry := range entries {
+		w.note(entry.Name())
+	}
+}
+
+// note starts waiting for the file name to settle, unless it has been sent
+// or declined already. A file that changed waits again from the start.
+func (w *watcher) note(name string) {
+	if strings.HasPrefix(name, ".") {
+		return
+	}
+	version, ok := w.stat(name)
+	if !ok || w.record.has(name, version) || w.declined[name] == version {
+		delete(w.pending, name)
+		return
+	}
+	if p, ok := w.pending[name]; ok && p.version == version {
+		return
+	}
+	w.pending[name] = pendingFile{version: version, since: time.Now()}
+}
+
+// stat returns the version of the file name, if it is a regular file.
+func (w *watcher) stat(name string) (fileVersion, bool) {
+	info, err := os.Lstat(filepath.Join(w.dir, name))
+	if err != nil || !info.Mode().IsRegular() {
+		return fileVersion{}, false
+	}
+	return fileVersion{size: info.Size(), modTime: info.ModTime().UnixNano()}, true
+}
+
+// sendSettled sends the files that stayed unchanged for the settle time,
+// oldest first, leaving out those waiting to be retried.
+func (w *watcher) sendSettled(ctx context.Context) error {
+	var settled []string
+	now := time.Now()
+	for name, p := range w.pending {
+		if now.Sub(p.since) >= w.watchOpts.Settle && !now.Before(p.retry) {
+			settled = append(settled, name)
+		}
+	}
+	slices.SortFunc(settled, func(a, b string) int {
+		return w.pending[a].since.Compare(w.pending[b].since)
+	})
+	for _, name := range settled {
+		p := w.pending[name]
+		delete(w.pending, name)
+		if version, ok := w.stat(name); !ok || version != p.version {
+			w.note(name)
+			continue
+		}
+		if err := w.send(ctx, name, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends the pending file name. If that fails, the file is put back to
+// be sent again after a growing delay, unless it changes meanwhile. Only the
+// end of the session or of ctx is returned.
+func (w *watcher) send(ctx context.Context, name string, p pendingFile) error {
+	path := filepath.Join(w.dir, name)
+	src, err := FileSource(path)
+	var result *SendResult
+	if err == nil {
+		result, err = w.sess.Send(ctx, src)
+	}
+	switch {
+	case err == nil:
+		if err := w.record.add(name, p.version, result); err != nil {
+			return err
+		}
+		w.report(path, result, nil)
+		return nil
+	case errors.Is(err, protocol.ErrDeclined):
+		w.declined[name] = p.version
+		w.report(path, nil, err)
+		return nil
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case errors.Is(err, p2p.ErrDisconnected) && w.ended():
+		return err
+	}
+
+	delay := max(p.delay, minRetryDelay)
+	w.sess.node.Logger.Warn("failed to send watched file", "path", path, "retry", delay, "err", err)
+	w.opts.emit(Event{Kind: EventRetrying, Peer: w.sess.Peer(), Metadata: &protocol.Metadata{Filename: name}, Error: err.Error()})
+	p.retry = time.Now().Add(delay)
+	p.delay = min(2*delay, maxRetryDelay)
+	w.pending[name] = p
+	return nil
+}
+
+// ended reports whether the session is over, as opposed to reconnecting.
+func (w *watcher) ended() bool {
+	select {
+	case <-w.sess.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *watcher) report(path string, result *SendResult, err error) {
+	if w.watchOpts.OnSend != nil {
+		w.watchOpts.OnSend(path, result, err)
+	}
+}
+
+// recordEntry is a line of the record of sent files.
+type recordEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+	Peer    peer.ID   `json:"peer"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// sendRecord is the record of the files sent from a watched directory, a
+// JSON object per line appended as each file is sent.
+type sendRecord struct {
+	file *os.File
+	sent map[string]fileVersion
+}
+
+func openRecord(path string) (*sendRecord, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open record: %w", err)
+	}
+	r := &sendRecord{file: file, sent: make(map[string]fileVersion)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry recordEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line cut short by a crash only costs sending its file again
+			continue
+		}
+		r.sent[entry.Name] = fileVersion{size: entry.Size, modTime: entry.ModTime.UnixNano()}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read record: %w", err)
+	}
+	// Start on a line of its own after a line cut short
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			file.Write([]byte{'\n'})
+		}
+	}
+	return r, nil
+}
+
+func (r *sendRecord) has(name string, version fileVersion) bool {
+	sent, ok := r.sent[name]
+	return ok && sent == version
+}
+
+func (r *sendRecord) add(name string, version fileVersion, result *SendResult) error {
+	line, err := json.Marshal(recordEntry{
+		Name:    name,
+		Size:    version.size,
+		ModTime: time.Unix(0, version.modTime),
+		SHA256:  utils.BytesToHex(result.Hash),
+		Peer:    result.Peer,
+		SentAt:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to record %s: %w", name, err)
+	}
+	if err := r.file.Sync(); err != nil {
+		return fmt.Errorf("failed to record %s: %w", name, err)
+	}
+	r.sent[name] = version
+	return nil
+}
+
+func (r *sendRecord) close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/urfave/cli/v2"
+)
+
+var policyFlags = []cli.Flag{
+	&cli.StringFlag{Name: "max-size", Usage: "decline files larger than `SIZE`, such as 2GB or 512MiB"},
+	&cli.StringSliceFlag{Name: "allow-ext", Usage: "only accept files with one of these extensions, such as pdf,tar.gz"},
+	&cli.StringSliceFlag{Name: "deny-ext", Usage: "decline files with one of these extensions"},
+	&cli.StringSliceFlag{Name: "allow-type", Usage: "only accept files of one of these MIME types, such as image/*, guessed from the extension"},
+	&cli.StringSliceFlag{Name: "deny-type", Usage: "decline files of one of these MIME types"},
+	&cli.StringSliceFlag{Name: "trust", Usage: "accept files from the sender with peer `ID` without asking"},
+	&cli.StringFlag{Name: "expect-sha256", Usage: "decline the file unless its SHA-256 checksum is `HEX`"},
+}
+
+// newPolicy returns the policy selected by the policy flags, or nil without
+// any.
+func newPolicy(c *cli.Context) (*peerlink.Policy, error) {
+	set := false
+	for _, flag := range policyFlags {
+		set = set || c.IsSet(flag.Names()[0])
+	}
+	if !set {
+		return nil, nil
+	}
+
+	policy := &peerlink.Policy{
+		AllowExtensions: c.StringSlice("allow-ext"),
+		DenyExtensions:  c.StringSlice("deny-ext"),
+		AllowTypes:      c.StringSlice("allow-type"),
+		DenyTypes:       c.StringSlice("deny-type"),
+	}
+	if c.IsSet("max-size") {
+		size, err := rw.ParseSize(c.String("max-size"))
+		if err != nil {
+			return nil, fmt.Errorf("%w: --max-size: %w", errUsage, err)
+		}
+		policy.MaxSize = size
+	}
+	for _, id := range c.StringSlice("trust") {
+		sender, err := peer.Decode(id)
+		if err != nil {
+			return nil, fmt.Errorf("%w: --trust: invalid peer ID %q: %w", errUsage, id, err)
+		}
+		policy.Trusted = append(policy.Trusted, sender)
+	}
+	if c.IsSet("expect-sha256") {
+		hash, err := utils.HexToBytes(c.String("expect-sha256"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%w: --expect-sha256 takes the 64 hex digits of a SHA-256 checksum", errUsage)
+		}
+		policy.ExpectHash = hash
+	}
+	return policy, nil
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// ServeChunks answers chunk requests read from stream with the matching
+// ranges of file until the receiver closes the stream, and returns the
+// number of bytes served. Progress is counted on meter, which may be nil.
+func ServeChunks(ctx context.Context, stream network.Stream, file io.ReadSeeker, m *Manifest, key []byte, meter *rw.Meter, logger *slog.Logger) (served int64, err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+	defer meter.Finish()
+
+	writer := bufio.NewWriter(stream)
+	pwriter := rw.NewPWriter(writer, key)
+	preader := rw.NewPReader(bufio.NewReader(stream), key)
+
+	if err := m.validate(); err != nil {
+		return 0, fmt.Errorf("ServeChunks: %w", err)
+	}
+	request := make([]byte, 8)
+	buf := make([]byte, m.ChunkSize)
+	for {
+		if _, err := io.ReadFull(preader, request); err != nil {
+			if errors.Is(err, io.EOF) {
+				return served, nil
+			}
+			return served, fmt.Errorf("ServeChunks: failed to read request: %w", integrityError(err))
+		}
+		index := binary.BigEndian.Uint64(request)
+		if index >= uint64(len(m.Chunks)) {
+			return served, fmt.Errorf("ServeChunks: requested chunk %d of %d", index, len(m.Chunks))
+		}
+
+		off, length := m.ChunkRange(int(index))
+		if _, err := file.Seek(off, io.SeekStart); err != nil {
+			return served, fmt.Errorf("ServeChunks: failed to seek to chunk %d: %w", index, err)
+		}
+		if _, err := io.ReadFull(file, buf[:length]); err != nil {
+			return served, fmt.Errorf("ServeChunks: failed to read chunk %d: %w", index, err)
+		}
+		if _, err := pwriter.Write(buf[:length]); err != nil {
+			return served, fmt.Errorf("ServeChunks: failed to write chunk %d: %w", index, err)
+		}
+		if err := writer.Flush(); err != nil {
+			return served, fmt.Errorf("ServeChunks: failed to flush writer: %w", err)
+		}
+		meter.Write(buf[:length])
+		served += length
+		logger.Debug("served chunk", "index", index, "bytes", length)
+	}
+}
+
+// ChunkStream requests chunks of a manifest from one provider over a single
+// stream.
+type ChunkStream struct {
+	stream   network.Stream
+	writer   *bufio.Writer
+	pwriter  *rw.PWriter
+	preader  *rw.PReader
+	manifest *Manifest
+	logger   *slog.Logger
+}
+
+// NewChunkStream prepares stream for requesting chunks of m.
+func NewChunkStream(stream network.Stream, m *Manifest, key []byte, logger *slog.Logger) *ChunkStream {
+	writer := bufio.NewWriter(stream)
+	return &ChunkStream{
+		stream:   stream,
+		writer:   writer,
+		pwriter:  rw.NewPWriter(writer, key),
+		preader:  rw.NewPReader(bufio.NewReader(stream), key),
+		manifest: m,
+		logger:   logger,
+	}
+}
+
+// Fetch requests chunk index into buf, which must hold a whole chunk, and
+// returns it after verifying it against the manifest. A chunk that does not
+// match yields ErrIntegrity.
+func (c *ChunkStream) Fetch(ctx context.Context, index int, buf []byte) (_ []byte, err error) {
+	defer guard(ctx, c.stream, &err)()
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint64(request, uint64(index))
+	if _, err := c.pwriter.Write(request); err != nil {
+		return nil, fmt.Errorf("Fetch: failed to request chunk %d: %w", index, err)
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, fmt.Errorf("Fetch: failed to flush writer: %w", err)
+	}
+
+	_, length := c.manifest.ChunkRange(index)
+	chunk := buf[:length]
+	if _, err := io.ReadFull(c.preader, chunk); err != nil {
+		return nil, fmt.Errorf("Fetch: failed to read chunk %d: %w", index, integrityError(err))
+	}
+	if sum := sha256.Sum256(chunk); !bytes.Equal(sum[:], c.manifest.Chunks[index]) {
+		c.logger.Warn("chunk checksum mismatch", "index", index, "expected", utils.BytesToHex(c.manifest.Chunks[index]), "actual", utils.BytesToHex(sum[:]))
+		return nil, fmt.Errorf("Fetch: chunk %d does not match the manifest: %w", index, ErrIntegrity)
+	}
+	return chunk, nil
+}
+
+// Close tells the provider no more chunks will be requested.
+func (c *ChunkStream) Close() error {
+	return c.stream.Close()
+}
@@ -2,16 +2,25 @@ package protocol
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"log/slog"
 
 	"github.com/SyedMa3/peerlink/rw"
 	"github.com/libp2p/go-libp2p/core/network"
 )
 
-func SendCompleteCheck(stream network.Stream, key []byte) error {
+// SendCompleteCheck tells the sender whether the file arrived intact.
+func SendCompleteCheck(ctx context.Context, stream network.Stream, key []byte, ok bool, logger *slog.Logger) (err error) {
+	defer guard(ctx, stream, &err)()
+
 	writer := bufio.NewWriter(stream)
 	pwriter := rw.NewPWriter(writer, key)
-	_, err := pwriter.Write([]byte("y"))
+	answer := "y"
+	if !ok {
+		answer = "n"
+	}
+	_, err = pwriter.Write([]byte(answer))
 	if err != nil {
 		return fmt.Errorf("SendCompleteCheck: failed to send confirmation: %w", err)
 	}
@@ -19,15 +28,24 @@ func SendCompleteCheck(stream network.Stream, key []byte) error {
 	if err != nil {
 		return fmt.Errorf("SendCompleteCheck: failed to flush writer: %w", err)
 	}
+	logger.Debug("sent completion confirmation", "ok", ok)
 	return nil
 }
 
-func ReceiveCompleteCheck(stream network.Stream, key []byte) error {
+// ReceiveCompleteCheck waits for the receiver's verdict on the transfer and
+// returns ErrIntegrity if the file did not arrive intact.
+func ReceiveCompleteCheck(ctx context.Context, stream network.Stream, key []byte, logger *slog.Logger) (err error) {
+	defer guard(ctx, stream, &err)()
+
 	reader := rw.NewPReader(stream, key)
 	confirmation := make([]byte, 1)
-	_, err := reader.Read(confirmation)
+	_, err = reader.Read(confirmation)
 	if err != nil {
-		return fmt.Errorf("ReceiveCompleteCheck: failed to read confirmation: %w", err)
+		return fmt.Errorf("ReceiveCompleteCheck: failed to read confirmation: %w", integrityError(err))
+	}
+	logger.Debug("received completion confirmation", "answer", string(confirmation))
+	if string(confirmation) != "y" {
+		return fmt.Errorf("ReceiveCompleteCheck: receiver reported a corrupted file: %w", ErrIntegrity)
 	}
 	return nil
 }
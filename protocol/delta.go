@@ -0,0 +1,454 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Bounds of the block size signatures are built with.
+const (
+	minBlockSize = 2 << 10
+	maxBlockSize = 128 << 10
+)
+
+// strongSize is how many bytes of a block's SHA-256 a signature keeps. The
+// whole file is checked against its full checksum after the delta is
+// applied, so a rare collision cannot go unnoticed.
+const strongSize = 16
+
+// Operations of a delta.
+const (
+	deltaCopy    = 'c'
+	deltaLiteral = 'd'
+	deltaEnd     = 'e'
+)
+
+// maxPathLength bounds the path in a delta request.
+const maxPathLength = 4096
+
+// MaxSignatureBlocks bounds the blocks of a signature a sender accepts.
+// Copies with more blocks are rebuilt without reusing anything.
+const MaxSignatureBlocks = 1 << 23
+
+// BlockSum is the checksum pair of one block of a file: a weak rolling
+// checksum to find candidate matches cheaply and a strong one to confirm
+// them.
+type BlockSum struct {
+	Weak   uint32
+	Strong [strongSize]byte
+}
+
+// Signature lists the checksums of the blocks of the receiver's copy of a
+// file. The sender finds those blocks in its own copy wherever they moved
+// and only sends the bytes in between.
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []BlockSum
+}
+
+// BlockSize picks the block size for a file of size bytes: about the square
+// root of the size, like rsync, so that larger files get fewer, larger
+// blocks.
+func BlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	bs = (bs + 1023) &^ 1023
+	return min(max(bs, minBlockSize), maxBlockSize)
+}
+
+// BuildSignature reads r, the size byte content of the receiver's copy, to
+// the end and returns its signature.
+func BuildSignature(r io.Reader, size int64) (*Signature, error) {
+	sig := &Signature{BlockSize: BlockSize(size)}
+	buf := make([]byte, sig.BlockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, BlockSum{Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("BuildSignature: failed to read data: %w", err)
+		}
+	}
+}
+
+// blockRange returns the offset and length of block i.
+func (s *Signature) blockRange(i int) (int64, int) {
+	off := int64(i) * int64(s.BlockSize)
+	return off, int(min(int64(s.BlockSize), s.Size-off))
+}
+
+// weakSum is the rsync rolling checksum of block.
+func weakSum(block []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | b<<16
+}
+
+func strongSum(block []byte) [strongSize]byte {
+	sum := sha256.Sum256(block)
+	return [strongSize]byte(sum[:strongSize])
+}
+
+// DeltaStats counts how a file was rebuilt from a delta.
+type DeltaStats struct {
+	// Literal is the number of bytes sent as they are and Matched the
+	// number reused from the receiver's copy.
+	Literal int64
+	Matched int64
+}
+
+// RequestDelta asks the sender for the delta turning base, the receiver's
+// copy of the file at path described by sig, into the sender's copy of size
+// bytes, and writes the result to w. It returns the size and SHA-256
+// checksum of what was written. A delta rebuilding more than size bytes
+// fails with ErrIntegrity as soon as it goes over. Progress is counted on
+// meter, which may be nil.
+func RequestDelta(ctx context.Context, stream network.Stream, path string, size int64, sig *Signature, base io.ReaderAt, w io.Writer, key []byte, meter *rw.Meter, logger *slog.Logger) (_ int64, _ []byte, _ DeltaStats, err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+	defer meter.Finish()
+
+	var stats DeltaStats
+	if len(path) > maxPathLength {
+		return 0, nil, stats, fmt.Errorf("RequestDelta: path too long: %d bytes", len(path))
+	}
+
+	// Send the request: the path and the signature of our copy
+	writer := bufio.NewWriter(stream)
+	request := bufio.NewWriterSize(rw.NewPWriter(writer, key), rw.MaxFrameSize)
+	binary.Write(request, binary.BigEndian, uint16(len(path)))
+	request.WriteString(path)
+	binary.Write(request, binary.BigEndian, uint32(sig.BlockSize))
+	binary.Write(request, binary.BigEndian, sig.Size)
+	binary.Write(request, binary.BigEndian, uint32(len(sig.Blocks)))
+	for _, block := range sig.Blocks {
+		binary.Write(request, binary.BigEndian, block.Weak)
+		request.Write(block.Strong[:])
+	}
+	if err := request.Flush(); err != nil {
+		return 0, nil, stats, fmt.Errorf("RequestDelta: failed to write request: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, nil, stats, fmt.Errorf("RequestDelta: failed to flush writer: %w", err)
+	}
+
+	// Apply the delta as it arrives
+	reader := bufio.NewReaderSize(rw.NewPReader(bufio.NewReader(stream), key), rw.MaxFrameSize)
+	checksum := sha256.New()
+	out := io.MultiWriter(w, checksum, meter)
+	buf := make([]byte, max(sig.BlockSize, rw.MaxFrameSize))
+	var written int64
+	tooLong := func(length int) error {
+		if written+int64(length) > size {
+			return fmt.Errorf("RequestDelta: sender rebuilt more than the %d bytes of the file: %w", size, ErrIntegrity)
+		}
+		return nil
+	}
+	for {
+		op, err := reader.ReadByte()
+		if err != nil {
+			return written, nil, stats, fmt.Errorf("RequestDelta: failed to read delta: %w", integrityError(err))
+		}
+		switch op {
+		case deltaCopy:
+			var header struct{ Index, Count uint32 }
+			if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+				return written, nil, stats, fmt.Errorf("RequestDelta: failed to read delta: %w", integrityError(err))
+			}
+			if uint64(header.Index)+uint64(header.Count) > uint64(len(sig.Blocks)) {
+				return written, nil, stats, fmt.Errorf("RequestDelta: sender referenced blocks %d+%d of %d", header.Index, header.Count, len(sig.Blocks))
+			}
+			for i := int(header.Index); i < int(header.Index+header.Count); i++ {
+				off, length := sig.blockRange(i)
+				if err := tooLong(length); err != nil {
+					return written, nil, stats, err
+				}
+				if n, err := base.ReadAt(buf[:length], off); n < length {
+					return written, nil, stats, fmt.Errorf("RequestDelta: failed to read block %d of the existing copy: %w", i, err)
+				}
+				if _, err := out.Write(buf[:length]); err != nil {
+					return written, nil, stats, fmt.Errorf("RequestDelta: failed to write data: %w", err)
+				}
+				written += int64(length)
+				stats.Matched += int64(length)
+			}
+		case deltaLiteral:
+			var length uint32
+			if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+				return written, nil, stats, fmt.Errorf("RequestDelta: failed to read delta: %w", integrityError(err))
+			}
+			if length > uint32(len(buf)) {
+				return written, nil, stats, fmt.Errorf("RequestDelta: literal of %d bytes is too large", length)
+			}
+			if err := tooLong(int(length)); err != nil {
+				return written, nil, stats, err
+			}
+			if _, err := io.ReadFull(reader, buf[:length]); err != nil {
+				return written, nil, stats, fmt.Errorf("RequestDelta: failed to read delta: %w", integrityError(err))
+			}
+			if _, err := out.Write(buf[:length]); err != nil {
+				return written, nil, stats, fmt.Errorf("RequestDelta: failed to write data: %w", err)
+			}
+			written += int64(length)
+			stats.Literal += int64(length)
+		case deltaEnd:
+			logger.Debug("applied delta", "path", path, "literal", stats.Literal, "matched", stats.Matched)
+			return written, checksum.Sum(nil), stats, nil
+		default:
+			return written, nil, stats, fmt.Errorf("RequestDelta: unknown delta operation %q", op)
+		}
+	}
+}
+
+// DeltaRequest is what the receiver asks ServeDelta for.
+type DeltaRequest struct {
+	Path      string
+	Signature *Signature
+}
+
+// ServeDelta reads a delta request from stream, asks open for the file it
+// names and sends the delta turning the receiver's copy into it. open may
+// refuse paths it does not serve; otherwise it also returns the meter
+// progress is counted on, which may be nil.
+func ServeDelta(ctx context.Context, stream network.Stream, open func(path string) (io.ReadCloser, *rw.Meter, error), key []byte, logger *slog.Logger) (_ *DeltaRequest, _ DeltaStats, err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+
+	var stats DeltaStats
+	reader := bufio.NewReaderSize(rw.NewPReader(bufio.NewReader(stream), key), rw.MaxFrameSize)
+	req, err := readDeltaRequest(reader)
+	if err != nil {
+		return nil, stats, fmt.Errorf("ServeDelta: failed to read request: %w", integrityError(err))
+	}
+
+	file, meter, err := open(req.Path)
+	if err != nil {
+		return req, stats, fmt.Errorf("ServeDelta: %w", err)
+	}
+	defer file.Close()
+	defer meter.Finish()
+
+	writer := bufio.NewWriter(stream)
+	out := bufio.NewWriterSize(rw.NewPWriter(writer, key), rw.MaxFrameSize)
+	d := &deltaEncoder{w: out, meter: meter}
+	if err := d.encode(file, req.Signature); err != nil {
+		return req, d.stats, fmt.Errorf("ServeDelta: %w", err)
+	}
+	if err := out.Flush(); err != nil {
+		return req, d.stats, fmt.Errorf("ServeDelta: failed to write delta: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return req, d.stats, fmt.Errorf("ServeDelta: failed to flush writer: %w", err)
+	}
+	logger.Debug("sent delta", "path", req.Path, "literal", d.stats.Literal, "matched", d.stats.Matched)
+	return req, d.stats, nil
+}
+
+func readDeltaRequest(r io.Reader) (*DeltaRequest, error) {
+	var pathLength uint16
+	if err := binary.Read(r, binary.BigEndian, &pathLength); err != nil {
+		return nil, err
+	}
+	if pathLength > maxPathLength {
+		return nil, fmt.Errorf("path too long: %d bytes", pathLength)
+	}
+	path := make([]byte, pathLength)
+	if _, err := io.ReadFull(r, path); err != nil {
+		return nil, err
+	}
+	var header struct {
+		BlockSize uint32
+		Size      int64
+		Blocks    uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	sig := &Signature{BlockSize: int(header.BlockSize), Size: header.Size}
+	if sig.BlockSize < minBlockSize || sig.BlockSize > maxBlockSize || sig.Size < 0 {
+		return nil, fmt.Errorf("invalid block size %d or size %d", sig.BlockSize, sig.Size)
+	}
+	if want := (sig.Size + int64(sig.BlockSize) - 1) / int64(sig.BlockSize); int64(header.Blocks) != want {
+		return nil, fmt.Errorf("signature lists %d blocks, expected %d", header.Blocks, want)
+	}
+	if header.Blocks > MaxSignatureBlocks {
+		return nil, fmt.Errorf("signature lists %d blocks, more than %d", header.Blocks, MaxSignatureBlocks)
+	}
+	// The blocks are counted by the peer, so the list only grows as they
+	// arrive
+	sig.Blocks = make([]BlockSum, 0, min(header.Blocks, 1<<12))
+	for range header.Blocks {
+		var block BlockSum
+		if err := binary.Read(r, binary.BigEndian, &block.Weak); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, block.Strong[:]); err != nil {
+			return nil, err
+		}
+		sig.Blocks = append(sig.Blocks, block)
+	}
+	return &DeltaRequest{Path: string(path), Signature: sig}, nil
+}
+
+// deltaEncoder writes the operations rebuilding a file from the blocks of a
+// signature and literal data.
+type deltaEncoder struct {
+	w     *bufio.Writer
+	meter *rw.Meter
+	stats DeltaStats
+	// run is a pending copy of consecutive blocks, merged into one
+	// operation.
+	runStart, runCount uint32
+}
+
+// encode slides a window the size of a block over r one byte at a time.
+// Whenever the window matches a block of sig, the bytes before it go out as
+// a literal, the block as a copy, and the window jumps past it.
+func (d *deltaEncoder) encode(r io.Reader, sig *Signature) error {
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+
+	bs := sig.BlockSize
+	// buf[:pos] is the pending literal and buf[pos:pos+n] the window.
+	buf := make([]byte, 0, rw.MaxFrameSize+2*bs)
+	pos := 0
+	eof := false
+	fill := func() error {
+		for !eof && len(buf)-pos <= bs {
+			m, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+m]
+			if errors.Is(err, io.EOF) {
+				eof = true
+			} else if err != nil {
+				return fmt.Errorf("failed to read file: %w", err)
+			}
+		}
+		return nil
+	}
+
+	var a, b uint32
+	rolling := false
+	for {
+		if err := fill(); err != nil {
+			return err
+		}
+		n := min(bs, len(buf)-pos)
+		if n == 0 {
+			break
+		}
+		window := buf[pos : pos+n]
+		if !rolling {
+			sum := weakSum(window)
+			a, b = sum&0xffff, sum>>16
+			rolling = true
+		}
+
+		if match := d.find(index[a&0xffff|b<<16], sig, window); match >= 0 {
+			if err := d.literal(buf[:pos]); err != nil {
+				return err
+			}
+			d.copyBlock(uint32(match), n)
+			buf = buf[:copy(buf, buf[pos+n:])]
+			pos = 0
+			rolling = false
+			continue
+		}
+
+		// Slide the window by one byte; at the end of the file it
+		// shrinks instead.
+		out := uint32(buf[pos])
+		a -= out
+		b -= uint32(n) * out
+		if pos+n < len(buf) {
+			a += uint32(buf[pos+n])
+			b += a
+		}
+		a &= 0xffff
+		b &= 0xffff
+		pos++
+		if pos >= rw.MaxFrameSize {
+			if err := d.literal(buf[:pos]); err != nil {
+				return err
+			}
+			buf = buf[:copy(buf, buf[pos:])]
+			pos = 0
+		}
+	}
+	if err := d.literal(buf[:pos]); err != nil {
+		return err
+	}
+	d.flushRun()
+	return d.w.WriteByte(deltaEnd)
+}
+
+// find returns the block among candidates matching window, or -1.
+func (d *deltaEncoder) find(candidates []int, sig *Signature, window []byte) int {
+	if len(candidates) == 0 {
+		return -1
+	}
+	strong := strongSum(window)
+	for _, i := range candidates {
+		if _, length := sig.blockRange(i); length == len(window) && sig.Blocks[i].Strong == strong {
+			return i
+		}
+	}
+	return -1
+}
+
+// copyBlock adds a block of the receiver's copy to the output. Write errors
+// stick to the buffered writer and surface when it is flushed.
+func (d *deltaEncoder) copyBlock(index uint32, length int) {
+	d.meter.Add(int64(length))
+	d.stats.Matched += int64(length)
+	if d.runCount > 0 && d.runStart+d.runCount == index {
+		d.runCount++
+		return
+	}
+	d.flushRun()
+	d.runStart, d.runCount = index, 1
+}
+
+func (d *deltaEncoder) flushRun() {
+	if d.runCount == 0 {
+		return
+	}
+	d.w.WriteByte(deltaCopy)
+	binary.Write(d.w, binary.BigEndian, [2]uint32{d.runStart, d.runCount})
+	d.runCount = 0
+}
+
+func (d *deltaEncoder) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	d.flushRun()
+	d.w.WriteByte(deltaLiteral)
+	binary.Write(d.w, binary.BigEndian, uint32(len(data)))
+	if _, err := d.w.Write(data); err != nil {
+		return fmt.Errorf("failed to write delta: %w", err)
+	}
+	d.meter.Write(data)
+	d.stats.Literal += int64(len(data))
+	return nil
+}
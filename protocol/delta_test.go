@@ -0,0 +1,36 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// deltaRequest encodes the header of a delta request for a signature of
+// blocks blocks of blockSize bytes, followed by data.
+func deltaRequest(blockSize uint32, blocks uint32, data []byte) *bytes.Reader {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(1))
+	buf.WriteString("a")
+	binary.Write(&buf, binary.BigEndian, blockSize)
+	binary.Write(&buf, binary.BigEndian, int64(blockSize)*int64(blocks))
+	binary.Write(&buf, binary.BigEndian, blocks)
+	buf.Write(data)
+	return bytes.NewReader(buf.Bytes())
+}
+
+func TestReadDeltaRequest(t *testing.T) {
+	block := make([]byte, 4+strongSize)
+	req, err := readDeltaRequest(deltaRequest(minBlockSize, 2, append(block, block...)))
+	if err != nil || len(req.Signature.Blocks) != 2 {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := readDeltaRequest(deltaRequest(minBlockSize, MaxSignatureBlocks+1, nil)); err == nil {
+		t.Error("accepted a signature with too many blocks")
+	}
+	// A signature announcing more blocks than it holds fails once the data
+	// runs out
+	if _, err := readDeltaRequest(deltaRequest(minBlockSize, MaxSignatureBlocks, block)); err == nil {
+		t.Error("accepted a truncated signature")
+	}
+}
@@ -0,0 +1,22 @@
+package protocol
+
+import "errors"
+
+var (
+	// ErrInvalidCode is returned for codes that are not five words.
+	ErrInvalidCode = errors.New("invalid code: exactly five words are required")
+	// ErrDeclined is returned when the receiver turns the transfer down.
+	ErrDeclined = errors.New("receiver declined the file transfer")
+	// ErrWrongCode is returned when the peers used different codes and
+	// therefore derived different session keys.
+	ErrWrongCode = errors.New("wrong code: the peers could not agree on a session key")
+	// ErrBusy is returned when the sender is serving as many receivers as
+	// it allows and asks the receiver to come back later.
+	ErrBusy = errors.New("sender is busy with other receivers")
+	// ErrTimeout is returned when an operation ran out of time, either
+	// because its context expired or because the peer went silent.
+	ErrTimeout = errors.New("operation timed out")
+	// ErrIntegrity is returned when received data does not match what the
+	// sender announced.
+	ErrIntegrity = errors.New("file integrity check failed")
+)
@@ -3,81 +3,184 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"os"
+	"log/slog"
 
 	"github.com/SyedMa3/peerlink/rw"
 	"github.com/SyedMa3/peerlink/utils"
 	"github.com/libp2p/go-libp2p/core/network"
 )
 
-func SendFile(stream network.Stream, filePath string, key []byte) {
-	defer stream.Close()
+// MaxStreams is the most streams a file may be split across.
+const MaxStreams = 16
 
-	file, err := os.Open(filePath)
-	if err != nil {
-		fmt.Printf("sendFile: failed to open file: %v", err)
-		return
+// Range is the part of a file requested over one file transfer stream.
+type Range struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	// Streams is the number of streams the receiver split the file across.
+	Streams int `json:"streams"`
+}
+
+// SplitRanges splits a file of size bytes into at most n contiguous ranges
+// of nearly equal length.
+func SplitRanges(size int64, n int) []Range {
+	n = int(max(1, min(int64(n), size)))
+	ranges := make([]Range, n)
+	var off int64
+	for i := range ranges {
+		length := size / int64(n)
+		if int64(i) < size%int64(n) {
+			length++
+		}
+		ranges[i] = Range{Offset: off, Length: length, Streams: n}
+		off += length
 	}
-	defer file.Close()
+	return ranges
+}
 
-	// Calculate the hash of the file
-	hash, err := utils.CalculateFileHash(file)
-	if err != nil {
-		fmt.Printf("sendFile: failed to calculate file hash: %v", err)
-		return
+// Index returns the position of r among the ranges SplitRanges makes of a
+// file of size bytes across r.Streams streams, or -1 if r is not one of
+// them.
+func (r Range) Index(size int64) int {
+	if r.Streams < 1 || r.Streams > MaxStreams {
+		return -1
+	}
+	for i, rng := range SplitRanges(size, r.Streams) {
+		if rng == r {
+			return i
+		}
 	}
+	return -1
+}
 
-	// Send the hash to the receiver
-	hashWriter := bufio.NewWriter(stream)
-	_, err = hashWriter.Write(hash)
+// SendFile reads the range the receiver asks for and sends its checksum,
+// the checksum of the whole file, and then the encrypted range. It returns
+// the range sent, the number of bytes sent and the checksum of the whole
+// file. fileHash is only called when the range does not cover the whole
+// file. Progress is counted on meter, which may be nil.
+func SendFile(ctx context.Context, stream network.Stream, file io.ReadSeeker, size int64, key []byte, fileHash func() ([]byte, error), meter *rw.Meter, logger *slog.Logger) (_ Range, _ int64, _ []byte, err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+
+	// Read the requested range
+	request := make([]byte, rw.MaxFrameSize)
+	n, err := rw.NewPReader(stream, key).Read(request)
 	if err != nil {
-		fmt.Printf("sendFile: failed to send file hash: %v", err)
-		return
+		return Range{}, 0, nil, fmt.Errorf("sendFile: failed to read range request: %w", integrityError(err))
 	}
-	err = hashWriter.Flush()
-	if err != nil {
-		fmt.Printf("sendFile: failed to flush hash writer: %v", err)
-		return
+	var rng Range
+	if err := json.Unmarshal(request[:n], &rng); err != nil {
+		return Range{}, 0, nil, fmt.Errorf("sendFile: failed to unmarshal range request: %w", err)
+	}
+	if rng.Index(size) < 0 {
+		return rng, 0, nil, fmt.Errorf("sendFile: invalid range %+v of a %d byte file", rng, size)
 	}
 
-	// Reset the file pointer to the beginning
-	_, err = file.Seek(0, 0)
+	// Calculate the hash of the range
+	if _, err := file.Seek(rng.Offset, io.SeekStart); err != nil {
+		return rng, 0, nil, fmt.Errorf("sendFile: failed to seek to range: %w", err)
+	}
+	hash, err := utils.CalculateHash(io.LimitReader(file, rng.Length))
 	if err != nil {
-		fmt.Printf("sendFile: failed to reset file pointer: %v", err)
-		return
+		return rng, 0, nil, fmt.Errorf("sendFile: failed to calculate range hash: %w", err)
 	}
+	whole := hash
+	if rng.Length != size {
+		if whole, err = fileHash(); err != nil {
+			return rng, 0, nil, fmt.Errorf("sendFile: failed to calculate file hash: %w", err)
+		}
+	}
+	logger.Debug("calculated range hash", "offset", rng.Offset, "length", rng.Length, "sha256", utils.BytesToHex(hash))
 
-	fmt.Printf("Sending file: %s\n", filePath)
-
+	// Send both hashes to the receiver
 	w := bufio.NewWriter(stream)
-	_, err = rw.WriteData(file, key, w)
+	if _, err := rw.NewPWriter(w, key).Write(append(hash, whole...)); err != nil {
+		return rng, 0, nil, fmt.Errorf("sendFile: failed to send range hash: %w", err)
+	}
+
+	// Go back to the start of the range
+	if _, err := file.Seek(rng.Offset, io.SeekStart); err != nil {
+		return rng, 0, nil, fmt.Errorf("sendFile: failed to reset file pointer: %w", err)
+	}
+
+	sent, err := rw.WriteData(io.LimitReader(file, rng.Length), key, w, meter, logger)
 	if err != nil {
-		fmt.Printf("sendFile: failed to write data: %v", err)
-		return
+		return rng, sent, nil, fmt.Errorf("sendFile: failed to write data: %w", err)
 	}
 	err = w.Flush()
 	if err != nil {
-		fmt.Printf("sendFile: failed to flush writer: %v", err)
-		return
+		return rng, sent, nil, fmt.Errorf("sendFile: failed to flush writer: %w", err)
 	}
-	fmt.Println("File sent successfully")
+	return rng, sent, whole, nil
 }
 
-func ReceiveFile(stream network.Stream, file *os.File, key []byte) error {
-	// Read the SHA256 checksum of the file from the stream
-	checksum := make([]byte, 32) // SHA256 produces a 32-byte hash
-	_, err := io.ReadFull(stream, checksum)
+// ReceiveFile asks for rng of the file, writes it into w and verifies it
+// against the checksum announced by the sender. It returns the number of
+// bytes received and the checksum of the whole file. When rng is the whole
+// file, that is the checksum of the data received, which must match the one
+// announced; otherwise it is the one the sender announced, which the caller
+// has to check against the assembled file. Progress is counted on meter,
+// which may be nil.
+func ReceiveFile(ctx context.Context, stream network.Stream, w io.Writer, rng Range, key []byte, meter *rw.Meter, logger *slog.Logger) (_ int64, _ []byte, err error) {
+	defer guard(ctx, stream, &err)()
+
+	// Request the range
+	request, err := json.Marshal(rng)
 	if err != nil {
-		fmt.Printf("receiveFile: failed to read file checksum: %v", err)
+		return 0, nil, fmt.Errorf("receiveFile: failed to marshal range request: %w", err)
+	}
+	writer := bufio.NewWriter(stream)
+	if _, err := rw.NewPWriter(writer, key).Write(request); err != nil {
+		return 0, nil, fmt.Errorf("receiveFile: failed to send range request: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, nil, fmt.Errorf("receiveFile: failed to flush writer: %w", err)
 	}
 
+	// Read the SHA256 checksums of the range and of the whole file
 	r := bufio.NewReader(stream)
-	calculatedChecksum := rw.ReadData(r, key, file)
+	checksums := make([]byte, 64)
+	_, err = io.ReadFull(rw.NewPReader(r, key), checksums)
+	if err != nil {
+		return 0, nil, fmt.Errorf("receiveFile: failed to read checksums: %w", integrityError(err))
+	}
+	checksum, whole := checksums[:32], checksums[32:]
+	logger.Debug("received range checksum", "offset", rng.Offset, "length", rng.Length, "sha256", utils.BytesToHex(checksum))
+
+	n, calculatedChecksum, err := rw.ReadData(r, key, &boundedWriter{w: w, left: rng.Length}, meter, logger)
+	if err != nil {
+		return n, nil, fmt.Errorf("receiveFile: %w", integrityError(err))
+	}
+
+	if n != rng.Length || !bytes.Equal(checksum, calculatedChecksum) {
+		logger.Warn("range checksum mismatch", "offset", rng.Offset, "expected", utils.BytesToHex(checksum), "actual", utils.BytesToHex(calculatedChecksum), "bytes", n)
+		return n, nil, fmt.Errorf("receiveFile: received data does not match its checksum: %w", ErrIntegrity)
+	}
+	if rng.Streams == 1 {
+		if !bytes.Equal(whole, calculatedChecksum) {
+			logger.Warn("file checksum mismatch", "expected", utils.BytesToHex(whole), "actual", utils.BytesToHex(calculatedChecksum))
+			return n, nil, fmt.Errorf("receiveFile: the range checksum does not match the file checksum: %w", ErrIntegrity)
+		}
+		return n, calculatedChecksum, nil
+	}
+	return n, whole, nil
+}
+
+// boundedWriter fails writes beyond the length of the requested range, so
+// that a sender cannot send more data than it announced.
+type boundedWriter struct {
+	w    io.Writer
+	left int64
+}
 
-	if !bytes.Equal(checksum, calculatedChecksum) {
-		return fmt.Errorf("receiveFile: received file checksum does not match")
+func (b *boundedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > b.left {
+		return 0, fmt.Errorf("sender sent more data than announced: %w", ErrIntegrity)
 	}
-	return nil
+	b.left -= int64(len(p))
+	return b.w.Write(p)
 }
@@ -0,0 +1,24 @@
+package protocol
+
+import "testing"
+
+func TestRangeIndex(t *testing.T) {
+	const size = 10
+	for i, rng := range SplitRanges(size, 3) {
+		if got := rng.Index(size); got != i {
+			t.Errorf("Index of %+v = %d, want %d", rng, got, i)
+		}
+	}
+	for _, rng := range []Range{
+		{Offset: 0, Length: size / 2, Streams: 1},
+		{Offset: 0, Length: size, Streams: 0},
+		{Offset: 0, Length: size, Streams: 2},
+		{Offset: 3, Length: 4, Streams: 3},
+		{Offset: 0, Length: 1, Streams: MaxStreams + 1},
+		{Offset: -1, Length: 1, Streams: 1},
+	} {
+		if got := rng.Index(size); got != -1 {
+			t.Errorf("Index of %+v = %d, want -1", rng, got)
+		}
+	}
+}
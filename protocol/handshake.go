@@ -1,8 +1,13 @@
 package protocol
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"log/slog"
 	"strings"
 
 	"github.com/SyedMa3/peerlink/utils"
@@ -10,54 +15,88 @@ import (
 	"github.com/schollz/pake/v3"
 )
 
-func HandleHandshake(stream network.Stream, words []string) ([]byte, error) {
+// Labels mixed into the key confirmation so that neither side can simply
+// echo the other's confirmation back.
+const (
+	senderConfirmLabel   = "peerlink sender confirmation"
+	receiverConfirmLabel = "peerlink receiver confirmation"
+)
+
+// busyMarker is sent instead of the PAKE reply when the sender turns a
+// handshake away. It can never be mistaken for PAKE bytes, which are JSON.
+var busyMarker = []byte("peerlink:busy")
+
+// RejectHandshake turns a receiver away with ErrBusy.
+func RejectHandshake(stream network.Stream) error {
+	defer stream.Close()
+	if _, err := stream.Write(busyMarker); err != nil {
+		return fmt.Errorf("rejectHandshake: failed to send busy marker: %w", err)
+	}
+	return nil
+}
+
+// HandleHandshake runs the sender's side of the PAKE handshake. It returns
+// ErrWrongCode if the receiver derived a different session key.
+func HandleHandshake(ctx context.Context, stream network.Stream, words []string, logger *slog.Logger) (_ []byte, err error) {
+	defer guard(ctx, stream, &err)()
 	defer stream.Close()
 
 	weakKey := []byte(strings.Join(words, " "))
 
 	p, err := pake.InitCurve(weakKey, 1, "siec")
 	if err != nil {
-		fmt.Printf("handleHandshake: failed to initialize PAKE: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("handleHandshake: failed to initialize PAKE: %w", err)
 	}
 
 	senderBytes, err := utils.ReadBytes(stream)
 	if err != nil {
-		fmt.Printf("handleHandshake: failed to read sender bytes: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("handleHandshake: failed to read sender bytes: %w", err)
 	}
 
 	if err := p.Update(senderBytes); err != nil {
-		fmt.Printf("handleHandshake: failed to update PAKE: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("handleHandshake: failed to update PAKE: %w", err)
 	}
+	logger.Debug("processed PAKE bytes from peer", "bytes", len(senderBytes))
 
 	receiverBytes := p.Bytes()
 	if _, err := stream.Write(receiverBytes); err != nil {
-		fmt.Printf("handleHandshake: failed to send receiver bytes: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("handleHandshake: failed to send receiver bytes: %w", err)
 	}
 
 	sessionKey, err := p.SessionKey()
 	if err != nil {
-		fmt.Printf("handleHandshake: failed to derive session key: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("handleHandshake: failed to derive session key: %w", err)
 	}
 
-	d, err := utils.ReadBytes(stream)
+	peerConfirmation, err := utils.ReadBytes(stream)
+	if err != nil {
+		return nil, fmt.Errorf("handleHandshake: failed to read key confirmation: %w", err)
+	}
+	// Always answer with our own confirmation so the receiver can tell a
+	// wrong code apart from a broken connection.
+	if _, err := stream.Write(confirmation(sessionKey, senderConfirmLabel)); err != nil {
+		return nil, fmt.Errorf("handleHandshake: failed to send key confirmation: %w", err)
+	}
+	if !hmac.Equal(peerConfirmation, confirmation(sessionKey, receiverConfirmLabel)) {
+		return nil, fmt.Errorf("handleHandshake: %w", ErrWrongCode)
+	}
+
+	_, err = utils.ReadBytes(stream)
 	if err != io.EOF {
-		if err != nil {
-			fmt.Printf("handleHandshake: unexpected data received: %v", d)
-			return nil, err
+		if err == nil {
+			return nil, fmt.Errorf("handleHandshake: unexpected data received")
 		}
-		fmt.Printf("handleHandshake: failed to read sender bytes: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("handleHandshake: failed to read sender bytes: %w", err)
 	}
 
 	return sessionKey, nil
 }
 
-func PerformHandshake(stream network.Stream, words []string) ([]byte, error) {
+// PerformHandshake runs the receiver's side of the PAKE handshake. It
+// returns ErrWrongCode if the sender derived a different session key.
+func PerformHandshake(ctx context.Context, stream network.Stream, words []string, logger *slog.Logger) (_ []byte, err error) {
+	defer guard(ctx, stream, &err)()
+
 	weakKey := []byte(strings.Join(words, " "))
 
 	p, err := pake.InitCurve(weakKey, 0, "siec")
@@ -75,15 +114,37 @@ func PerformHandshake(stream network.Stream, words []string) ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("performHandshake: failed to read PAKE bytes: %w", err)
 	}
+	if bytes.Equal(senderBytes, busyMarker) {
+		return nil, fmt.Errorf("performHandshake: %w", ErrBusy)
+	}
 
 	if err := p.Update(senderBytes); err != nil {
 		return nil, fmt.Errorf("performHandshake: failed to update PAKE: %w", err)
 	}
+	logger.Debug("processed PAKE bytes from peer", "bytes", len(senderBytes))
 
 	sessionKey, err := p.SessionKey()
 	if err != nil {
 		return nil, fmt.Errorf("performHandshake: failed to derive session key: %w", err)
 	}
 
+	if _, err := stream.Write(confirmation(sessionKey, receiverConfirmLabel)); err != nil {
+		return nil, fmt.Errorf("performHandshake: failed to send key confirmation: %w", err)
+	}
+	peerConfirmation, err := utils.ReadBytes(stream)
+	if err != nil {
+		return nil, fmt.Errorf("performHandshake: failed to read key confirmation: %w", err)
+	}
+	if !hmac.Equal(peerConfirmation, confirmation(sessionKey, senderConfirmLabel)) {
+		return nil, fmt.Errorf("performHandshake: %w", ErrWrongCode)
+	}
+
 	return sessionKey, nil
 }
+
+// confirmation proves knowledge of key without revealing it.
+func confirmation(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
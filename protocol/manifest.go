@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// DefaultChunkSize is the chunk size providers split a file into. Every
+// provider must use the same size for their manifests to match, and
+// manifests with another size are refused.
+const DefaultChunkSize = 1 << 20
+
+// maxManifestSize bounds an encoded manifest, which is enough for files of
+// over a terabyte at DefaultChunkSize.
+const maxManifestSize = 64 << 20
+
+// Manifest lists the SHA-256 checksum of every chunk of a file, so that a
+// receiver can fetch chunks from several providers and verify each of them
+// on its own.
+type Manifest struct {
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunk_size"`
+	Hash      []byte   `json:"hash"`
+	Chunks    [][]byte `json:"chunks"`
+}
+
+// BuildManifest reads r to the end and returns its manifest.
+func BuildManifest(r io.Reader, chunkSize int64) (*Manifest, error) {
+	m := &Manifest{ChunkSize: chunkSize}
+	whole := sha256.New()
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			m.Chunks = append(m.Chunks, sum[:])
+			whole.Write(buf[:n])
+			m.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("BuildManifest: failed to read data: %w", err)
+		}
+	}
+	m.Hash = whole.Sum(nil)
+	return m, nil
+}
+
+// Root returns a checksum identifying the manifest. Providers serving
+// identical content have identical roots.
+func (m *Manifest) Root() []byte {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, m.Size)
+	binary.Write(h, binary.BigEndian, m.ChunkSize)
+	h.Write(m.Hash)
+	for _, c := range m.Chunks {
+		h.Write(c)
+	}
+	return h.Sum(nil)
+}
+
+// Equal reports whether m and other describe the same content.
+func (m *Manifest) Equal(other *Manifest) bool {
+	return bytes.Equal(m.Root(), other.Root())
+}
+
+// ChunkRange returns the offset and length of chunk i.
+func (m *Manifest) ChunkRange(i int) (int64, int64) {
+	off := int64(i) * m.ChunkSize
+	return off, min(m.ChunkSize, m.Size-off)
+}
+
+// validate checks that the manifest is consistent with its own size.
+func (m *Manifest) validate() error {
+	// Any other chunk size is refused, since chunks are read into memory
+	// whole
+	if m.ChunkSize != DefaultChunkSize {
+		return fmt.Errorf("unsupported chunk size %d", m.ChunkSize)
+	}
+	if m.Size < 0 {
+		return fmt.Errorf("invalid size %d", m.Size)
+	}
+	if len(m.Hash) != sha256.Size {
+		return errors.New("malformed file checksum")
+	}
+	if want := (m.Size + m.ChunkSize - 1) / m.ChunkSize; int64(len(m.Chunks)) != want {
+		return fmt.Errorf("manifest lists %d chunks, expected %d", len(m.Chunks), want)
+	}
+	for i, c := range m.Chunks {
+		if len(c) != sha256.Size {
+			return fmt.Errorf("chunk %d has a malformed checksum", i)
+		}
+	}
+	return nil
+}
+
+// SendManifest sends the manifest to the receiver.
+func SendManifest(ctx context.Context, stream network.Stream, m *Manifest, key []byte, logger *slog.Logger) (err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("SendManifest: failed to marshal manifest: %w", err)
+	}
+	writer := bufio.NewWriter(stream)
+	_, err = rw.NewPWriter(writer, key).Write(data)
+	if err != nil {
+		return fmt.Errorf("SendManifest: failed to write manifest: %w", err)
+	}
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("SendManifest: failed to flush writer: %w", err)
+	}
+	logger.Debug("sent manifest", "chunks", len(m.Chunks), "bytes", len(data))
+	return nil
+}
+
+// ReceiveManifest reads the manifest sent by the provider.
+func ReceiveManifest(ctx context.Context, stream network.Stream, key []byte, logger *slog.Logger) (_ *Manifest, err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rw.NewPReader(bufio.NewReader(stream), key), maxManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("ReceiveManifest: failed to read manifest: %w", integrityError(err))
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("ReceiveManifest: failed to unmarshal manifest: %w", err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, fmt.Errorf("ReceiveManifest: %w", err)
+	}
+	logger.Debug("received manifest", "chunks", len(m.Chunks), "size", m.Size)
+	return &m, nil
+}
@@ -0,0 +1,31 @@
+package protocol
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestManifestValidate(t *testing.T) {
+	m, err := BuildManifest(bytes.NewReader(make([]byte, 3*DefaultChunkSize+1)), DefaultChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.validate(); err != nil {
+		t.Fatalf("valid manifest: %v", err)
+	}
+
+	for name, change := range map[string]func(*Manifest){
+		"huge chunk size":  func(m *Manifest) { m.ChunkSize = math.MaxInt64 },
+		"small chunk size": func(m *Manifest) { m.ChunkSize = 1 },
+		"negative size":    func(m *Manifest) { m.Size = -1 },
+		"missing chunk":    func(m *Manifest) { m.Chunks = m.Chunks[1:] },
+		"short checksum":   func(m *Manifest) { m.Hash = m.Hash[:8] },
+	} {
+		forged := *m
+		change(&forged)
+		if err := forged.validate(); err == nil {
+			t.Errorf("%s: manifest accepted", name)
+		}
+	}
+}
@@ -3,10 +3,13 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"strings"
+	"log/slog"
+	"time"
 
 	"github.com/SyedMa3/peerlink/rw"
 	"github.com/SyedMa3/peerlink/utils"
@@ -16,9 +19,52 @@ import (
 type Metadata struct {
 	Filename string `json:"filename"`
 	Size     int64  `json:"size"`
+	// Hash is the SHA-256 checksum of the file, which lets a receiver that
+	// already holds the content skip the transfer. Older senders omit it.
+	Hash []byte `json:"hash,omitempty"`
+	// Attrs holds the attributes of the file when the sender preserves
+	// them.
+	Attrs *Attrs `json:"attrs,omitempty"`
 }
 
-func SendMetadata(stream network.Stream, metadata Metadata, key []byte) (bool, error) {
+// Attrs are the file attributes carried along with preserved files.
+type Attrs struct {
+	// Mode holds the Unix permission bits, such as 0755.
+	Mode       uint32    `json:"mode"`
+	ModTime    time.Time `json:"mtime"`
+	AccessTime time.Time `json:"atime,omitempty"`
+	// Link is the target of a symbolic link, which is offered as a link
+	// without content instead of the file it points to.
+	Link string `json:"link,omitempty"`
+	// Xattrs holds the extended attributes in the user namespace.
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// Equal reports whether m and other describe the same file.
+func (m Metadata) Equal(other Metadata) bool {
+	return m.Filename == other.Filename && m.Size == other.Size && bytes.Equal(m.Hash, other.Hash)
+}
+
+// AcceptFunc decides whether the receiver wants the file described by metadata.
+type AcceptFunc func(ctx context.Context, metadata Metadata) (bool, error)
+
+// Answer is the receiver's reply to the offered metadata.
+type Answer byte
+
+const (
+	Declined Answer = 'n'
+	Accepted Answer = 'y'
+	// Present means that the receiver already holds the content, so the
+	// sender skips the transfer.
+	Present Answer = 'h'
+	// RelayLimited declines a file too large to receive over the limited
+	// relay connection the receiver has to the sender.
+	RelayLimited Answer = 'r'
+)
+
+// SendMetadata offers metadata to the receiver and returns its answer.
+func SendMetadata(ctx context.Context, stream network.Stream, metadata Metadata, key []byte, logger *slog.Logger) (_ Answer, err error) {
+	defer guard(ctx, stream, &err)()
 	defer stream.Close()
 
 	writer := bufio.NewWriter(stream)
@@ -30,35 +76,43 @@ func SendMetadata(stream network.Stream, metadata Metadata, key []byte) (bool, e
 	// Serialize metadata to JSON
 	metadataBytes, err := json.Marshal(metadata)
 	if err != nil {
-		return false, fmt.Errorf("SendMetadata: failed to marshal metadata: %w", err)
+		return Declined, fmt.Errorf("SendMetadata: failed to marshal metadata: %w", err)
 	}
 
 	// Send metadata
 	_, err = pwriter.Write(metadataBytes)
 	if err != nil {
-		return false, fmt.Errorf("SendMetadata: failed to write metadata: %w", err)
+		return Declined, fmt.Errorf("SendMetadata: failed to write metadata: %w", err)
 	}
 	err = writer.Flush()
 	if err != nil {
-		return false, fmt.Errorf("SendMetadata: failed to flush writer: %w", err)
+		return Declined, fmt.Errorf("SendMetadata: failed to flush writer: %w", err)
 	}
 
 	// Await confirmation from receiver
 	confirmation := make([]byte, 1)
 	_, err = preader.Read(confirmation)
-	if err != nil && err != io.EOF {
-		return false, fmt.Errorf("SendMetadata: failed to read confirmation: %w", err)
+	if err == io.EOF {
+		return Declined, fmt.Errorf("SendMetadata: receiver closed the stream without answering")
 	}
-	answer := strings.TrimSpace(strings.ToLower(string(confirmation)))
-
-	if answer == "y" {
-		return true, nil
-	} else {
-		return false, nil
+	if err != nil {
+		return Declined, fmt.Errorf("SendMetadata: failed to read confirmation: %w", integrityError(err))
+	}
+	answer := Answer(confirmation[0])
+	logger.Debug("received metadata confirmation", "answer", string(answer))
+
+	switch answer {
+	case Accepted, Present, RelayLimited:
+		return answer, nil
+	default:
+		return Declined, nil
 	}
 }
 
-func ReceiveMetadata(stream network.Stream, key []byte) (string, bool, error) {
+// ReceiveMetadata reads the sender's metadata, asks decide how to answer it
+// and reports the answer back to the sender.
+func ReceiveMetadata(ctx context.Context, stream network.Stream, key []byte, decide func(context.Context, Metadata) (Answer, error), logger *slog.Logger) (_ Metadata, _ Answer, err error) {
+	defer guard(ctx, stream, &err)()
 	defer stream.Close()
 
 	// Initialize a buffered writer and reader
@@ -69,40 +123,44 @@ func ReceiveMetadata(stream network.Stream, key []byte) (string, bool, error) {
 	preader := rw.NewPReader(reader, key)
 
 	// Read metadata JSON from the stream
-	metadataBytes := make([]byte, 1024)
-	_, err := preader.Read(metadataBytes)
+	metadataBytes := make([]byte, rw.MaxFrameSize)
+	n, err := preader.Read(metadataBytes)
 	if err != nil {
-		return "", false, fmt.Errorf("ReceiveMetadata: failed to read metadata: %w", err)
+		return Metadata{}, Declined, fmt.Errorf("ReceiveMetadata: failed to read metadata: %w", integrityError(err))
 	}
 
 	// Deserialize metadata
 	var metadata Metadata
-	err = json.Unmarshal(bytes.TrimRight(metadataBytes, "\x00"), &metadata)
+	err = json.Unmarshal(metadataBytes[:n], &metadata)
 	if err != nil {
-		return "", false, fmt.Errorf("ReceiveMetadata: failed to unmarshal metadata: %w", err)
+		return Metadata{}, Declined, fmt.Errorf("ReceiveMetadata: failed to unmarshal metadata: %w", err)
 	}
+	logger.Debug("received metadata", "filename", metadata.Filename, "size", metadata.Size)
 
-	// Prompt user for confirmation (Assuming a synchronous prompt)
-	fmt.Printf("Received file metadata:\nFilename: %s\nSize: %d bytes\nDo you want to receive this file? (y/n): ", metadata.Filename, metadata.Size)
-	response, err := utils.ReadInput()
+	answer, err := decide(ctx, metadata)
 	if err != nil {
-		return "", false, fmt.Errorf("ReceiveMetadata: failed to read user input: %w", err)
+		return metadata, Declined, fmt.Errorf("ReceiveMetadata: failed to decide on transfer: %w", err)
 	}
-	response = strings.TrimSpace(strings.ToLower(response))
 
 	// Send confirmation back to sender
-	if response != "y" {
-		response = "n"
-	}
-
-	_, err = pwriter.Write([]byte(response))
+	_, err = pwriter.Write([]byte{byte(answer)})
 	if err != nil {
-		return "", false, fmt.Errorf("ReceiveMetadata: failed to send confirmation: %w", err)
+		return metadata, Declined, fmt.Errorf("ReceiveMetadata: failed to send confirmation: %w", err)
 	}
 	err = writer.Flush()
 	if err != nil {
-		return "", false, fmt.Errorf("ReceiveMetadata: failed to flush writer: %w", err)
+		return metadata, Declined, fmt.Errorf("ReceiveMetadata: failed to flush writer: %w", err)
 	}
 
-	return metadata.Filename, response == "y", nil
+	return metadata, answer, nil
+}
+
+// integrityError marks decryption failures as ErrIntegrity. After the
+// handshake confirmed the key, they can only stem from corrupted or
+// tampered data.
+func integrityError(err error) error {
+	if errors.Is(err, utils.ErrDecrypt) {
+		return fmt.Errorf("%w: %w", ErrIntegrity, err)
+	}
+	return err
 }
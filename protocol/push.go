@@ -0,0 +1,33 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// Knock asks a receiver listening on a code to fetch the file from this
+// node. The receiver then drives the usual protocols, handshake first, over
+// streams of its own. Knock returns once the receiver took the knock.
+func Knock(ctx context.Context, stream network.Stream) (err error) {
+	defer guard(ctx, stream, &err)()
+
+	if err := stream.CloseWrite(); err != nil {
+		return fmt.Errorf("Knock: failed to close stream for writing: %w", err)
+	}
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("Knock: receiver turned the knock down: %w", err)
+	}
+	return nil
+}
+
+// AnswerKnock tells the sender that knocked whether its knock was taken.
+func AnswerKnock(stream network.Stream, taken bool) error {
+	if !taken {
+		return stream.Reset()
+	}
+	return stream.Close()
+}
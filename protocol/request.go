@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// maxRequestSize bounds the name of a requested file.
+const maxRequestSize = 4096
+
+// RequestFile asks a peer that holds the file called name to serve it and
+// waits until it is ready to. The file is then fetched with the usual
+// protocols and key, as if the peer had offered it under a code.
+func RequestFile(ctx context.Context, stream network.Stream, name string, key []byte, logger *slog.Logger) (err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+
+	writer := bufio.NewWriter(stream)
+	if _, err := rw.NewPWriter(writer, key).Write([]byte(name)); err != nil {
+		return fmt.Errorf("RequestFile: failed to send request: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("RequestFile: failed to flush writer: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return fmt.Errorf("RequestFile: failed to close write side: %w", err)
+	}
+
+	answer := make([]byte, 1)
+	_, err = rw.NewPReader(bufio.NewReader(stream), key).Read(answer)
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("RequestFile: the file is not available: %w", ErrDeclined)
+	}
+	if err != nil {
+		return fmt.Errorf("RequestFile: failed to read answer: %w", integrityError(err))
+	}
+	logger.Debug("file request answered", "name", name, "answer", string(answer))
+	if string(answer) != "y" {
+		return fmt.Errorf("RequestFile: the file is not available: %w", ErrDeclined)
+	}
+	return nil
+}
+
+// ReadFileRequest reads the name of the file a peer asks for. The request
+// is answered with AnswerFileRequest.
+func ReadFileRequest(ctx context.Context, stream network.Stream, key []byte) (_ string, err error) {
+	defer guard(ctx, stream, &err)()
+
+	name, err := io.ReadAll(io.LimitReader(rw.NewPReader(bufio.NewReader(stream), key), maxRequestSize))
+	if err != nil {
+		return "", fmt.Errorf("ReadFileRequest: failed to read request: %w", integrityError(err))
+	}
+	return string(name), nil
+}
+
+// AnswerFileRequest tells the peer asking for a file whether it is about to
+// be served.
+func AnswerFileRequest(stream network.Stream, key []byte, ok bool) error {
+	defer stream.Close()
+	if !ok {
+		return nil
+	}
+	writer := bufio.NewWriter(stream)
+	if _, err := rw.NewPWriter(writer, key).Write([]byte("y")); err != nil {
+		return fmt.Errorf("AnswerFileRequest: failed to send answer: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("AnswerFileRequest: failed to flush writer: %w", err)
+	}
+	return nil
+}
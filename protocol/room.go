@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// RoomMessageKind identifies a message of a room.
+type RoomMessageKind string
+
+const (
+	// RoomWelcome is sent by the creator of the room to a member that just
+	// joined, with the room key and what the room holds so far.
+	RoomWelcome RoomMessageKind = "welcome"
+	// RoomJoined and RoomLeft announce the members that come and go.
+	RoomJoined RoomMessageKind = "joined"
+	RoomLeft   RoomMessageKind = "left"
+	// RoomOffer carries files published by a member, first to the creator
+	// and then from the creator to the other members.
+	RoomOffer RoomMessageKind = "offer"
+)
+
+// maxRoomMessageSize bounds a single room message. The welcome, which lists
+// every member and file of the room, is the largest.
+const maxRoomMessageSize = 16 << 20
+
+// RoomMessage is exchanged between the creator of a room, which relays the
+// messages, and each of its members.
+type RoomMessage struct {
+	Kind RoomMessageKind `json:"kind"`
+	// Key is the room key, which the members use to fetch files from each
+	// other. Only set on RoomWelcome.
+	Key []byte `json:"key,omitempty"`
+	// Members lists the members to connect to for their files.
+	Members []peer.AddrInfo `json:"members,omitempty"`
+	Files   []RoomFile      `json:"files,omitempty"`
+}
+
+// RoomFile is a file published in a room.
+type RoomFile struct {
+	// ID tells the files of a member apart.
+	ID       string   `json:"id"`
+	From     peer.ID  `json:"from"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// RoomFetch asks a member of a room for a file it published. The member
+// serves the file over protocols scoped to Nonce, which the fetching member
+// picks at random, so that any number of fetches run side by side.
+type RoomFetch struct {
+	ID    string `json:"id"`
+	Nonce string `json:"nonce"`
+}
+
+// RoomStream carries the messages of a room over a stream that stays open
+// for as long as the member is in the room.
+type RoomStream struct {
+	stream network.Stream
+	// limit holds each message read by dec to maxRoomMessageSize.
+	limit *io.LimitedReader
+	dec   *json.Decoder
+
+	mu  sync.Mutex
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// NewRoomStream returns a RoomStream over stream, sealing the messages with
+// key.
+func NewRoomStream(stream network.Stream, key []byte) *RoomStream {
+	w := bufio.NewWriter(stream)
+	limit := &io.LimitedReader{R: rw.NewPReader(bufio.NewReader(stream), key), N: maxRoomMessageSize}
+	return &RoomStream{
+		stream: stream,
+		limit:  limit,
+		dec:    json.NewDecoder(limit),
+		w:      w,
+		enc:    json.NewEncoder(rw.NewPWriter(w, key)),
+	}
+}
+
+// Send writes msg to the stream. It is safe for concurrent use.
+func (s *RoomStream) Send(msg RoomMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(msg); err != nil {
+		return fmt.Errorf("RoomStream: failed to send %s message: %w", msg.Kind, err)
+	}
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("RoomStream: failed to flush writer: %w", err)
+	}
+	return nil
+}
+
+// Receive reads the next message from the stream. It returns io.EOF once
+// the other side left the room.
+func (s *RoomStream) Receive() (RoomMessage, error) {
+	var msg RoomMessage
+	s.limit.N = maxRoomMessageSize
+	if err := s.dec.Decode(&msg); err != nil {
+		if s.limit.N == 0 {
+			return msg, fmt.Errorf("RoomStream: message exceeds %d bytes", maxRoomMessageSize)
+		}
+		if errors.Is(err, io.EOF) {
+			return msg, io.EOF
+		}
+		return msg, fmt.Errorf("RoomStream: failed to read message: %w", integrityError(err))
+	}
+	return msg, nil
+}
+
+// Close resets the stream, which interrupts a pending Receive.
+func (s *RoomStream) Close() error {
+	return s.stream.Reset()
+}
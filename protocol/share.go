@@ -0,0 +1,96 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// ShareEntry is a file or directory in a shared directory.
+type ShareEntry struct {
+	Name    string    `json:"name"`
+	Dir     bool      `json:"dir,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// maxListingSize bounds an encoded listing, which is enough for directories
+// of about a hundred thousand entries.
+const maxListingSize = 16 << 20
+
+// shareListing answers a listing request, with the entries of the directory
+// or the reason it cannot be listed.
+type shareListing struct {
+	Entries []ShareEntry `json:"entries"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// RequestListing asks the sharer for the entries of the directory at the
+// slash-separated path p, relative to the shared directory.
+func RequestListing(ctx context.Context, stream network.Stream, p string, key []byte, logger *slog.Logger) (_ []ShareEntry, err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+
+	writer := bufio.NewWriter(stream)
+	if _, err := rw.NewPWriter(writer, key).Write([]byte(p)); err != nil {
+		return nil, fmt.Errorf("RequestListing: failed to send request: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, fmt.Errorf("RequestListing: failed to flush writer: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return nil, fmt.Errorf("RequestListing: failed to close write side: %w", err)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(rw.NewPReader(bufio.NewReader(stream), key), maxListingSize))
+	if err != nil {
+		return nil, fmt.Errorf("RequestListing: failed to read listing: %w", integrityError(err))
+	}
+	var listing shareListing
+	if err := json.Unmarshal(data, &listing); err != nil {
+		return nil, fmt.Errorf("RequestListing: failed to unmarshal listing: %w", err)
+	}
+	if listing.Error != "" {
+		return nil, errors.New(listing.Error)
+	}
+	logger.Debug("received listing", "path", p, "entries", len(listing.Entries))
+	return listing.Entries, nil
+}
+
+// ServeListing reads a listing request and answers it with the entries list
+// returns for the requested path, or with its error. It returns the path.
+func ServeListing(ctx context.Context, stream network.Stream, key []byte, list func(string) ([]ShareEntry, error), logger *slog.Logger) (_ string, err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+
+	p, err := io.ReadAll(io.LimitReader(rw.NewPReader(bufio.NewReader(stream), key), maxRequestSize))
+	if err != nil {
+		return "", fmt.Errorf("ServeListing: failed to read request: %w", integrityError(err))
+	}
+	var listing shareListing
+	listing.Entries, err = list(string(p))
+	if err != nil {
+		listing.Error = err.Error()
+	}
+	data, err := json.Marshal(listing)
+	if err != nil {
+		return "", fmt.Errorf("ServeListing: failed to marshal listing: %w", err)
+	}
+	writer := bufio.NewWriter(stream)
+	if _, err := rw.NewPWriter(writer, key).Write(data); err != nil {
+		return "", fmt.Errorf("ServeListing: failed to write listing: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return "", fmt.Errorf("ServeListing: failed to flush writer: %w", err)
+	}
+	logger.Debug("sent listing", "path", string(p), "entries", len(listing.Entries))
+	return string(p), nil
+}
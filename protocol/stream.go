@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// guard resets stream as soon as ctx is done, which unblocks any pending
+// read or write on it. The returned function must be deferred: it stops
+// watching ctx and annotates *errp with the reason ctx ended, if any.
+func guard(ctx context.Context, stream network.Stream, errp *error) func() {
+	stop := context.AfterFunc(ctx, func() {
+		stream.Reset()
+	})
+	return func() {
+		stop()
+		if *errp != nil {
+			*errp = contextError(ctx, *errp)
+		}
+	}
+}
+
+// contextError marks err as ErrTimeout or as the cancellation of ctx when
+// one of them caused it.
+func contextError(ctx context.Context, err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrTimeout):
+		return err
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	case ctx.Err() != nil:
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// idleStream refreshes the deadline of the underlying stream before every
+// read and write, so that a peer going silent for longer than idle fails the
+// pending operation instead of blocking it forever.
+type idleStream struct {
+	network.Stream
+	idle time.Duration
+}
+
+// WithIdleTimeout returns stream wrapped so that any read or write that makes
+// no progress for idle fails with ErrTimeout. A non-positive idle returns
+// stream unchanged.
+func WithIdleTimeout(stream network.Stream, idle time.Duration) network.Stream {
+	if idle <= 0 {
+		return stream
+	}
+	return &idleStream{Stream: stream, idle: idle}
+}
+
+func (s *idleStream) Read(p []byte) (int, error) {
+	if err := s.Stream.SetReadDeadline(time.Now().Add(s.idle)); err != nil {
+		return 0, err
+	}
+	return s.Stream.Read(p)
+}
+
+func (s *idleStream) Write(p []byte) (int, error) {
+	if err := s.Stream.SetWriteDeadline(time.Now().Add(s.idle)); err != nil {
+		return 0, err
+	}
+	return s.Stream.Write(p)
+}
+
+// limitedStream passes reads and writes on the underlying stream through a
+// rate limiter.
+type limitedStream struct {
+	network.Stream
+	r io.Reader
+	w io.Writer
+}
+
+// WithLimit returns stream wrapped so that its reads and writes are held to
+// the rate of limiter until ctx is done. A nil limiter returns stream
+// unchanged.
+func WithLimit(ctx context.Context, stream network.Stream, limiter *rw.Limiter) network.Stream {
+	if limiter == nil {
+		return stream
+	}
+	return &limitedStream{
+		Stream: stream,
+		r:      limiter.Reader(ctx, stream),
+		w:      limiter.Writer(ctx, stream),
+	}
+}
+
+func (s *limitedStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *limitedStream) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
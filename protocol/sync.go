@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SyedMa3/peerlink/rw"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+// DirEntry describes one regular file of a synced directory.
+type DirEntry struct {
+	// Path is slash-separated and relative to the directory.
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    []byte    `json:"hash"`
+}
+
+// maxDirManifestSize bounds an encoded directory manifest, which is enough
+// for hundreds of thousands of files.
+const maxDirManifestSize = 64 << 20
+
+// DirManifest lists the files of a directory the sender syncs to the
+// receiver.
+type DirManifest struct {
+	Name  string     `json:"name"`
+	Files []DirEntry `json:"files"`
+}
+
+// Size returns the total size of the files.
+func (m *DirManifest) Size() int64 {
+	var size int64
+	for _, f := range m.Files {
+		size += f.Size
+	}
+	return size
+}
+
+// validate checks that every path stays inside the directory and appears
+// only once, since the receiver writes to them.
+func (m *DirManifest) validate() error {
+	seen := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		if !ValidPath(f.Path) {
+			return fmt.Errorf("invalid path %q", f.Path)
+		}
+		if seen[f.Path] {
+			return fmt.Errorf("path %q listed twice", f.Path)
+		}
+		seen[f.Path] = true
+		if f.Size < 0 || len(f.Hash) != sha256.Size {
+			return fmt.Errorf("invalid size or checksum for %q", f.Path)
+		}
+	}
+	return nil
+}
+
+// ValidPath reports whether p is a clean, slash-separated path that stays
+// inside the directory it is relative to.
+func ValidPath(p string) bool {
+	return p != "." && path.Clean(p) == p && filepath.IsLocal(filepath.FromSlash(p)) && !strings.ContainsAny(p, "\\\x00")
+}
+
+// SendDirManifest offers the manifest to the receiver and reports whether it
+// accepted the sync.
+func SendDirManifest(ctx context.Context, stream network.Stream, m *DirManifest, key []byte, logger *slog.Logger) (_ bool, err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return false, fmt.Errorf("SendDirManifest: failed to marshal manifest: %w", err)
+	}
+	writer := bufio.NewWriter(stream)
+	if _, err := rw.NewPWriter(writer, key).Write(data); err != nil {
+		return false, fmt.Errorf("SendDirManifest: failed to write manifest: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return false, fmt.Errorf("SendDirManifest: failed to flush writer: %w", err)
+	}
+	if err := stream.CloseWrite(); err != nil {
+		return false, fmt.Errorf("SendDirManifest: failed to close write side: %w", err)
+	}
+	logger.Debug("sent directory manifest", "files", len(m.Files), "bytes", len(data))
+
+	confirmation := make([]byte, 1)
+	_, err = rw.NewPReader(bufio.NewReader(stream), key).Read(confirmation)
+	if errors.Is(err, io.EOF) {
+		return false, fmt.Errorf("SendDirManifest: receiver closed the stream without answering")
+	}
+	if err != nil {
+		return false, fmt.Errorf("SendDirManifest: failed to read confirmation: %w", integrityError(err))
+	}
+	return string(confirmation) == "y", nil
+}
+
+// ReceiveDirManifest reads the sender's manifest, asks accept whether to
+// sync it and reports the answer back to the sender.
+func ReceiveDirManifest(ctx context.Context, stream network.Stream, key []byte, accept func(context.Context, *DirManifest) (bool, error), logger *slog.Logger) (_ *DirManifest, _ bool, err error) {
+	defer guard(ctx, stream, &err)()
+	defer stream.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rw.NewPReader(bufio.NewReader(stream), key), maxDirManifestSize))
+	if err != nil {
+		return nil, false, fmt.Errorf("ReceiveDirManifest: failed to read manifest: %w", integrityError(err))
+	}
+	var m DirManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, false, fmt.Errorf("ReceiveDirManifest: failed to unmarshal manifest: %w", err)
+	}
+	if err := m.validate(); err != nil {
+		return nil, false, fmt.Errorf("ReceiveDirManifest: %w", err)
+	}
+	logger.Debug("received directory manifest", "files", len(m.Files), "size", m.Size())
+
+	accepted, err := accept(ctx, &m)
+	if err != nil {
+		return &m, false, fmt.Errorf("ReceiveDirManifest: failed to decide on sync: %w", err)
+	}
+	response := "n"
+	if accepted {
+		response = "y"
+	}
+	writer := bufio.NewWriter(stream)
+	if _, err := rw.NewPWriter(writer, key).Write([]byte(response)); err != nil {
+		return &m, false, fmt.Errorf("ReceiveDirManifest: failed to send confirmation: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return &m, false, fmt.Errorf("ReceiveDirManifest: failed to flush writer: %w", err)
+	}
+	return &m, accepted, nil
+}
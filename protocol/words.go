@@ -54,3 +54,17 @@ func GenerateCIDFromWordAndTime(words []string) (cid.Cid, error) {
 	// Create a CID using the raw codec
 	return cid.NewCidV1(cid.Raw, hash), nil
 }
+
+// ParseCode splits a code of the form word1-word2-word3-word4-word5 into its words.
+func ParseCode(code string) ([]string, error) {
+	words := strings.Split(strings.ToLower(strings.TrimSpace(code)), "-")
+	if len(words) != 5 {
+		return nil, ErrInvalidCode
+	}
+	for _, word := range words {
+		if word == "" {
+			return nil, ErrInvalidCode
+		}
+	}
+	return words, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/SyedMa3/peerlink/utils"
+	"github.com/urfave/cli/v2"
+)
+
+var cacheFlag = &cli.StringFlag{Name: "cache", Usage: "copy accepted files found in the content cache in `DIR` instead of transferring them, and add received files to it"}
+
+func receiveCommand(client *peerlink.Client) *cli.Command {
+	return &cli.Command{
+		Name:      "receive",
+		Usage:     "Receive a file",
+		ArgsUsage: "<input-passphrase> | --listen",
+		Flags: append([]cli.Flag{
+			jsonFlag,
+			&cli.BoolFlag{Name: "yes", Aliases: []string{"y"}, Usage: "accept the file without asking"},
+			queryTimeoutFlag,
+			publishTimeoutFlag,
+			limitFlag,
+			cacheFlag,
+			preserveFlag,
+			preAcceptFlag,
+			onCompleteFlag,
+			&cli.BoolFlag{Name: "listen", Usage: "publish a code of your own and wait for the sender to push the file with send --to-code"},
+			&cli.IntFlag{Name: "streams", Usage: "parallel streams to fetch the file over (0 picks from the round-trip time)"},
+			&cli.BoolFlag{Name: "swarm", Usage: "download chunks from every sender serving the code at once"},
+			&cli.IntFlag{Name: "max-providers", Usage: "with --swarm, senders to download from at once (0 for no limit)"},
+		}, append(policyFlags, timeoutFlags...)...),
+		Action: func(c *cli.Context) error {
+			listen := c.Bool("listen")
+			switch {
+			case listen && c.NArg() > 0:
+				return fmt.Errorf("%w: --listen generates the passphrase, do not pass one", errUsage)
+			case listen && c.Bool("swarm"):
+				return fmt.Errorf("%w: --listen and --swarm are mutually exclusive", errUsage)
+			case !listen && c.NArg() < 1:
+				return fmt.Errorf("%w: input passphrase is required", errUsage)
+			case c.Bool("yes") && c.IsSet(preAcceptFlag.Name):
+				return fmt.Errorf("%w: --yes and --pre-accept are mutually exclusive", errUsage)
+			}
+			passphrase := c.Args().First()
+			out := newOutput(c)
+			if console, ok := out.(*console); ok {
+				console.listening = listen
+			}
+			defer out.close()
+
+			var w io.Writer = os.Stdout
+			if c.Bool(jsonFlag.Name) {
+				// Keep stdout clean for the JSON events
+				w = os.Stderr
+			}
+			accept := promptAccept(w)
+			if command := c.String(preAcceptFlag.Name); command != "" {
+				accept = hookAccept(command, w)
+			}
+			if c.Bool("yes") {
+				accept = nil
+			}
+			if !c.Bool("swarm") && c.IsSet("max-providers") {
+				return fmt.Errorf("%w: --max-providers requires --swarm", errUsage)
+			}
+			limit, err := newLimiter(c)
+			if err != nil {
+				return err
+			}
+			policy, err := newPolicy(c)
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := withTimeout(c)
+			defer cancel()
+			opts := peerlink.Options{
+				OnEvent:  out.handle,
+				Accept:   accept,
+				Timeouts: timeouts(c),
+				Streams:  c.Int("streams"),
+				Limit:    limit,
+				Cache:    c.String(cacheFlag.Name),
+				Preserve: c.Bool(preserveFlag.Name),
+				Policy:   policy,
+			}
+			var result *peerlink.ReceiveResult
+			switch {
+			case listen:
+				result, err = client.Listen(ctx, peerlink.DirSink("."), opts)
+			case c.Bool("swarm"):
+				result, err = client.ReceiveSwarm(ctx, passphrase, peerlink.DirSink("."), opts, peerlink.SwarmOptions{
+					MaxProviders: c.Int("max-providers"),
+				})
+			default:
+				result, err = client.Receive(ctx, passphrase, peerlink.DirSink("."), opts)
+			}
+			if err != nil {
+				out.failed(err)
+				return err
+			}
+			out.received(result)
+			if command := c.String(onCompleteFlag.Name); command != "" {
+				if err := runOnComplete(ctx, command, result, w); err != nil {
+					out.hookFailed(result, err)
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// promptAccept returns an AcceptFunc that asks the user on stdin, writing
+// the question to w, whether to receive the offered file.
+func promptAccept(w io.Writer) protocol.AcceptFunc {
+	return func(ctx context.Context, metadata protocol.Metadata) (bool, error) {
+		fmt.Fprintf(w, "Received file metadata:\nFilename: %s\nSize: %d bytes\nDo you want to receive this file? (y/n): ", metadata.Filename, metadata.Size)
+		response, err := utils.ReadInputContext(ctx)
+		if err != nil {
+			return false, err
+		}
+		return strings.ToLower(response) == "y", nil
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/urfave/cli/v2"
+)
+
+const roomHelp = `Commands:
+  publish <file>...  offer files to the other members
+  files              list the files the other members offer
+  get <number>...    fetch files from the list
+  members            list the other members
+  help               show this help
+  quit               leave the room
+`
+
+func roomCommand(client *peerlink.Client) *cli.Command {
+	flags := append([]cli.Flag{
+		jsonFlag,
+		&cli.BoolFlag{Name: "yes", Aliases: []string{"y"}, Usage: "fetch every file the other members publish without asking"},
+		publishTimeoutFlag,
+		queryTimeoutFlag,
+		limitFlag,
+		cacheFlag,
+		preserveFlag,
+	}, append(policyFlags, timeoutFlags...)...)
+	return &cli.Command{
+		Name:  "room",
+		Usage: "Share files with a group of peers under one code",
+		Description: "The member that creates the room relays the news of members and files to everybody,\n" +
+			"so it must stay: the room ends for everybody when it leaves, and nobody takes its place.\n" +
+			"Files are fetched straight from the member that published them.",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "create",
+				Usage: "Create a room and print its code; the room lasts as long as you stay in it",
+				Flags: flags,
+				Action: func(c *cli.Context) error {
+					return runRoom(c, client, "")
+				},
+			},
+			{
+				Name:      "join",
+				Usage:     "Join the room created with a code, for as long as its creator stays in it",
+				ArgsUsage: "<input-passphrase>",
+				Flags:     flags,
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 1 {
+						return fmt.Errorf("%w: input passphrase is required", errUsage)
+					}
+					return runRoom(c, client, c.Args().First())
+				},
+			},
+		},
+	}
+}
+
+func runRoom(c *cli.Context, client *peerlink.Client, code string) error {
+	limit, err := newLimiter(c)
+	if err != nil {
+		return err
+	}
+	policy, err := newPolicy(c)
+	if err != nil {
+		return err
+	}
+	base := newOutput(c)
+	if console, ok := base.(*console); ok {
+		console.session = true
+	}
+	out := &syncOutput{out: base}
+	defer out.close()
+
+	// Notices go to stderr with --json to keep stdout clean for the JSON
+	// events.
+	var w io.Writer = os.Stdout
+	if c.Bool(jsonFlag.Name) {
+		w = os.Stderr
+	}
+	sh := &roomShell{
+		w:        w,
+		lines:    readLines(os.Stdin),
+		preserve: c.Bool(preserveFlag.Name),
+		fetchAll: c.Bool("yes"),
+		queue:    make(chan peerlink.RoomFile, 64),
+	}
+
+	ctx, cancel := withTimeout(c)
+	defer cancel()
+	room, err := client.OpenRoom(ctx, peerlink.Options{
+		OnEvent:  out.handle,
+		Timeouts: timeouts(c),
+		Limit:    limit,
+		Cache:    c.String(cacheFlag.Name),
+		Preserve: c.Bool(preserveFlag.Name),
+		Policy:   policy,
+	}, peerlink.RoomOptions{
+		Code:    code,
+		Sink:    peerlink.DirSink("."),
+		OnOffer: sh.offered,
+		OnJoin: func(p peer.ID) {
+			sh.printf("%s joined the room\n", p)
+		},
+		OnLeave: func(p peer.ID) {
+			sh.printf("%s left the room\n", p)
+		},
+	})
+	if err != nil {
+		out.failed(err)
+		return err
+	}
+	defer room.Close()
+
+	sh.printf("\nIn the room. Type \"help\" for the commands.\n")
+	return sh.run(ctx, room, out)
+}
+
+// roomShell reads commands from the user while files are published and
+// fetched in the background.
+type roomShell struct {
+	w     io.Writer
+	lines <-chan string
+	// preserve publishes symbolic links as links.
+	preserve bool
+	// fetchAll fetches every file offered without being asked to.
+	fetchAll bool
+	queue    chan peerlink.RoomFile
+
+	mu sync.Mutex
+	// offers numbers the files offered so far, for get.
+	offers []peerlink.RoomFile
+}
+
+func (sh *roomShell) printf(format string, args ...any) {
+	fmt.Fprintf(sh.w, format, args...)
+}
+
+// offered announces a file another member published.
+func (sh *roomShell) offered(f peerlink.RoomFile) {
+	sh.mu.Lock()
+	sh.offers = append(sh.offers, f)
+	n := len(sh.offers)
+	sh.mu.Unlock()
+	sh.printf("[%d] %s offers %s (%d bytes)\n", n, f.From, f.Metadata.Filename, f.Metadata.Size)
+	if sh.fetchAll {
+		sh.enqueue(f)
+	}
+}
+
+func (sh *roomShell) enqueue(f peerlink.RoomFile) {
+	select {
+	case sh.queue <- f:
+	default:
+		sh.printf("Too many files queued, %s was not added\n", f.Metadata.Filename)
+	}
+}
+
+// run executes the user's commands until they quit, stdin ends or the room
+// ends. Files to fetch are queued and fetched one after another.
+func (sh *roomShell) run(ctx context.Context, room *peerlink.Room, out output) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var fetching sync.WaitGroup
+	fetching.Add(1)
+	go func() {
+		defer fetching.Done()
+		for {
+			select {
+			case f := <-sh.queue:
+				sh.fetch(ctx, room, out, f)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	// Leaving interrupts the file being fetched and drops the queued ones.
+	defer fetching.Wait()
+	defer cancel()
+
+	for {
+		select {
+		case line, ok := <-sh.lines:
+			if !ok {
+				return nil
+			}
+			command, args, _ := strings.Cut(line, " ")
+			switch command {
+			case "":
+			case "publish":
+				sh.publish(room, strings.Fields(args))
+			case "files":
+				sh.listFiles(room)
+			case "get":
+				sh.get(strings.Fields(args))
+			case "members":
+				for _, p := range room.Members() {
+					sh.printf("%s\n", p)
+				}
+			case "help":
+				sh.printf(roomHelp)
+			case "quit", "exit":
+				return nil
+			default:
+				sh.printf("Unknown command %q. Type \"help\" for the commands.\n", command)
+			}
+		case <-room.Done():
+			sh.printf("\nThe room was closed by its creator\n")
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (sh *roomShell) publish(room *peerlink.Room, paths []string) {
+	if len(paths) == 0 {
+		sh.printf("Usage: publish <file>...\n")
+	}
+	for _, path := range paths {
+		src, err := openSource(path, sh.preserve)
+		if err == nil {
+			_, err = room.Publish(src)
+		}
+		if err != nil {
+			sh.printf("Publishing %s failed: %v\n", path, err)
+			continue
+		}
+		sh.printf("Published %s\n", path)
+	}
+}
+
+// listFiles prints the files still offered, under the numbers get takes.
+func (sh *roomShell) listFiles(room *peerlink.Room) {
+	offered := room.Files()
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	listed := false
+	for i, f := range sh.offers {
+		if slices.ContainsFunc(offered, func(o peerlink.RoomFile) bool { return o.ID == f.ID }) {
+			sh.printf("[%d] %s offers %s (%d bytes)\n", i+1, f.From, f.Metadata.Filename, f.Metadata.Size)
+			listed = true
+		}
+	}
+	if !listed {
+		sh.printf("No files offered\n")
+	}
+}
+
+func (sh *roomShell) get(args []string) {
+	if len(args) == 0 {
+		sh.printf("Usage: get <number>...\n")
+	}
+	for _, arg := range args {
+		n, err := strconv.Atoi(arg)
+		sh.mu.Lock()
+		valid := err == nil && n >= 1 && n <= len(sh.offers)
+		var f peerlink.RoomFile
+		if valid {
+			f = sh.offers[n-1]
+		}
+		sh.mu.Unlock()
+		if !valid {
+			sh.printf("No file numbered %s. Type \"files\" for the list.\n", arg)
+			continue
+		}
+		sh.enqueue(f)
+	}
+}
+
+// fetch fetches a file another member published and reports the outcome.
+func (sh *roomShell) fetch(ctx context.Context, room *peerlink.Room, out output, f peerlink.RoomFile) {
+	result, err := room.Fetch(ctx, f)
+	if err == nil {
+		out.received(result)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	out.failed(err)
+	sh.printf("Fetching %s failed: %v\n", f.Metadata.Filename, err)
+}
@@ -0,0 +1,210 @@
+package rw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minBurst is the smallest burst a Limiter allows, so that slow limits still
+// pass whole frames without splitting them into tiny writes.
+const minBurst = 16 * 1024
+
+// Limiter caps the rate of the bytes passed through it with a token bucket
+// that holds up to a fifth of a second's worth of bytes. A nil *Limiter is
+// valid and does not limit anything. A Limiter may be shared by several
+// streams, which then share its rate, and its rate may be changed while
+// they are running.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 for no limit
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a Limiter passing rate bytes per second. A rate of zero
+// or less does not limit anything until SetRate is called.
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate to rate bytes per second, zero or less lifting
+// the limit. It takes effect for bytes that have not been waited for yet.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(max(rate, 0))
+	l.last = time.Now()
+	l.tokens = min(l.tokens, l.burst())
+}
+
+// Rate returns the current rate in bytes per second, or 0 if there is no
+// limit.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+func (l *Limiter) burst() float64 {
+	return max(l.rate/5, minBurst)
+}
+
+// chunk returns how many of n bytes may be passed at once.
+func (l *Limiter) chunk(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return n
+	}
+	return min(n, int(l.burst()))
+}
+
+// WaitN blocks until n bytes may pass or ctx is done. Bytes beyond what the
+// bucket holds are borrowed from the future and delay the next caller.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst())
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reader returns r limited by l until ctx is done. A nil l returns r.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l, ctx: ctx}
+}
+
+// Writer returns w limited by l until ctx is done. A nil l returns w.
+func (l *Limiter) Writer(ctx context.Context, w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &limitedWriter{w: w, l: l, ctx: ctx}
+}
+
+type limitedReader struct {
+	r   io.Reader
+	l   *Limiter
+	ctx context.Context
+}
+
+// Read reads at most a burst and then waits for it, so a slow receiver
+// leaves the data in the stream and the sender is held back by flow control.
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p[:r.l.chunk(len(p))])
+	if n > 0 {
+		if werr := r.l.WaitN(r.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+type limitedWriter struct {
+	w   io.Writer
+	l   *Limiter
+	ctx context.Context
+}
+
+// Write waits for and writes p a burst at a time, so that a changed rate
+// takes effect within a large write.
+func (w *limitedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p[:w.l.chunk(len(p))]
+		if err := w.l.WaitN(w.ctx, len(chunk)); err != nil {
+			return n, err
+		}
+		m, err := w.w.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// ParseRate parses a rate such as "10MB/s", "512KiB" or "1.5M" into bytes
+// per second. Decimal (KB, MB, GB) and binary (KiB, MiB, GiB) units are
+// accepted, single letters are binary, and the "/s" suffix is optional. "0"
+// means no limit.
+func ParseRate(s string) (int64, error) {
+	rate, err := parseBytes(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return 0, fmt.Errorf("ParseRate: %s in rate %q", err, s)
+	}
+	return rate, nil
+}
+
+// ParseSize parses a size such as "2GB", "512KiB" or "1.5M" into bytes,
+// with the units of ParseRate.
+func ParseSize(s string) (int64, error) {
+	size, err := parseBytes(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("ParseSize: %s in size %q", err, s)
+	}
+	return size, nil
+}
+
+func parseBytes(str string) (int64, error) {
+	i := strings.IndexFunc(str, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(str)
+	}
+	value, err := strconv.ParseFloat(str[:i], 64)
+	if err != nil || value < 0 {
+		return 0, errors.New("invalid number")
+	}
+	multiplier, ok := rateUnits[strings.ToLower(strings.TrimSpace(str[i:]))]
+	if !ok {
+		return 0, errors.New("unknown unit")
+	}
+	return int64(value * multiplier), nil
+}
+
+var rateUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kib": 1 << 10, "kb": 1e3,
+	"m": 1 << 20, "mib": 1 << 20, "mb": 1e6,
+	"g": 1 << 30, "gib": 1 << 30, "gb": 1e9,
+}
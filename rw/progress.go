@@ -0,0 +1,122 @@
+package rw
+
+import (
+	"sync"
+	"time"
+)
+
+// progressInterval is the minimum time between two progress reports.
+const progressInterval = 200 * time.Millisecond
+
+// Progress is a snapshot of how far a transfer has come.
+type Progress struct {
+	Done    int64         `json:"done"`
+	Total   int64         `json:"total"`
+	Rate    float64       `json:"rate"` // bytes per second
+	Elapsed time.Duration `json:"elapsed"`
+	ETA     time.Duration `json:"eta"`
+	// Limit is the bandwidth limit in bytes per second, 0 if there is none.
+	Limit int64 `json:"limit,omitempty"`
+}
+
+// Meter counts the payload bytes written to it and periodically reports
+// them, together with a smoothed rate and an ETA, to a callback. A nil
+// *Meter is valid and counts nothing. A Meter may be shared by several
+// streams carrying parts of the same payload.
+type Meter struct {
+	total  int64
+	report func(Progress)
+
+	mu       sync.Mutex
+	start    time.Time
+	last     time.Time
+	done     int64
+	lastDone int64
+	rate     float64
+	peak     float64
+}
+
+// NewMeter returns a Meter for a payload of total bytes. report is called at
+// most every progressInterval and once more from Finish.
+func NewMeter(total int64, report func(Progress)) *Meter {
+	now := time.Now()
+	return &Meter{total: total, report: report, start: now, last: now}
+}
+
+// Write counts len(p) bytes as done. It never fails, so a Meter can be
+// plugged into io.MultiWriter or io.TeeReader.
+func (m *Meter) Write(p []byte) (int, error) {
+	m.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Add counts n bytes as done, for payload that is accounted for without
+// passing through the Meter.
+func (m *Meter) Add(n int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.done += n
+
+	now := time.Now()
+	if now.Sub(m.last) >= progressInterval {
+		m.sample(now)
+		m.emit(now)
+	}
+}
+
+// Finish reports the final state of the transfer.
+func (m *Meter) Finish() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.sample(now)
+	m.emit(now)
+}
+
+func (m *Meter) sample(now time.Time) {
+	dt := now.Sub(m.last).Seconds()
+	if dt <= 0 {
+		return
+	}
+	instant := float64(m.done-m.lastDone) / dt
+	if m.lastDone == 0 {
+		m.rate = instant
+	} else {
+		m.rate = 0.3*instant + 0.7*m.rate
+	}
+	m.peak = max(m.peak, m.rate)
+	m.last = now
+	m.lastDone = m.done
+}
+
+// Peak returns the highest smoothed rate seen so far in bytes per second.
+func (m *Meter) Peak() float64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.peak
+}
+
+func (m *Meter) emit(now time.Time) {
+	if m.report == nil {
+		return
+	}
+	p := Progress{
+		Done:    m.done,
+		Total:   m.total,
+		Rate:    m.rate,
+		Elapsed: now.Sub(m.start),
+	}
+	if m.rate > 0 && m.total > m.done {
+		p.ETA = time.Duration(float64(m.total-m.done) / m.rate * float64(time.Second))
+	}
+	m.report(p)
+}
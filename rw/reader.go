@@ -1,11 +1,11 @@
 package rw
 
 import (
-	"bufio"
 	"crypto/sha256"
 	"fmt"
 	"io"
-	"os"
+	"log/slog"
+	"time"
 
 	"github.com/SyedMa3/peerlink/utils"
 )
@@ -13,6 +13,7 @@ import (
 type PReader struct {
 	io.Reader
 	key []byte
+	buf []byte
 }
 
 func NewPReader(r io.Reader, key []byte) *PReader {
@@ -20,6 +21,13 @@ func NewPReader(r io.Reader, key []byte) *PReader {
 }
 
 func (r *PReader) Read(p []byte) (n int, err error) {
+	// Serve whatever is left over from the previous frame first
+	if len(r.buf) > 0 {
+		n = copy(p, r.buf)
+		r.buf = r.buf[n:]
+		return n, nil
+	}
+
 	// Read the length of the encrypted data
 	lengthBytes := make([]byte, 4)
 	n, err = io.ReadFull(r.Reader, lengthBytes)
@@ -49,20 +57,26 @@ func (r *PReader) Read(p []byte) (n int, err error) {
 		return 0, fmt.Errorf("failed to decrypt data: %w", err)
 	}
 
-	// Copy the decrypted data to the output buffer
+	// Copy the decrypted data to the output buffer, keeping the rest for the next call
 	n = copy(p, decryptedData)
+	r.buf = decryptedData[n:]
 	return n, nil
 }
 
-func ReadData(r *bufio.Reader, key []byte, file *os.File) []byte {
+// ReadData decrypts everything from r into w and returns the number of
+// plaintext bytes written along with their SHA-256 checksum. Progress is
+// counted on meter, which may be nil.
+func ReadData(r io.Reader, key []byte, w io.Writer, meter *Meter, logger *slog.Logger) (int64, []byte, error) {
 	reader := NewPReader(r, key)
+	defer meter.Finish()
 
+	start := time.Now()
 	checksum := sha256.New()
-	_, err := io.Copy(io.MultiWriter(file, checksum), reader)
+	n, err := io.Copy(io.MultiWriter(w, checksum, meter), reader)
 	if err != nil {
-		fmt.Printf("readData: failed to copy data to tmp file: %v", err)
-		return nil
+		return n, nil, fmt.Errorf("readData: failed to copy data: %w", err)
 	}
+	logger.Debug("read encrypted data", "bytes", n, "duration", time.Since(start))
 
-	return checksum.Sum(nil)
+	return n, checksum.Sum(nil), nil
 }
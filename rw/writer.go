@@ -3,11 +3,15 @@ package rw
 import (
 	"fmt"
 	"io"
-	"os"
+	"log/slog"
+	"time"
 
 	"github.com/SyedMa3/peerlink/utils"
 )
 
+// MaxFrameSize is the largest plaintext chunk sealed into a single frame.
+const MaxFrameSize = 64 * 1024
+
 type PWriter struct {
 	io.Writer
 	key []byte
@@ -18,10 +22,25 @@ func NewPWriter(w io.Writer, key []byte) *PWriter {
 }
 
 func (w *PWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > MaxFrameSize {
+			chunk = chunk[:MaxFrameSize]
+		}
+		if err := w.writeFrame(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (w *PWriter) writeFrame(p []byte) error {
 	// Encrypt the data before writing
 	encryptedData, err := utils.Encrypt(w.key, p)
 	if err != nil {
-		return 0, fmt.Errorf("failed to encrypt data: %w", err)
+		return fmt.Errorf("failed to encrypt data: %w", err)
 	}
 
 	// Prepend the length of the encrypted data
@@ -35,23 +54,28 @@ func (w *PWriter) Write(p []byte) (n int, err error) {
 	// Write the length followed by the encrypted data
 	_, err = w.Writer.Write(lengthBytes)
 	if err != nil {
-		return n, fmt.Errorf("failed to write data length: %w", err)
+		return fmt.Errorf("failed to write data length: %w", err)
 	}
 
 	_, err = w.Writer.Write(encryptedData)
 	if err != nil {
-		return n, fmt.Errorf("failed to write encrypted data: %w", err)
+		return fmt.Errorf("failed to write encrypted data: %w", err)
 	}
 
-	return len(p), nil
+	return nil
 }
 
-func WriteData(file *os.File, key []byte, w io.Writer) (int64, error) {
+// WriteData encrypts everything read from r into w. Progress is counted on
+// meter, which may be nil.
+func WriteData(r io.Reader, key []byte, w io.Writer, meter *Meter, logger *slog.Logger) (int64, error) {
 	writer := NewPWriter(w, key)
+	defer meter.Finish()
 
-	n, err := io.Copy(writer, file)
+	start := time.Now()
+	n, err := io.Copy(writer, io.TeeReader(r, meter))
 	if err != nil {
-		return 0, err
+		return n, err
 	}
+	logger.Debug("wrote encrypted data", "bytes", n, "duration", time.Since(start))
 	return n, nil
 }
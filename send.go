@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/urfave/cli/v2"
+)
+
+var preserveFlag = &cli.BoolFlag{Name: "preserve", Usage: "preserve permissions, times, extended attributes, symbolic links and sparse files (needed on both sides)"}
+
+func sendCommand(client *peerlink.Client) *cli.Command {
+	return &cli.Command{
+		Name:      "send",
+		Usage:     "Send a file",
+		ArgsUsage: "<filename>",
+		Flags: append([]cli.Flag{
+			jsonFlag,
+			publishTimeoutFlag,
+			limitFlag,
+			preserveFlag,
+			&cli.BoolFlag{Name: "serve", Usage: "keep the code alive and serve the file to several receivers"},
+			&cli.IntFlag{Name: "max-receivers", Usage: "with --serve, stop after this many receivers fetched the file (0 for no limit)"},
+			&cli.IntFlag{Name: "max-parallel", Usage: "with --serve, receivers served at once; 1 serves them one after another (0 for no limit)"},
+			&cli.DurationFlag{Name: "until", Usage: "with --serve, stop accepting receivers after this long (0 for no limit)"},
+			&cli.StringFlag{Name: "code", Usage: "with --serve, serve under an existing code so several senders can feed a swarm receiver"},
+			&cli.StringFlag{Name: "to-code", Usage: "push the file to the receiver waiting with receive --listen on `CODE`"},
+			queryTimeoutFlag,
+		}, timeoutFlags...),
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 1 {
+				return fmt.Errorf("%w: filename is required", errUsage)
+			}
+			if !c.Bool("serve") && (c.IsSet("max-receivers") || c.IsSet("max-parallel") || c.IsSet("until") || c.IsSet("code")) {
+				return fmt.Errorf("%w: --max-receivers, --max-parallel, --until and --code require --serve", errUsage)
+			}
+			if c.Bool("serve") && c.IsSet("to-code") {
+				return fmt.Errorf("%w: --serve and --to-code are mutually exclusive", errUsage)
+			}
+			limit, err := newLimiter(c)
+			if err != nil {
+				return err
+			}
+			out := newOutput(c)
+			defer out.close()
+
+			src, err := openSource(c.Args().First(), c.Bool(preserveFlag.Name))
+			if err != nil {
+				out.failed(err)
+				return err
+			}
+
+			ctx, cancel := withTimeout(c)
+			defer cancel()
+			opts := peerlink.Options{
+				OnEvent:  out.handle,
+				Timeouts: timeouts(c),
+				Limit:    limit,
+				Preserve: c.Bool(preserveFlag.Name),
+			}
+
+			if c.Bool("serve") {
+				if console, ok := out.(*console); ok {
+					console.serving = true
+				}
+				result, err := client.Serve(ctx, src, opts, peerlink.ServeOptions{
+					MaxReceivers: c.Int("max-receivers"),
+					MaxParallel:  c.Int("max-parallel"),
+					Until:        c.Duration("until"),
+					Code:         c.String("code"),
+				})
+				if err != nil {
+					out.failed(err)
+					return err
+				}
+				out.served(result)
+				return nil
+			}
+
+			var result *peerlink.SendResult
+			if code := c.String("to-code"); code != "" {
+				if console, ok := out.(*console); ok {
+					console.pushing = true
+				}
+				result, err = client.SendTo(ctx, code, src, opts)
+			} else {
+				result, err = client.Send(ctx, src, opts)
+			}
+			if err != nil {
+				out.failed(err)
+				return err
+			}
+			out.sent(result)
+			return nil
+		},
+	}
+}
+
+// openSource offers the file at path. When preserving, a symbolic link is
+// offered as a link instead of the file it points to.
+func openSource(path string, preserve bool) (peerlink.Source, error) {
+	if preserve {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return peerlink.LinkSource(path)
+		}
+	}
+	return peerlink.FileSource(path)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/urfave/cli/v2"
+)
+
+const sessionHelp = `Commands:
+  send <file>...  queue files to send to the peer
+  help            show this help
+  quit            leave the session
+`
+
+func sessionCommand(client *peerlink.Client) *cli.Command {
+	return &cli.Command{
+		Name:      "session",
+		Usage:     "Open a two-way session to send files back and forth under one code",
+		ArgsUsage: "[input-passphrase]",
+		Flags: append([]cli.Flag{
+			jsonFlag,
+			&cli.BoolFlag{Name: "yes", Aliases: []string{"y"}, Usage: "accept every file the peer sends without asking"},
+			&cli.DurationFlag{Name: "resume", Usage: "keep the session through a dropped connection for up to this long, reconnecting meanwhile; the peer needs --resume too"},
+			publishTimeoutFlag,
+			queryTimeoutFlag,
+			limitFlag,
+			cacheFlag,
+			preserveFlag,
+			preAcceptFlag,
+			onCompleteFlag,
+		}, append(policyFlags, timeoutFlags...)...),
+		Action: func(c *cli.Context) error {
+			if c.Bool("yes") && c.IsSet(preAcceptFlag.Name) {
+				return fmt.Errorf("%w: --yes and --pre-accept are mutually exclusive", errUsage)
+			}
+			limit, err := newLimiter(c)
+			if err != nil {
+				return err
+			}
+			policy, err := newPolicy(c)
+			if err != nil {
+				return err
+			}
+			base := newOutput(c)
+			if console, ok := base.(*console); ok {
+				console.session = true
+			}
+			out := &syncOutput{out: base}
+			defer out.close()
+
+			// Questions and notices go to stderr with --json to keep stdout
+			// clean for the JSON events.
+			var w io.Writer = os.Stdout
+			if c.Bool(jsonFlag.Name) {
+				w = os.Stderr
+			}
+			sh := &shell{w: w, lines: readLines(os.Stdin), preserve: c.Bool(preserveFlag.Name)}
+
+			ctx, cancel := withTimeout(c)
+			defer cancel()
+			opts := peerlink.Options{
+				OnEvent:  out.handle,
+				Accept:   sh.accept,
+				Timeouts: timeouts(c),
+				Limit:    limit,
+				Cache:    c.String(cacheFlag.Name),
+				Preserve: c.Bool(preserveFlag.Name),
+				Policy:   policy,
+			}
+			if command := c.String(preAcceptFlag.Name); command != "" {
+				opts.Accept = hookAccept(command, w)
+			}
+			if c.Bool("yes") {
+				opts.Accept = nil
+			}
+
+			sess, err := client.OpenSession(ctx, opts, peerlink.SessionOptions{
+				Code:   c.Args().First(),
+				Sink:   peerlink.DirSink("."),
+				Resume: c.Duration("resume"),
+				OnReceive: func(result *peerlink.ReceiveResult, err error) {
+					if err != nil {
+						out.failed(err)
+						sh.printf("Receiving a file failed: %v\n", err)
+						return
+					}
+					out.received(result)
+					if command := c.String(onCompleteFlag.Name); command != "" {
+						if err := runOnComplete(ctx, command, result, w); err != nil {
+							out.hookFailed(result, err)
+							sh.printf("%v\n", err)
+						}
+					}
+				},
+			})
+			if err != nil {
+				out.failed(err)
+				return err
+			}
+			defer sess.Close()
+
+			sh.printf("\nSession open with %s. Type \"help\" for the commands.\n", sess.Peer())
+			return sh.run(ctx, sess, out)
+		},
+	}
+}
+
+// shell reads commands from the user while files flow both ways. A line
+// typed while a question about an incoming file is pending answers it.
+type shell struct {
+	w     io.Writer
+	lines <-chan string
+	// preserve offers symbolic links as links.
+	preserve bool
+
+	mu      sync.Mutex
+	pending chan string
+}
+
+// readLines delivers the lines read from r until it ends, then closes the
+// channel.
+func readLines(r io.Reader) <-chan string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- strings.TrimSpace(scanner.Text())
+		}
+	}()
+	return lines
+}
+
+func (sh *shell) printf(format string, args ...any) {
+	fmt.Fprintf(sh.w, format, args...)
+}
+
+// accept asks the user whether to receive a file the peer offers.
+func (sh *shell) accept(ctx context.Context, metadata protocol.Metadata) (bool, error) {
+	answer := make(chan string, 1)
+	sh.mu.Lock()
+	sh.pending = answer
+	sh.mu.Unlock()
+	defer func() {
+		sh.mu.Lock()
+		sh.pending = nil
+		sh.mu.Unlock()
+	}()
+
+	sh.printf("The peer offers %s (%d bytes). Do you want to receive it? (y/n): ", metadata.Filename, metadata.Size)
+	select {
+	case response := <-answer:
+		return strings.ToLower(response) == "y", nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// run executes the user's commands until they quit, stdin ends or the peer
+// leaves. Files to send are queued and sent one after another in the
+// background.
+func (sh *shell) run(ctx context.Context, sess *peerlink.Session, out output) error {
+	ctx, cancel := context.WithCancel(ctx)
+	queue := make(chan string, 64)
+	var sending sync.WaitGroup
+	sending.Add(1)
+	go func() {
+		defer sending.Done()
+		for path := range queue {
+			if ctx.Err() == nil {
+				sh.send(ctx, sess, out, path)
+			}
+		}
+	}()
+	// Leaving interrupts the file being sent and drops the queued ones.
+	defer sending.Wait()
+	defer close(queue)
+	defer cancel()
+
+	for {
+		select {
+		case line, ok := <-sh.lines:
+			if !ok {
+				return nil
+			}
+			sh.mu.Lock()
+			pending := sh.pending
+			sh.pending = nil
+			sh.mu.Unlock()
+			if pending != nil {
+				pending <- line
+				continue
+			}
+
+			command, args, _ := strings.Cut(line, " ")
+			switch command {
+			case "":
+			case "send":
+				files := strings.Fields(args)
+				if len(files) == 0 {
+					sh.printf("Usage: send <file>...\n")
+				}
+				for _, path := range files {
+					select {
+					case queue <- path:
+					default:
+						sh.printf("Too many files queued, %s was not added\n", path)
+					}
+				}
+			case "help":
+				sh.printf(sessionHelp)
+			case "quit", "exit":
+				return nil
+			default:
+				sh.printf("Unknown command %q. Type \"help\" for the commands.\n", command)
+			}
+		case <-sess.Done():
+			sh.printf("\nThe peer left the session\n")
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// send sends the file at path to the peer and reports the outcome.
+func (sh *shell) send(ctx context.Context, sess *peerlink.Session, out output, path string) {
+	src, err := openSource(path, sh.preserve)
+	if err == nil {
+		var result *peerlink.SendResult
+		if result, err = sess.Send(ctx, src); err == nil {
+			out.sent(result)
+			return
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	out.failed(err)
+	sh.printf("Sending %s failed: %v\n", path, err)
+}
+
+// syncOutput serializes the calls to an output, which the session makes
+// from the goroutines sending and receiving files at the same time.
+type syncOutput struct {
+	mu  sync.Mutex
+	out output
+}
+
+func (o *syncOutput) handle(e peerlink.Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.out.handle(e)
+}
+
+func (o *syncOutput) sent(result *peerlink.SendResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.out.sent(result)
+}
+
+func (o *syncOutput) served(result *peerlink.ServeResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.out.served(result)
+}
+
+func (o *syncOutput) received(result *peerlink.ReceiveResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.out.received(result)
+}
+
+func (o *syncOutput) synced(result *peerlink.SyncResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.out.synced(result)
+}
+
+func (o *syncOutput) shared(result *peerlink.ShareResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.out.shared(result)
+}
+
+func (o *syncOutput) listed(path string, entries []peerlink.ShareEntry) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.out.listed(path, entries)
+}
+
+func (o *syncOutput) failed(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.out.failed(err)
+}
+
+func (o *syncOutput) hookFailed(result *peerlink.ReceiveResult, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.out.hookFailed(result, err)
+}
+
+func (o *syncOutput) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.out.close()
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/SyedMa3/peerlink/protocol"
+	"github.com/urfave/cli/v2"
+)
+
+const browseHelp = `Commands:
+  ls [path]         list a directory of the share
+  cd <path>         change the current directory of the share
+  pwd               print the current directory of the share
+  get <path>...     fetch files, or whole directories, into the current directory
+  help              show this help
+  quit              stop browsing
+`
+
+func shareCommand(client *peerlink.Client) *cli.Command {
+	return &cli.Command{
+		Name:      "share",
+		Usage:     "Let a peer browse a directory and fetch the files it picks",
+		ArgsUsage: "<directory>",
+		Flags: append([]cli.Flag{
+			jsonFlag,
+			publishTimeoutFlag,
+			limitFlag,
+		}, timeoutFlags...),
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 1 {
+				return fmt.Errorf("%w: directory is required", errUsage)
+			}
+			dir := c.Args().First()
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				return fmt.Errorf("%w: not a directory: %s", errUsage, dir)
+			}
+			limit, err := newLimiter(c)
+			if err != nil {
+				return err
+			}
+			out := newOutput(c)
+			if console, ok := out.(*console); ok {
+				console.sharing = true
+			}
+			defer out.close()
+
+			ctx, cancel := withTimeout(c)
+			defer cancel()
+			result, err := client.Share(ctx, dir, peerlink.Options{
+				OnEvent:  out.handle,
+				Timeouts: timeouts(c),
+				Limit:    limit,
+			})
+			if err != nil {
+				out.failed(err)
+				return err
+			}
+			out.shared(result)
+			return nil
+		},
+	}
+}
+
+func browseCommand(client *peerlink.Client) *cli.Command {
+	return &cli.Command{
+		Name:      "browse",
+		Usage:     "Browse the directory a peer shares and fetch files from it",
+		ArgsUsage: "<input-passphrase>",
+		Flags: append([]cli.Flag{
+			jsonFlag,
+			&cli.StringSliceFlag{Name: "ls", Usage: "list the directory at `PATH` of the share and exit; may be repeated"},
+			&cli.StringSliceFlag{Name: "get", Usage: "fetch the file or directory at `PATH` of the share and exit; may be repeated"},
+			queryTimeoutFlag,
+			limitFlag,
+			cacheFlag,
+		}, append(policyFlags, timeoutFlags...)...),
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 1 {
+				return fmt.Errorf("%w: input passphrase is required", errUsage)
+			}
+			limit, err := newLimiter(c)
+			if err != nil {
+				return err
+			}
+			policy, err := newPolicy(c)
+			if err != nil {
+				return err
+			}
+			out := newOutput(c)
+			if console, ok := out.(*console); ok {
+				console.session = true
+			}
+			defer out.close()
+
+			// Notices go to stderr with --json to keep stdout clean for the
+			// JSON events.
+			var w io.Writer = os.Stdout
+			if c.Bool(jsonFlag.Name) {
+				w = os.Stderr
+			}
+
+			ctx, cancel := withTimeout(c)
+			defer cancel()
+			b, err := client.Browse(ctx, c.Args().First(), peerlink.Options{
+				OnEvent:  out.handle,
+				Timeouts: timeouts(c),
+				Limit:    limit,
+				Cache:    c.String(cacheFlag.Name),
+				Policy:   policy,
+			})
+			if err != nil {
+				out.failed(err)
+				return err
+			}
+			defer b.Close()
+
+			sh := &browseShell{w: w, browser: b, out: out, cwd: "."}
+			if c.IsSet("ls") || c.IsSet("get") {
+				for _, p := range c.StringSlice("ls") {
+					if err := sh.list(ctx, sh.resolve(p)); err != nil {
+						out.failed(err)
+						return err
+					}
+				}
+				for _, p := range c.StringSlice("get") {
+					if err := sh.get(ctx, sh.resolve(p)); err != nil {
+						out.failed(err)
+						return err
+					}
+				}
+				return nil
+			}
+
+			sh.printf("\nBrowsing the directory shared by %s. Type \"help\" for the commands.\n", b.Peer())
+			return sh.run(ctx, readLines(os.Stdin))
+		},
+	}
+}
+
+// browseShell reads commands from the user to walk a share and fetch files
+// from it, one at a time.
+type browseShell struct {
+	w       io.Writer
+	browser *peerlink.Browser
+	out     output
+	// cwd is the current directory, a slash-separated path in the share.
+	cwd string
+}
+
+func (sh *browseShell) printf(format string, args ...any) {
+	fmt.Fprintf(sh.w, format, args...)
+}
+
+// resolve returns the path of the share p refers to from the current
+// directory. A leading slash starts from the shared directory, and nothing
+// goes above it.
+func (sh *browseShell) resolve(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = sh.cwd + "/" + p
+	}
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// run executes the user's commands until they quit, stdin ends or the peer
+// stops sharing.
+func (sh *browseShell) run(ctx context.Context, lines <-chan string) error {
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			command, args, _ := strings.Cut(line, " ")
+			args = strings.TrimSpace(args)
+			var err error
+			switch command {
+			case "":
+			case "ls":
+				err = sh.list(ctx, sh.resolve(args))
+			case "cd":
+				err = sh.cd(ctx, args)
+			case "pwd":
+				if sh.cwd == "." {
+					sh.printf("/\n")
+				} else {
+					sh.printf("/%s\n", sh.cwd)
+				}
+			case "get":
+				paths := strings.Fields(args)
+				if len(paths) == 0 {
+					sh.printf("Usage: get <path>...\n")
+				}
+				for _, p := range paths {
+					if err = sh.get(ctx, sh.resolve(p)); err != nil {
+						break
+					}
+				}
+			case "help":
+				sh.printf(browseHelp)
+			case "quit", "exit":
+				return nil
+			default:
+				sh.printf("Unknown command %q. Type \"help\" for the commands.\n", command)
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				sh.out.failed(err)
+				sh.printf("%v\n", err)
+			}
+		case <-sh.browser.Done():
+			sh.printf("\nThe peer stopped sharing\n")
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (sh *browseShell) list(ctx context.Context, p string) error {
+	entries, err := sh.browser.List(ctx, p)
+	if err != nil {
+		return err
+	}
+	sh.out.listed(p, entries)
+	return nil
+}
+
+func (sh *browseShell) cd(ctx context.Context, arg string) error {
+	if arg == "" {
+		arg = "/"
+	}
+	p := sh.resolve(arg)
+	// Listing the directory checks that it is one
+	if _, err := sh.browser.List(ctx, p); err != nil {
+		return err
+	}
+	sh.cwd = p
+	return nil
+}
+
+// get fetches the file at p into the current directory. A directory is
+// fetched with everything under it into a directory of the same name.
+func (sh *browseShell) get(ctx context.Context, p string) error {
+	if entries, err := sh.browser.List(ctx, p); err == nil {
+		return sh.getDir(ctx, p, path.Base(p), entries)
+	}
+	result, err := sh.browser.Get(ctx, p, peerlink.DirSink("."))
+	if err != nil {
+		return err
+	}
+	sh.out.received(result)
+	return nil
+}
+
+func (sh *browseShell) getDir(ctx context.Context, p, local string, entries []peerlink.ShareEntry) error {
+	if err := os.MkdirAll(local, 0o755); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		// The names come from the peer, which must not steer the files
+		// out of the directory
+		if !protocol.ValidPath(e.Name) || strings.Contains(e.Name, "/") {
+			return fmt.Errorf("invalid name %q in %s", e.Name, p)
+		}
+		child := path.Join(p, e.Name)
+		if e.Dir {
+			sub, err := sh.browser.List(ctx, child)
+			if err != nil {
+				return err
+			}
+			if err := sh.getDir(ctx, child, filepath.Join(local, e.Name), sub); err != nil {
+				return err
+			}
+			continue
+		}
+		result, err := sh.browser.Get(ctx, child, peerlink.DirSink(local))
+		if err != nil {
+			return err
+		}
+		sh.out.received(result)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/urfave/cli/v2"
+)
+
+func syncCommand(client *peerlink.Client) *cli.Command {
+	return &cli.Command{
+		Name:      "sync",
+		Usage:     "Sync a directory, sending only what the receiver's copy lacks",
+		ArgsUsage: "<directory>",
+		Flags: append([]cli.Flag{
+			jsonFlag,
+			&cli.StringFlag{Name: "from", Usage: "receive: bring <directory> up to date with the one offered under `CODE`"},
+			&cli.BoolFlag{Name: "yes", Aliases: []string{"y"}, Usage: "with --from, accept the sync without asking"},
+			publishTimeoutFlag,
+			queryTimeoutFlag,
+			limitFlag,
+		}, timeoutFlags...),
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 1 {
+				return fmt.Errorf("%w: directory is required", errUsage)
+			}
+			dir := c.Args().First()
+			code := c.String("from")
+			if code == "" {
+				if c.IsSet("yes") {
+					return fmt.Errorf("%w: --yes requires --from", errUsage)
+				}
+				if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+					return fmt.Errorf("%w: not a directory: %s", errUsage, dir)
+				}
+			}
+			limit, err := newLimiter(c)
+			if err != nil {
+				return err
+			}
+			out := newOutput(c)
+			defer out.close()
+
+			ctx, cancel := withTimeout(c)
+			defer cancel()
+			opts := peerlink.Options{
+				OnEvent:  out.handle,
+				Timeouts: timeouts(c),
+				Limit:    limit,
+			}
+
+			var result *peerlink.SyncResult
+			if code != "" {
+				opts.Accept = promptAccept(os.Stdout)
+				if c.Bool(jsonFlag.Name) {
+					opts.Accept = promptAccept(os.Stderr)
+				}
+				if c.Bool("yes") {
+					opts.Accept = nil
+				}
+				result, err = client.ReceiveDir(ctx, code, dir, opts)
+			} else {
+				result, err = client.SendDir(ctx, dir, opts)
+			}
+			if err != nil {
+				out.failed(err)
+				return err
+			}
+			out.synced(result)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/urfave/cli/v2"
+)
+
+// timeoutFlags are shared by the commands that run a transfer. Durations
+// left at zero fall back to peerlink.DefaultTimeouts; negative ones disable
+// the limit.
+var timeoutFlags = []cli.Flag{
+	&cli.DurationFlag{Name: "timeout", Usage: "give up if the whole transfer takes longer than this (0 for no limit)"},
+	&cli.DurationFlag{Name: "phase-timeout", Usage: "limit for each protocol exchange such as the handshake", Value: peerlink.DefaultTimeouts.Phase},
+	&cli.DurationFlag{Name: "accept-timeout", Usage: "limit for the receiver to accept the file", Value: peerlink.DefaultTimeouts.Accept},
+	&cli.DurationFlag{Name: "idle-timeout", Usage: "limit for the peer staying silent while data is flowing", Value: peerlink.DefaultTimeouts.Idle},
+}
+
+var (
+	publishTimeoutFlag = &cli.DurationFlag{Name: "publish-timeout", Usage: "limit for announcing the code on the DHT", Value: peerlink.DefaultTimeouts.Publish}
+	queryTimeoutFlag   = &cli.DurationFlag{Name: "query-timeout", Usage: "limit for finding and connecting to the peer", Value: peerlink.DefaultTimeouts.Query}
+)
+
+func timeouts(c *cli.Context) peerlink.Timeouts {
+	return peerlink.Timeouts{
+		Publish: c.Duration("publish-timeout"),
+		Query:   c.Duration("query-timeout"),
+		Phase:   c.Duration("phase-timeout"),
+		Accept:  c.Duration("accept-timeout"),
+		Idle:    c.Duration("idle-timeout"),
+	}
+}
+
+// withTimeout bounds the command's context by --timeout, if set.
+func withTimeout(c *cli.Context) (context.Context, context.CancelFunc) {
+	if d := c.Duration("timeout"); d > 0 {
+		return context.WithTimeout(c.Context, d)
+	}
+	return context.WithCancel(c.Context)
+}
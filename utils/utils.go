@@ -2,11 +2,13 @@ package utils
 
 import (
 	"bufio"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -16,6 +18,10 @@ import (
 	"github.com/libp2p/go-libp2p/core/network"
 )
 
+// ErrDecrypt is returned by Decrypt when data was not sealed with the key or
+// has been tampered with.
+var ErrDecrypt = errors.New("message authentication failed")
+
 func ReadInput() (string, error) {
 	reader := bufio.NewReader(os.Stdin)
 	input, err := reader.ReadString('\n')
@@ -25,6 +31,26 @@ func ReadInput() (string, error) {
 	return strings.TrimSpace(input), nil
 }
 
+// ReadInputContext is like ReadInput but gives up when ctx is done. The
+// abandoned read keeps waiting for a line in the background.
+func ReadInputContext(ctx context.Context) (string, error) {
+	type line struct {
+		text string
+		err  error
+	}
+	result := make(chan line, 1)
+	go func() {
+		text, err := ReadInput()
+		result <- line{text, err}
+	}()
+	select {
+	case l := <-result:
+		return l.text, l.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
 func ReadBytes(stream network.Stream) ([]byte, error) {
 	buf := make([]byte, 1024)
 	n, err := stream.Read(buf)
@@ -83,7 +109,7 @@ func Decrypt(key, data []byte) ([]byte, error) {
 	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Decrypt: failed to decrypt: %w", err)
+		return nil, fmt.Errorf("Decrypt: failed to decrypt: %w", ErrDecrypt)
 	}
 
 	return plaintext, nil
@@ -99,11 +125,12 @@ func HexToBytes(s string) ([]byte, error) {
 	return hex.DecodeString(s)
 }
 
-func CalculateFileHash(file *os.File) ([]byte, error) {
+// CalculateHash returns the SHA-256 checksum of everything read from r.
+func CalculateHash(r io.Reader) ([]byte, error) {
 	hash := sha256.New()
-	_, err := io.Copy(hash, file)
+	_, err := io.Copy(hash, r)
 	if err != nil {
-		return nil, fmt.Errorf("calculateFileHash: failed to calculate file hash: %w", err)
+		return nil, fmt.Errorf("calculateHash: failed to calculate hash: %w", err)
 	}
 	return hash.Sum(nil), nil
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/SyedMa3/peerlink/peerlink"
+	"github.com/urfave/cli/v2"
+)
+
+func watchCommand(client *peerlink.Client) *cli.Command {
+	return &cli.Command{
+		Name:      "watch",
+		Usage:     "Watch a directory, not its subdirectories, and send every new file in it to a peer in a session",
+		ArgsUsage: "<directory>",
+		Flags: append([]cli.Flag{
+			jsonFlag,
+			&cli.StringFlag{Name: "to", Usage: "join the session the peer opened with peerlink session under `CODE`", Required: true},
+			&cli.DurationFlag{Name: "settle", Usage: "send a file once it has stopped changing for this long", Value: 2 * time.Second},
+			&cli.StringFlag{Name: "record", Usage: "keep the record of the files sent in `FILE` (default <directory>/.peerlink-sent)"},
+			&cli.DurationFlag{Name: "resume", Usage: "keep reconnecting to the peer for this long when the connection drops; the peer needs --resume too", Value: 10 * time.Minute},
+			queryTimeoutFlag,
+			limitFlag,
+			preserveFlag,
+		}, timeoutFlags...),
+		Action: func(c *cli.Context) error {
+			if c.NArg() < 1 {
+				return fmt.Errorf("%w: directory is required", errUsage)
+			}
+			dir := c.Args().First()
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				return fmt.Errorf("%w: not a directory: %s", errUsage, dir)
+			}
+			limit, err := newLimiter(c)
+			if err != nil {
+				return err
+			}
+			base := newOutput(c)
+			if console, ok := base.(*console); ok {
+				console.session = true
+			}
+			out := &syncOutput{out: base}
+			defer out.close()
+
+			// Keep stdout clean for the JSON events
+			var w io.Writer = os.Stdout
+			if c.Bool(jsonFlag.Name) {
+				w = os.Stderr
+			}
+
+			ctx, cancel := withTimeout(c)
+			defer cancel()
+			opts := peerlink.Options{
+				OnEvent:  out.handle,
+				Timeouts: timeouts(c),
+				Limit:    limit,
+				Preserve: c.Bool(preserveFlag.Name),
+			}
+			err = client.Watch(ctx, dir, opts, peerlink.WatchOptions{
+				Code:   c.String("to"),
+				Settle: c.Duration("settle"),
+				Record: c.String("record"),
+				Resume: c.Duration("resume"),
+				OnSend: func(path string, result *peerlink.SendResult, err error) {
+					if err != nil {
+						out.failed(err)
+						fmt.Fprintf(w, "Sending %s failed: %v\n", path, err)
+						return
+					}
+					out.sent(result)
+				},
+			})
+			if err != nil {
+				out.failed(err)
+				return err
+			}
+			return nil
+		},
+	}
+}